@@ -0,0 +1,141 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// BlobStore keeps opaque blobs under slash separated keys like "files/ab12.json"
+type BlobStore interface {
+	Put(key string, data []byte) error
+	Get(key string) ([]byte, error)
+	// Has reports whether key exists without reading it
+	Has(key string) (bool, error)
+	Delete(key string) error
+	// List returns every key starting with prefix
+	List(prefix string) ([]string, error)
+}
+
+var (
+	ErrBlobNotFound = errors.New("blob not found")
+	errBadBlobKey   = errors.New("invalid blob key")
+)
+
+// LocalBlobStore keeps every blob in its own file below dir
+type LocalBlobStore struct {
+	dir string
+}
+
+func NewLocalBlobStore(dir string) (*LocalBlobStore, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &LocalBlobStore{dir: dir}, nil
+}
+
+// path maps key into dir, keys that would leave dir are rejected
+func (s *LocalBlobStore) path(key string) (string, error) {
+	if key == "" || strings.HasPrefix(key, "/") {
+		return "", errBadBlobKey
+	}
+	for _, part := range strings.Split(key, "/") {
+		if part == "" || part == "." || part == ".." {
+			return "", errBadBlobKey
+		}
+	}
+	return filepath.Join(s.dir, filepath.FromSlash(key)), nil
+}
+
+// Put writes to a temp file and renames it, a crash never leaves half a blob
+func (s *LocalBlobStore) Put(key string, data []byte) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func (s *LocalBlobStore) Get(key string) ([]byte, error) {
+	path, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, ErrBlobNotFound
+	}
+	return data, err
+}
+
+func (s *LocalBlobStore) Has(key string) (bool, error) {
+	path, err := s.path(key)
+	if err != nil {
+		return false, err
+	}
+	info, err := os.Stat(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	// a directory is a key prefix, not a blob
+	return !info.IsDir(), nil
+}
+
+// Delete removes key, deleting a missing key is not an error
+func (s *LocalBlobStore) Delete(key string) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+func (s *LocalBlobStore) List(prefix string) ([]string, error) {
+	var keys []string
+	err := filepath.WalkDir(s.dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || strings.HasPrefix(d.Name(), ".tmp-") {
+			return nil
+		}
+		rel, err := filepath.Rel(s.dir, path)
+		if err != nil {
+			return err
+		}
+		if key := filepath.ToSlash(rel); strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+		return nil
+	})
+	return keys, err
+}
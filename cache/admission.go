@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math/bits"
+)
+
+/*
+
+AdmissionPolicy - interface{}
+  Record(key)           -> every access (hit, miss, write)
+  Admit(candidate, victim) -> should candidate replace victim in memory?
+
+AlwaysAdmit - admits everything, the old behaviour
+
+TinyLFU - struct
+- count-min sketch of 4 rows of 4 bit counters
+- counters are halved every sampleSize records so old popularity fades
+- candidate is admitted only if it is estimated to be more frequent than the victim
+
+*/
+
+type AdmissionPolicy interface {
+	Record(key Key)
+	Admit(candidate Key, victim Key) bool
+}
+
+type AlwaysAdmit struct{}
+
+func (a *AlwaysAdmit) Record(key Key) {}
+
+func (a *AlwaysAdmit) Admit(candidate Key, victim Key) bool {
+	return true
+}
+
+const (
+	sketchDepth      = 4
+	sketchMaxCounter = 15
+)
+
+type TinyLFU struct {
+	rows       [sketchDepth][]uint8
+	mask       uint64
+	samples    int
+	sampleSize int
+}
+
+// NewTinyLFU sizes the sketch for a memory tier holding capacity keys
+func NewTinyLFU(capacity int) *TinyLFU {
+	if capacity < 1 {
+		capacity = 1
+	}
+	width := 1 << bits.Len(uint(capacity*4-1))
+
+	t := &TinyLFU{
+		mask:       uint64(width - 1),
+		sampleSize: capacity * 10,
+	}
+	for i := range t.rows {
+		t.rows[i] = make([]uint8, width)
+	}
+	return t
+}
+
+func (t *TinyLFU) Record(key Key) {
+	h := hashKey(key)
+	for i := range t.rows {
+		idx := t.index(h, i)
+		if t.rows[i][idx] < sketchMaxCounter {
+			t.rows[i][idx]++
+		}
+	}
+
+	t.samples++
+	if t.samples >= t.sampleSize {
+		t.reset()
+	}
+}
+
+func (t *TinyLFU) Admit(candidate Key, victim Key) bool {
+	return t.Estimate(candidate) > t.Estimate(victim)
+}
+
+// Estimate returns the approximate access count of key
+func (t *TinyLFU) Estimate(key Key) int {
+	h := hashKey(key)
+	min := uint8(sketchMaxCounter)
+	for i := range t.rows {
+		if c := t.rows[i][t.index(h, i)]; c < min {
+			min = c
+		}
+	}
+	return int(min)
+}
+
+// reset halves every counter so the sketch follows recent popularity
+func (t *TinyLFU) reset() {
+	for i := range t.rows {
+		for j := range t.rows[i] {
+			t.rows[i][j] >>= 1
+		}
+	}
+	t.samples /= 2
+}
+
+func (t *TinyLFU) index(h uint64, row int) uint64 {
+	h2 := h>>32 | 1
+	return (h + uint64(row)*h2) & t.mask
+}
+
+// hashKey hashes the value of a key, the expiry is not part of its identity
+func hashKey(key Key) uint64 {
+	hasher := fnv.New64a()
+	switch v := key.value.(type) {
+	case string:
+		hasher.Write([]byte(v))
+	default:
+		fmt.Fprintf(hasher, "%T:%v", v, v)
+	}
+	h := hasher.Sum64()
+	// fnv leaves the high bits weak for short keys, mix them before use
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	return h
+}
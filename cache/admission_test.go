@@ -0,0 +1,110 @@
+package main
+
+import "testing"
+
+// inMemory reports whether key is in the memory tier of mu
+func inMemory(mu *MultiCache, key Key) bool {
+	mu.mut.Lock()
+	defer mu.mut.Unlock()
+	_, exists := mu.c.store[key]
+	return exists
+}
+
+func TestTinyLFUPrefersFrequentKeys(t *testing.T) {
+	tiny := NewTinyLFU(64)
+	hot, cold := Key{value: "hot"}, Key{value: "cold"}
+	for i := 0; i < 10; i++ {
+		tiny.Record(hot)
+	}
+	tiny.Record(cold)
+
+	if tiny.Admit(cold, hot) {
+		t.Error("cold key admitted over a hot victim")
+	}
+	if !tiny.Admit(hot, cold) {
+		t.Error("hot key rejected over a cold victim")
+	}
+	if got := tiny.Estimate(Key{value: "never"}); got != 0 {
+		t.Errorf("unseen key estimated at %d", got)
+	}
+}
+
+func TestTinyLFUForgetsOldPopularity(t *testing.T) {
+	tiny := NewTinyLFU(8) // halves every 80 records
+	old := Key{value: "old"}
+	for i := 0; i < 15; i++ {
+		tiny.Record(old)
+	}
+	for i := 0; i < 200; i++ {
+		tiny.Record(Key{value: i})
+	}
+	if got := tiny.Estimate(old); got > 3 {
+		t.Errorf("old key still estimated at %d", got)
+	}
+}
+
+func TestAdmissionRejectsColdAndPromotesHot(t *testing.T) {
+	mu, err := NewMultiCache(2, newLRU(2), t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mu.Close()
+	mu.SetAdmissionPolicy(NewTinyLFU(64))
+
+	a, b := Key{value: "a"}, Key{value: "b"}
+	mu.SetKey(a, Value{value: 1})
+	mu.SetKey(b, Value{value: 2})
+	for i := 0; i < 5; i++ {
+		mu.LookupKey(a)
+		mu.LookupKey(b)
+	}
+
+	// a one-off write does not push a hot key out of memory
+	cold := Key{value: "cold"}
+	mu.SetKey(cold, Value{value: 3})
+	if inMemory(mu, cold) || !inMemory(mu, a) || !inMemory(mu, b) {
+		t.Fatal("cold key was admitted into memory")
+	}
+	if value, found := mu.LookupKey(cold); !found || value.value != 3 {
+		t.Fatalf("cold key = %v %v, want it served from disk", value.value, found)
+	}
+
+	// once it is read more often than the victim it is promoted
+	for i := 0; i < 10 && !inMemory(mu, cold); i++ {
+		mu.LookupKey(cold)
+	}
+	if !inMemory(mu, cold) {
+		t.Fatal("hot disk key never promoted")
+	}
+	if mu.dc.Exists(cold) {
+		t.Error("promoted key still on disk")
+	}
+	demoted := 0
+	for _, key := range []Key{a, b} {
+		if !inMemory(mu, key) && mu.dc.Exists(key) {
+			demoted++
+		}
+	}
+	if demoted != 1 {
+		t.Errorf("%d keys demoted to disk by the promotion, want 1", demoted)
+	}
+}
+
+func TestAlwaysAdmitPromotesOnFirstHit(t *testing.T) {
+	mu, err := NewMultiCache(1, newLRU(1), t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mu.Close()
+
+	a, b := Key{value: "a"}, Key{value: "b"}
+	mu.SetKey(a, Value{value: 1})
+	mu.SetKey(b, Value{value: 2}) // demotes a
+	if inMemory(mu, a) || !mu.dc.Exists(a) {
+		t.Fatal("a was not demoted")
+	}
+	mu.LookupKey(a)
+	if !inMemory(mu, a) || inMemory(mu, b) {
+		t.Error("disk hit not promoted")
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import "container/list"
+
+/*
+
+ARC - Adaptive Replacement Cache
+- t1 : resident keys seen once recently
+- t2 : resident keys seen at least twice
+- b1 : ghost keys evicted from t1
+- b2 : ghost keys evicted from t2
+- p  : target size of t1, grows on b1 hits and shrinks on b2 hits
+
+MultiCache evicts through check() before it calls setValue() for the new key,
+so check() runs the REPLACE step and setValue() adapts p and trims the ghosts.
+
+*/
+
+type ARC struct {
+	capacity int
+	p        int
+	t1       *list.List
+	t2       *list.List
+	b1       *list.List
+	b2       *list.List
+	where    map[Key]*list.Element
+	lists    map[Key]*list.List
+}
+
+func NewARC(capacity int) *ARC {
+	arc := &ARC{capacity: capacity}
+	arc.Initalize()
+	return arc
+}
+
+func (a *ARC) Initalize() {
+	a.p = 0
+	a.t1 = list.New()
+	a.t2 = list.New()
+	a.b1 = list.New()
+	a.b2 = list.New()
+	a.where = make(map[Key]*list.Element)
+	a.lists = make(map[Key]*list.List)
+}
+
+func (a *ARC) setValue(key Key) {
+	switch a.lists[key] {
+	case a.t1, a.t2:
+		a.move(key, a.t2)
+	case a.b1:
+		a.p = min(a.capacity, a.p+max(a.b2.Len()/a.b1.Len(), 1))
+		a.move(key, a.t2)
+	case a.b2:
+		a.p = max(0, a.p-max(a.b1.Len()/a.b2.Len(), 1))
+		a.move(key, a.t2)
+	default:
+		a.move(key, a.t1)
+	}
+	a.trimGhosts()
+}
+
+func (a *ARC) check() Key {
+	from, to := a.replaceLists()
+	if from == nil {
+		return Key{}
+	}
+	key := from.Back().Value.(Key)
+	a.move(key, to)
+	a.trimGhosts()
+	return key
+}
+
+// victim returns the key check would evict, without evicting it
+func (a *ARC) victim() Key {
+	from, _ := a.replaceLists()
+	if from == nil {
+		return Key{}
+	}
+	return from.Back().Value.(Key)
+}
+
+func (a *ARC) removeKey(key Key) {
+	if l, exists := a.lists[key]; exists {
+		l.Remove(a.where[key])
+		delete(a.where, key)
+		delete(a.lists, key)
+	}
+}
+
+// replaceLists picks the resident list to evict from and the ghost list the key goes to
+func (a *ARC) replaceLists() (*list.List, *list.List) {
+	if a.t1.Len() > 0 && (a.t1.Len() > a.p || a.t2.Len() == 0) {
+		return a.t1, a.b1
+	}
+	if a.t2.Len() > 0 {
+		return a.t2, a.b2
+	}
+	return nil, nil
+}
+
+// trimGhosts keeps |t1|+|b1| <= c and the whole directory <= 2c
+func (a *ARC) trimGhosts() {
+	for a.b1.Len() > 0 && a.t1.Len()+a.b1.Len() > a.capacity {
+		a.removeKey(a.b1.Back().Value.(Key))
+	}
+	for a.t1.Len()+a.t2.Len()+a.b1.Len()+a.b2.Len() > 2*a.capacity {
+		if a.b2.Len() > 0 {
+			a.removeKey(a.b2.Back().Value.(Key))
+		} else if a.b1.Len() > 0 {
+			a.removeKey(a.b1.Back().Value.(Key))
+		} else {
+			break
+		}
+	}
+}
+
+// move puts key at the MRU end of l, taking it out of whichever list held it
+func (a *ARC) move(key Key, l *list.List) {
+	a.removeKey(key)
+	a.where[key] = l.PushFront(key)
+	a.lists[key] = l
+}
@@ -0,0 +1,403 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+/*
+
+BackingStore - interface{}
+  Load / Store / Delete against the system of record
+
+WriteMode
+- CacheOnly    : the store is never written (default)
+- WriteThrough : SetKey / DeleteKey write the store first, the cache only
+                 changes if the store accepted the write
+- WriteBehind  : the cache changes right away, writes are queued and flushed
+                 in batches by a go routine. Several writes to one key before
+                 a flush are coalesced into the last one. Close flushes
+                 whatever is still queued.
+
+ReadThrough - a miss in both tiers is loaded from the store and cached
+
+*/
+
+type BackingStore interface {
+	// Load returns the stored value, found is false if the store does not have key
+	Load(key Key) (value Value, found bool, err error)
+	Store(key Key, value Value) error
+	Delete(key Key) error
+}
+
+// BatchStore is implemented by stores that can take a write-behind flush in one call
+type BatchStore interface {
+	BackingStore
+	StoreBatch(writes []StoreWrite) error
+}
+
+// StoreWrite is one queued write-behind operation
+type StoreWrite struct {
+	Key     Key
+	Value   Value
+	Deleted bool
+}
+
+type WriteMode int
+
+const (
+	CacheOnly WriteMode = iota
+	WriteThrough
+	WriteBehind
+)
+
+type StoreOptions struct {
+	WriteMode   WriteMode
+	ReadThrough bool
+
+	// write-behind only, a flush happens every FlushInterval or as soon as
+	// BatchSize keys are queued
+	FlushInterval time.Duration
+	BatchSize     int
+}
+
+const (
+	defaultFlushInterval = time.Second
+	defaultBatchSize     = 100
+)
+
+var errStoreAttached = errors.New("a backing store is already attached")
+
+// backingLink ties a MultiCache to its store, a nil link means no store
+type backingLink struct {
+	store   BackingStore
+	options StoreOptions
+	behind  *writeBehind
+}
+
+// SetBackingStore attaches store to the cache. It can only be called once.
+func (mu *MultiCache) SetBackingStore(store BackingStore, options StoreOptions) error {
+	mu.mut.Lock()
+	defer mu.mut.Unlock()
+
+	if mu.backing != nil {
+		return errStoreAttached
+	}
+
+	link := &backingLink{store: store, options: options}
+	if options.WriteMode == WriteBehind {
+		if options.FlushInterval <= 0 {
+			options.FlushInterval = defaultFlushInterval
+		}
+		if options.BatchSize <= 0 {
+			options.BatchSize = defaultBatchSize
+		}
+		link.options = options
+		link.behind = newWriteBehind(store, options.FlushInterval, options.BatchSize)
+	}
+	mu.backing = link
+	return nil
+}
+
+// Flush writes out the queued write-behind writes now
+func (mu *MultiCache) Flush() error {
+	mu.mut.Lock()
+	backing := mu.backing
+	mu.mut.Unlock()
+
+	if backing == nil || backing.behind == nil {
+		return nil
+	}
+	return backing.behind.flush()
+}
+
+// readThrough loads key from the store after a miss in both tiers. The load
+// runs without the cache lock, if the key was set meanwhile that value wins.
+func (mu *MultiCache) readThrough(backing *backingLink, key Key) (Value, bool) {
+	if backing.behind != nil {
+		// the store is behind the cache, a queued write is the latest value
+		if write, queued := backing.behind.pending(key); queued {
+			return write.Value, !write.Deleted
+		}
+	}
+
+	start := time.Now()
+	value, found, err := backing.store.Load(key)
+	mu.RecordLoad(key, time.Since(start), err)
+	if err != nil {
+		fmt.Println("unable to load key ", key.value, " from backing store : ", err)
+		return Value{}, false
+	}
+	if !found {
+		return Value{}, false
+	}
+
+	mu.mut.Lock()
+	defer mu.mut.Unlock()
+
+	if cached, exists := mu.c.store[key]; exists && !cached.expired(time.Now()) {
+		return cached, true
+	}
+	mu.set(key, value, mu.defaultTTL)
+	return value, true
+}
+
+func (b *backingLink) write(key Key, value Value) error {
+	if b == nil {
+		return nil
+	}
+	switch b.options.WriteMode {
+	case WriteThrough:
+		return b.store.Store(key, Value{value: value.value})
+	case WriteBehind:
+		b.behind.enqueue(StoreWrite{Key: key, Value: Value{value: value.value}})
+	}
+	return nil
+}
+
+func (b *backingLink) delete(key Key) error {
+	if b == nil {
+		return nil
+	}
+	switch b.options.WriteMode {
+	case WriteThrough:
+		return b.store.Delete(key)
+	case WriteBehind:
+		b.behind.enqueue(StoreWrite{Key: key, Deleted: true})
+	}
+	return nil
+}
+
+func (b *backingLink) close() error {
+	if b == nil || b.behind == nil {
+		return nil
+	}
+	return b.behind.close()
+}
+
+type writeBehind struct {
+	store     BackingStore
+	queue     map[Key]StoreWrite
+	inflight  map[Key]StoreWrite
+	batchSize int
+	interval  time.Duration
+	kick      chan struct{}
+	done      chan struct{}
+	stopped   chan struct{}
+	flushMu   sync.Mutex
+	mu        sync.Mutex
+}
+
+func newWriteBehind(store BackingStore, interval time.Duration, batchSize int) *writeBehind {
+	wb := &writeBehind{
+		store:     store,
+		queue:     make(map[Key]StoreWrite),
+		batchSize: batchSize,
+		interval:  interval,
+		kick:      make(chan struct{}, 1),
+		done:      make(chan struct{}),
+		stopped:   make(chan struct{}),
+	}
+	go wb.run()
+	return wb
+}
+
+// enqueue replaces any queued write for the same key
+func (wb *writeBehind) enqueue(write StoreWrite) {
+	wb.mu.Lock()
+	wb.queue[write.Key] = write
+	full := len(wb.queue) >= wb.batchSize
+	wb.mu.Unlock()
+
+	if full {
+		select {
+		case wb.kick <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (wb *writeBehind) pending(key Key) (StoreWrite, bool) {
+	wb.mu.Lock()
+	defer wb.mu.Unlock()
+	if write, queued := wb.queue[key]; queued {
+		return write, true
+	}
+	write, queued := wb.inflight[key]
+	return write, queued
+}
+
+func (wb *writeBehind) run() {
+	defer close(wb.stopped)
+
+	ticker := time.NewTicker(wb.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-wb.done:
+			return
+		case <-ticker.C:
+		case <-wb.kick:
+		}
+		if err := wb.flush(); err != nil {
+			fmt.Println("write-behind flush failed, will retry : ", err)
+		}
+	}
+}
+
+// flush writes the queue out in batches. Writes that fail go back on the
+// queue unless a newer write for the same key arrived in the meantime.
+func (wb *writeBehind) flush() error {
+	wb.flushMu.Lock()
+	defer wb.flushMu.Unlock()
+
+	wb.mu.Lock()
+	queue := wb.queue
+	wb.queue = make(map[Key]StoreWrite)
+	wb.inflight = queue
+	wb.mu.Unlock()
+
+	defer func() {
+		wb.mu.Lock()
+		wb.inflight = nil
+		wb.mu.Unlock()
+	}()
+
+	writes := make([]StoreWrite, 0, len(queue))
+	for _, write := range queue {
+		writes = append(writes, write)
+	}
+
+	for start := 0; start < len(writes); start += wb.batchSize {
+		end := min(start+wb.batchSize, len(writes))
+		if err := wb.writeBatch(writes[start:end]); err != nil {
+			wb.requeue(writes[start:])
+			return err
+		}
+	}
+	return nil
+}
+
+func (wb *writeBehind) writeBatch(writes []StoreWrite) error {
+	if batch, ok := wb.store.(BatchStore); ok {
+		return batch.StoreBatch(writes)
+	}
+	for _, write := range writes {
+		var err error
+		if write.Deleted {
+			err = wb.store.Delete(write.Key)
+		} else {
+			err = wb.store.Store(write.Key, write.Value)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (wb *writeBehind) requeue(writes []StoreWrite) {
+	wb.mu.Lock()
+	defer wb.mu.Unlock()
+	for _, write := range writes {
+		if _, newer := wb.queue[write.Key]; !newer {
+			wb.queue[write.Key] = write
+		}
+	}
+}
+
+// close stops the flusher and writes out everything still queued
+func (wb *writeBehind) close() error {
+	close(wb.done)
+	<-wb.stopped
+	return wb.flush()
+}
+
+// MemoryStore is an in memory BackingStore, handy as a fake in tests
+type MemoryStore struct {
+	data    map[Key]interface{}
+	stores  int
+	deletes int
+	batches int
+	fail    error
+	mu      sync.Mutex
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{data: make(map[Key]interface{})}
+}
+
+func (s *MemoryStore) Load(key Key) (Value, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.fail != nil {
+		return Value{}, false, s.fail
+	}
+	value, found := s.data[key]
+	return Value{value: value}, found, nil
+}
+
+func (s *MemoryStore) Store(key Key, value Value) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.fail != nil {
+		return s.fail
+	}
+	s.data[key] = value.value
+	s.stores++
+	return nil
+}
+
+func (s *MemoryStore) Delete(key Key) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.fail != nil {
+		return s.fail
+	}
+	delete(s.data, key)
+	s.deletes++
+	return nil
+}
+
+func (s *MemoryStore) StoreBatch(writes []StoreWrite) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.fail != nil {
+		return s.fail
+	}
+	for _, write := range writes {
+		if write.Deleted {
+			delete(s.data, write.Key)
+			s.deletes++
+		} else {
+			s.data[write.Key] = write.Value.value
+			s.stores++
+		}
+	}
+	s.batches++
+	return nil
+}
+
+// SetFail makes every call return err until it is called again with nil
+func (s *MemoryStore) SetFail(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.fail = err
+}
+
+// Counts returns how many keys were stored and deleted and how many batches came in
+func (s *MemoryStore) Counts() (stores int, deletes int, batches int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.stores, s.deletes, s.batches
+}
+
+// Len returns the number of stored keys
+func (s *MemoryStore) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.data)
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func newBackedCache(t *testing.T, options StoreOptions) (*MultiCache, *MemoryStore) {
+	t.Helper()
+
+	mu, err := NewMultiCache(2, newLRU(2), t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := NewMemoryStore()
+	if err := mu.SetBackingStore(store, options); err != nil {
+		t.Fatal(err)
+	}
+	return mu, store
+}
+
+func TestWriteThrough(t *testing.T) {
+	mu, store := newBackedCache(t, StoreOptions{WriteMode: WriteThrough})
+	defer mu.Close()
+
+	if err := mu.SetKey(Key{value: "a"}, Value{value: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if value, found, _ := store.Load(Key{value: "a"}); !found || value.value != 1 {
+		t.Fatalf("store has %v %v, want 1", value.value, found)
+	}
+
+	store.SetFail(errors.New("store down"))
+	if err := mu.SetKey(Key{value: "b"}, Value{value: 2}); err == nil {
+		t.Fatal("SetKey succeeded with the store down")
+	}
+	if _, found := mu.LookupKey(Key{value: "b"}); found {
+		t.Error("failed write-through reached the cache")
+	}
+	if _, err := mu.DeleteKey(Key{value: "a"}); err == nil {
+		t.Error("DeleteKey succeeded with the store down")
+	}
+	if _, found := mu.LookupKey(Key{value: "a"}); !found {
+		t.Error("failed delete removed the key from the cache")
+	}
+}
+
+func TestWriteBehindCoalescesAndFlushesOnClose(t *testing.T) {
+	mu, store := newBackedCache(t, StoreOptions{WriteMode: WriteBehind, FlushInterval: time.Hour, BatchSize: 100})
+
+	for i := 0; i < 10; i++ {
+		mu.SetKey(Key{value: "counter"}, Value{value: i})
+	}
+	mu.SetKey(Key{value: "temp"}, Value{value: "x"})
+	mu.DeleteKey(Key{value: "temp"})
+
+	if store.Len() != 0 {
+		t.Fatal("write-behind wrote before a flush")
+	}
+	if err := mu.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	stores, deletes, batches := store.Counts()
+	if stores != 1 || deletes != 1 || batches != 1 {
+		t.Errorf("%d stores, %d deletes in %d batches, want 1, 1, 1", stores, deletes, batches)
+	}
+	if value, _, _ := store.Load(Key{value: "counter"}); value.value != 9 {
+		t.Errorf("store has counter %v, want the last write 9", value.value)
+	}
+}
+
+func TestWriteBehindFlushesFullBatch(t *testing.T) {
+	mu, store := newBackedCache(t, StoreOptions{WriteMode: WriteBehind, FlushInterval: time.Hour, BatchSize: 5})
+	defer mu.Close()
+
+	for i := 0; i < 5; i++ {
+		mu.SetKey(Key{value: i}, Value{value: i})
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for store.Len() < 5 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if store.Len() != 5 {
+		t.Fatalf("store has %d keys after a full batch, want 5", store.Len())
+	}
+}
+
+func TestWriteBehindRetriesFailedFlush(t *testing.T) {
+	mu, store := newBackedCache(t, StoreOptions{WriteMode: WriteBehind, FlushInterval: time.Hour})
+	defer mu.Close()
+
+	mu.SetKey(Key{value: "a"}, Value{value: 1})
+	store.SetFail(errors.New("store down"))
+	if err := mu.Flush(); err == nil {
+		t.Fatal("Flush succeeded with the store down")
+	}
+
+	store.SetFail(nil)
+	if err := mu.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if value, found, _ := store.Load(Key{value: "a"}); !found || value.value != 1 {
+		t.Errorf("store has %v %v after retry, want 1", value.value, found)
+	}
+}
+
+func TestReadThrough(t *testing.T) {
+	mu, store := newBackedCache(t, StoreOptions{ReadThrough: true})
+	defer mu.Close()
+
+	store.Store(Key{value: "a"}, Value{value: "from store"})
+	if value, found := mu.LookupKey(Key{value: "a"}); !found || value.value != "from store" {
+		t.Fatalf("read-through returned %v %v", value.value, found)
+	}
+
+	store.Delete(Key{value: "a"})
+	if _, found := mu.LookupKey(Key{value: "a"}); !found {
+		t.Error("read-through value was not cached")
+	}
+	if _, found := mu.LookupKey(Key{value: "b"}); found {
+		t.Error("missing key found")
+	}
+	if stats := mu.Stats(); stats.Loads != 2 {
+		t.Errorf("%d loads recorded, want 2", stats.Loads)
+	}
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+)
+
+/*
+
+InvalidationBus - interface{}
+  Join(invalidate) BusMember
+  a cache joins with its Invalidate, the member it gets back publishes the
+  keys the cache changed. A member never receives its own keys.
+
+  LocalBus - caches in the same process, delivery is synchronous
+  TCPBus   - caches in different processes, connected to one BusHub
+
+BusHub
+- accepts TCPBus connections
+- relays every busMessage to every other connection
+
+*/
+
+type InvalidationBus interface {
+	Join(invalidate func(key Key)) BusMember
+}
+
+type BusMember interface {
+	Publish(key Key) error
+	Leave()
+}
+
+// busMembers is the member list LocalBus and TCPBus share
+type busMembers struct {
+	members map[*busMember]struct{}
+	mu      sync.Mutex
+}
+
+type busMember struct {
+	invalidate func(key Key)
+	publish    func(from *busMember, key Key) error
+	leave      func(m *busMember)
+}
+
+func (m *busMember) Publish(key Key) error {
+	return m.publish(m, key)
+}
+
+func (m *busMember) Leave() {
+	m.leave(m)
+}
+
+func (b *busMembers) join(invalidate func(key Key), publish func(from *busMember, key Key) error) *busMember {
+	m := &busMember{invalidate: invalidate, publish: publish, leave: b.remove}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.members == nil {
+		b.members = make(map[*busMember]struct{})
+	}
+	b.members[m] = struct{}{}
+	return m
+}
+
+func (b *busMembers) remove(m *busMember) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.members, m)
+}
+
+// deliver invalidates key on every member except from, from may be nil. The
+// callbacks run without b.mu so a member can leave from inside one.
+func (b *busMembers) deliver(from *busMember, key Key) {
+	b.mu.Lock()
+	targets := make([]*busMember, 0, len(b.members))
+	for m := range b.members {
+		if m != from {
+			targets = append(targets, m)
+		}
+	}
+	b.mu.Unlock()
+
+	for _, m := range targets {
+		m.invalidate(key)
+	}
+}
+
+// LocalBus connects caches in one process
+type LocalBus struct {
+	members busMembers
+}
+
+func NewLocalBus() *LocalBus {
+	return &LocalBus{}
+}
+
+func (b *LocalBus) Join(invalidate func(key Key)) BusMember {
+	return b.members.join(invalidate, func(from *busMember, key Key) error {
+		b.members.deliver(from, key)
+		return nil
+	})
+}
+
+type busMessage struct {
+	Key interface{}
+}
+
+var errBusClosed = errors.New("invalidation bus is closed")
+
+// TCPBus is one connection to a BusHub. Keys published by a member go to the
+// hub and to the other members on the same TCPBus.
+type TCPBus struct {
+	conn    net.Conn
+	enc     *gob.Encoder
+	members busMembers
+	closed  bool
+	writeMu sync.Mutex
+}
+
+// DialBus connects to the BusHub listening on addr
+func DialBus(addr string) (*TCPBus, error) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	bus := &TCPBus{conn: conn, enc: gob.NewEncoder(conn)}
+	go bus.receive()
+	return bus, nil
+}
+
+func (b *TCPBus) Join(invalidate func(key Key)) BusMember {
+	return b.members.join(invalidate, b.publish)
+}
+
+func (b *TCPBus) publish(from *busMember, key Key) error {
+	b.members.deliver(from, key)
+
+	b.writeMu.Lock()
+	defer b.writeMu.Unlock()
+	if b.closed {
+		return errBusClosed
+	}
+	return b.enc.Encode(busMessage{Key: key.value})
+}
+
+// receive hands keys from the hub to every member until the connection closes
+func (b *TCPBus) receive() {
+	dec := gob.NewDecoder(b.conn)
+	for {
+		var msg busMessage
+		if err := dec.Decode(&msg); err != nil {
+			return
+		}
+		b.members.deliver(nil, Key{value: msg.Key})
+	}
+}
+
+// Close disconnects from the hub, members stop receiving remote keys
+func (b *TCPBus) Close() error {
+	b.writeMu.Lock()
+	defer b.writeMu.Unlock()
+	if b.closed {
+		return nil
+	}
+	b.closed = true
+	return b.conn.Close()
+}
+
+// BusHub relays invalidations between TCPBus connections
+type BusHub struct {
+	listener net.Listener
+	conns    map[net.Conn]*hubConn
+	closed   bool
+	mu       sync.Mutex
+	wg       sync.WaitGroup
+}
+
+type hubConn struct {
+	conn net.Conn
+	enc  *gob.Encoder
+	mu   sync.Mutex
+}
+
+func NewBusHub() *BusHub {
+	return &BusHub{conns: make(map[net.Conn]*hubConn)}
+}
+
+// Serve accepts connections on l until Close is called
+func (h *BusHub) Serve(l net.Listener) error {
+	h.mu.Lock()
+	if h.closed {
+		h.mu.Unlock()
+		l.Close()
+		return errBusClosed
+	}
+	h.listener = l
+	h.mu.Unlock()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			h.mu.Lock()
+			closed := h.closed
+			h.mu.Unlock()
+			if closed {
+				return nil
+			}
+			return err
+		}
+
+		h.mu.Lock()
+		if h.closed {
+			h.mu.Unlock()
+			conn.Close()
+			return nil
+		}
+		h.conns[conn] = &hubConn{conn: conn, enc: gob.NewEncoder(conn)}
+		h.wg.Add(1)
+		h.mu.Unlock()
+
+		go h.relay(conn)
+	}
+}
+
+// relay forwards every message read from conn to the other connections
+func (h *BusHub) relay(conn net.Conn) {
+	defer h.wg.Done()
+	defer func() {
+		h.mu.Lock()
+		delete(h.conns, conn)
+		h.mu.Unlock()
+		conn.Close()
+	}()
+
+	dec := gob.NewDecoder(conn)
+	for {
+		var msg busMessage
+		if err := dec.Decode(&msg); err != nil {
+			return
+		}
+
+		h.mu.Lock()
+		targets := make([]*hubConn, 0, len(h.conns))
+		for other, hc := range h.conns {
+			if other != conn {
+				targets = append(targets, hc)
+			}
+		}
+		h.mu.Unlock()
+
+		for _, hc := range targets {
+			hc.mu.Lock()
+			err := hc.enc.Encode(msg)
+			hc.mu.Unlock()
+			if err != nil {
+				fmt.Println("unable to relay invalidation to ", hc.conn.RemoteAddr(), " : ", err)
+			}
+		}
+	}
+}
+
+// Close stops accepting, drops every connection and waits for the relays
+func (h *BusHub) Close() error {
+	h.mu.Lock()
+	if h.closed {
+		h.mu.Unlock()
+		return nil
+	}
+	h.closed = true
+	var err error
+	if h.listener != nil {
+		err = h.listener.Close()
+	}
+	for conn := range h.conns {
+		conn.Close()
+	}
+	h.mu.Unlock()
+
+	h.wg.Wait()
+	return err
+}
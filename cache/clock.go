@@ -0,0 +1,108 @@
+package main
+
+import "container/list"
+
+/*
+
+Clock - second chance
+- ring of keys with a referenced bit
+- hits only set the bit, no list reordering
+- the hand skips (and clears) referenced keys and evicts the first unreferenced one
+
+*/
+
+type clockEntry struct {
+	key        Key
+	referenced bool
+}
+
+type Clock struct {
+	ring *list.List
+	hand *list.Element
+	m    map[Key]*list.Element
+}
+
+func NewClock() *Clock {
+	c := &Clock{}
+	c.Initalize()
+	return c
+}
+
+func (c *Clock) Initalize() {
+	c.ring = list.New()
+	c.hand = nil
+	c.m = make(map[Key]*list.Element)
+}
+
+func (c *Clock) setValue(key Key) {
+	if elem, found := c.m[key]; found {
+		elem.Value.(*clockEntry).referenced = true
+		return
+	}
+
+	// new keys go right behind the hand so they get a full sweep
+	entry := &clockEntry{key: key}
+	if c.hand == nil {
+		c.m[key] = c.ring.PushBack(entry)
+		c.hand = c.m[key]
+		return
+	}
+	c.m[key] = c.ring.InsertBefore(entry, c.hand)
+}
+
+func (c *Clock) check() Key {
+	if c.hand == nil {
+		return Key{}
+	}
+	for {
+		entry := c.hand.Value.(*clockEntry)
+		if !entry.referenced {
+			c.removeKey(entry.key)
+			return entry.key
+		}
+		entry.referenced = false
+		c.advance()
+	}
+}
+
+// victim returns the key check would evict, without evicting it
+func (c *Clock) victim() Key {
+	if c.hand == nil {
+		return Key{}
+	}
+	elem := c.hand
+	for i := 0; i < c.ring.Len(); i++ {
+		if !elem.Value.(*clockEntry).referenced {
+			return elem.Value.(*clockEntry).key
+		}
+		elem = c.next(elem)
+	}
+	// every bit is set, a full sweep clears them and lands back on the hand
+	return c.hand.Value.(*clockEntry).key
+}
+
+func (c *Clock) removeKey(key Key) {
+	elem, found := c.m[key]
+	if !found {
+		return
+	}
+	if elem == c.hand {
+		c.advance()
+		if c.hand == elem {
+			c.hand = nil
+		}
+	}
+	c.ring.Remove(elem)
+	delete(c.m, key)
+}
+
+func (c *Clock) advance() {
+	c.hand = c.next(c.hand)
+}
+
+func (c *Clock) next(elem *list.Element) *list.Element {
+	if elem.Next() != nil {
+		return elem.Next()
+	}
+	return c.ring.Front()
+}
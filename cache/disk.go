@@ -0,0 +1,352 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+/*
+
+DiskCache - append only segment file
+- data.log  -> [length uint32][crc32 uint32][gob(diskRecord)] ...
+- index     -> map[Key]diskEntry (offset + size + expiry of the latest record)
+
+SetKey / ChangeCapacity evict into the segment, GetKey reads through the index.
+Overwritten and removed records stay in the file as garbage until Compact
+rewrites the live records into a fresh segment and renames it over the old one.
+
+On start the segment is replayed to rebuild the index, records that expired
+while the process was down are left out. A torn record at the tail (crash in
+the middle of a write) is truncated away. A record whose checksum is fine but
+that does not decode, e.g. a value type nobody registered with gob yet, is not
+torn: opening fails and the segment is left as it is.
+
+*/
+
+const (
+	segmentFileName = "data.log"
+	compactFileName = "data.log.compact"
+	recordHeaderLen = 8
+
+	// compaction kicks in once garbage is at least this big and
+	// makes up more than half of the segment
+	compactMinGarbage = 1 << 20
+)
+
+var (
+	errCorruptRecord     = errors.New("disk cache: corrupt record")
+	errUndecodableRecord = errors.New("disk cache: undecodable record")
+)
+
+type diskRecord struct {
+	Key     interface{}
+	Expiry  time.Time
+	Value   interface{}
+	Deleted bool
+}
+
+type diskEntry struct {
+	offset int64
+	size   int64
+	expiry time.Time
+}
+
+type DiskCache struct {
+	dir     string
+	segment *os.File
+	index   map[Key]diskEntry
+	size    int64
+	garbage int64
+	mut     *sync.Mutex
+}
+
+func NewDiskCache(dir string) (*DiskCache, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	dc := &DiskCache{
+		dir:   dir,
+		index: make(map[Key]diskEntry),
+		mut:   &sync.Mutex{},
+	}
+
+	// a compaction that died before the rename leaves a half written file behind
+	os.Remove(filepath.Join(dir, compactFileName))
+
+	segment, err := os.OpenFile(filepath.Join(dir, segmentFileName), os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	dc.segment = segment
+
+	if err := dc.recover(); err != nil {
+		segment.Close()
+		return nil, err
+	}
+	return dc, nil
+}
+
+// recover replays the segment and rebuilds the index
+func (dc *DiskCache) recover() error {
+	info, err := dc.segment.Stat()
+	if err != nil {
+		return err
+	}
+	end := info.Size()
+
+	var offset int64
+	now := time.Now()
+	for {
+		record, size, err := readRecord(dc.segment, offset, end)
+		if err == io.EOF {
+			break
+		}
+		if errors.Is(err, errUndecodableRecord) {
+			// the bytes are intact, cutting them off would lose the record
+			// and everything written after it
+			return fmt.Errorf("record at offset %d: %w", offset, err)
+		}
+		if err != nil {
+			// everything after the last good record is a torn write
+			fmt.Println("disk cache: truncating segment at offset ", offset, " : ", err)
+			if err := dc.segment.Truncate(offset); err != nil {
+				return err
+			}
+			break
+		}
+
+		key := Key{value: record.Key}
+		if old, exists := dc.index[key]; exists {
+			dc.garbage += old.size
+		}
+		value := Value{value: record.Value, expiry: record.Expiry}
+		if record.Deleted || value.expired(now) {
+			delete(dc.index, key)
+			dc.garbage += size
+		} else {
+			dc.index[key] = diskEntry{offset: offset, size: size, expiry: record.Expiry}
+		}
+		offset += size
+	}
+
+	dc.size = offset
+	return nil
+}
+
+func (dc *DiskCache) Get(key Key) (Value, bool) {
+	dc.mut.Lock()
+	defer dc.mut.Unlock()
+
+	entry, exists := dc.index[key]
+	if !exists {
+		return Value{}, false
+	}
+
+	record, _, err := readRecord(dc.segment, entry.offset, dc.size)
+	if err != nil {
+		fmt.Println("disk cache: unable to read key ", key.value, " : ", err)
+		return Value{}, false
+	}
+	return Value{value: record.Value, expiry: record.Expiry}, true
+}
+
+func (dc *DiskCache) Exists(key Key) bool {
+	dc.mut.Lock()
+	defer dc.mut.Unlock()
+
+	_, exists := dc.index[key]
+	return exists
+}
+
+func (dc *DiskCache) Len() int {
+	dc.mut.Lock()
+	defer dc.mut.Unlock()
+
+	return len(dc.index)
+}
+
+func (dc *DiskCache) Set(key Key, value Value) error {
+	dc.mut.Lock()
+	defer dc.mut.Unlock()
+
+	offset, size, err := dc.append(diskRecord{Key: key.value, Expiry: value.expiry, Value: value.value})
+	if err != nil {
+		return err
+	}
+
+	if old, exists := dc.index[key]; exists {
+		dc.garbage += old.size
+	}
+	dc.index[key] = diskEntry{offset: offset, size: size, expiry: value.expiry}
+
+	return dc.maybeCompact()
+}
+
+func (dc *DiskCache) Remove(key Key) error {
+	dc.mut.Lock()
+	defer dc.mut.Unlock()
+
+	old, exists := dc.index[key]
+	if !exists {
+		return nil
+	}
+
+	_, size, err := dc.append(diskRecord{Key: key.value, Deleted: true})
+	if err != nil {
+		return err
+	}
+	delete(dc.index, key)
+	dc.garbage += old.size + size
+
+	return dc.maybeCompact()
+}
+
+// forEachExpiry calls fn for every key on disk that has an expiry
+func (dc *DiskCache) forEachExpiry(fn func(key Key, expiry time.Time)) {
+	dc.mut.Lock()
+	defer dc.mut.Unlock()
+
+	for key, entry := range dc.index {
+		if !entry.expiry.IsZero() {
+			fn(key, entry.expiry)
+		}
+	}
+}
+
+// Compact rewrites the live records into a new segment and drops the garbage
+func (dc *DiskCache) Compact() error {
+	dc.mut.Lock()
+	defer dc.mut.Unlock()
+
+	return dc.compact()
+}
+
+func (dc *DiskCache) Close() error {
+	dc.mut.Lock()
+	defer dc.mut.Unlock()
+
+	if err := dc.segment.Sync(); err != nil {
+		dc.segment.Close()
+		return err
+	}
+	return dc.segment.Close()
+}
+
+func (dc *DiskCache) maybeCompact() error {
+	if dc.garbage < compactMinGarbage || dc.garbage*2 < dc.size {
+		return nil
+	}
+	return dc.compact()
+}
+
+func (dc *DiskCache) compact() error {
+	compactPath := filepath.Join(dc.dir, compactFileName)
+	segmentPath := filepath.Join(dc.dir, segmentFileName)
+
+	out, err := os.OpenFile(compactPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+
+	index := make(map[Key]diskEntry, len(dc.index))
+	var offset int64
+	for key, entry := range dc.index {
+		buf := make([]byte, entry.size)
+		if _, err := dc.segment.ReadAt(buf, entry.offset); err != nil {
+			out.Close()
+			os.Remove(compactPath)
+			return err
+		}
+		if _, err := out.WriteAt(buf, offset); err != nil {
+			out.Close()
+			os.Remove(compactPath)
+			return err
+		}
+		index[key] = diskEntry{offset: offset, size: entry.size, expiry: entry.expiry}
+		offset += entry.size
+	}
+
+	if err := out.Sync(); err != nil {
+		out.Close()
+		os.Remove(compactPath)
+		return err
+	}
+	if err := os.Rename(compactPath, segmentPath); err != nil {
+		out.Close()
+		os.Remove(compactPath)
+		return err
+	}
+
+	dc.segment.Close()
+	dc.segment = out
+	dc.index = index
+	dc.size = offset
+	dc.garbage = 0
+	return nil
+}
+
+func (dc *DiskCache) append(record diskRecord) (int64, int64, error) {
+	var payload bytes.Buffer
+	if err := gob.NewEncoder(&payload).Encode(&record); err != nil {
+		return 0, 0, err
+	}
+
+	buf := make([]byte, recordHeaderLen+payload.Len())
+	binary.LittleEndian.PutUint32(buf[0:4], uint32(payload.Len()))
+	binary.LittleEndian.PutUint32(buf[4:8], crc32.ChecksumIEEE(payload.Bytes()))
+	copy(buf[recordHeaderLen:], payload.Bytes())
+
+	offset := dc.size
+	if _, err := dc.segment.WriteAt(buf, offset); err != nil {
+		// drop whatever made it to the file so the next append starts clean
+		dc.segment.Truncate(offset)
+		return 0, 0, err
+	}
+	dc.size += int64(len(buf))
+
+	return offset, int64(len(buf)), nil
+}
+
+// readRecord reads the record at offset, records end at end. A short header,
+// a length running past end or a bad checksum is a corrupt or torn record, a
+// payload that passes the checksum but does not decode is undecodable.
+func readRecord(r io.ReaderAt, offset int64, end int64) (diskRecord, int64, error) {
+	header := make([]byte, recordHeaderLen)
+	n, err := r.ReadAt(header, offset)
+	if err == io.EOF && n == 0 {
+		return diskRecord{}, 0, io.EOF
+	}
+	if n < recordHeaderLen {
+		return diskRecord{}, 0, errCorruptRecord
+	}
+
+	length := binary.LittleEndian.Uint32(header[0:4])
+	sum := binary.LittleEndian.Uint32(header[4:8])
+	if int64(length) > end-offset-recordHeaderLen {
+		return diskRecord{}, 0, errCorruptRecord
+	}
+
+	payload := make([]byte, length)
+	if n, _ := r.ReadAt(payload, offset+recordHeaderLen); n < int(length) {
+		return diskRecord{}, 0, errCorruptRecord
+	}
+	if crc32.ChecksumIEEE(payload) != sum {
+		return diskRecord{}, 0, errCorruptRecord
+	}
+
+	var record diskRecord
+	if err := gob.NewDecoder(bytes.NewReader(payload)).Decode(&record); err != nil {
+		return diskRecord{}, 0, fmt.Errorf("%w: %v", errUndecodableRecord, err)
+	}
+	return record, recordHeaderLen + int64(length), nil
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func openDisk(t *testing.T, dir string) *DiskCache {
+	t.Helper()
+	dc, err := NewDiskCache(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dc
+}
+
+func segmentSize(t *testing.T, dir string) int64 {
+	t.Helper()
+	info, err := os.Stat(filepath.Join(dir, segmentFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return info.Size()
+}
+
+func TestDiskCacheRecover(t *testing.T) {
+	dir := t.TempDir()
+	dc := openDisk(t, dir)
+	dc.Set(Key{value: "a"}, Value{value: 1})
+	dc.Set(Key{value: "b"}, Value{value: 2})
+	dc.Set(Key{value: "a"}, Value{value: 3})
+	dc.Remove(Key{value: "b"})
+	dc.Set(Key{value: "gone"}, Value{value: 4, expiry: time.Now().Add(-time.Second)})
+	if err := dc.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	dc = openDisk(t, dir)
+	defer dc.Close()
+	if value, found := dc.Get(Key{value: "a"}); !found || value.value != 3 {
+		t.Errorf("a = %v %v, want the latest value 3", value.value, found)
+	}
+	if dc.Exists(Key{value: "b"}) {
+		t.Error("removed key came back")
+	}
+	if dc.Exists(Key{value: "gone"}) {
+		t.Error("expired key came back")
+	}
+	if dc.Len() != 1 {
+		t.Errorf("%d keys recovered, want 1", dc.Len())
+	}
+}
+
+func TestDiskCacheTruncatesTornTail(t *testing.T) {
+	// header with the given payload length followed by payload
+	record := func(length uint32, payload ...byte) []byte {
+		header := make([]byte, recordHeaderLen)
+		binary.LittleEndian.PutUint32(header, length)
+		return append(header, payload...)
+	}
+	tails := map[string][]byte{
+		"half a header": {1, 2, 3},
+		"short payload": record(100, 1, 2, 3),
+		"huge length":   record(0xFFFFFFF0), // must not allocate 4GiB
+		"bad checksum":  record(4, 1, 2, 3, 4),
+	}
+	for name, tail := range tails {
+		dir := t.TempDir()
+		dc := openDisk(t, dir)
+		dc.Set(Key{value: "a"}, Value{value: 1})
+		dc.Close()
+		good := segmentSize(t, dir)
+
+		f, err := os.OpenFile(filepath.Join(dir, segmentFileName), os.O_WRONLY|os.O_APPEND, 0o644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Write(tail)
+		f.Close()
+
+		dc = openDisk(t, dir)
+		if value, found := dc.Get(Key{value: "a"}); !found || value.value != 1 {
+			t.Errorf("%s: a = %v %v, want 1", name, value.value, found)
+		}
+		if size := segmentSize(t, dir); size != good {
+			t.Errorf("%s: segment is %d bytes, want it truncated to %d", name, size, good)
+		}
+		// appends continue after the last good record
+		dc.Set(Key{value: "b"}, Value{value: 2})
+		dc.Close()
+		dc = openDisk(t, dir)
+		if dc.Len() != 2 {
+			t.Errorf("%s: %d keys after reopening, want 2", name, dc.Len())
+		}
+		dc.Close()
+	}
+}
+
+func TestDiskCacheKeepsUndecodableRecord(t *testing.T) {
+	dir := t.TempDir()
+	dc := openDisk(t, dir)
+	dc.Set(Key{value: "a"}, Value{value: 1})
+	dc.Close()
+
+	// intact record whose payload is not a gob diskRecord
+	payload := []byte("not gob")
+	record := make([]byte, recordHeaderLen, recordHeaderLen+len(payload))
+	binary.LittleEndian.PutUint32(record[0:4], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(record[4:8], crc32.ChecksumIEEE(payload))
+	record = append(record, payload...)
+	f, err := os.OpenFile(filepath.Join(dir, segmentFileName), os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write(record)
+	f.Close()
+	before := segmentSize(t, dir)
+
+	if _, err := NewDiskCache(dir); !errors.Is(err, errUndecodableRecord) {
+		t.Fatalf("opening = %v, want %v", err, errUndecodableRecord)
+	}
+	if size := segmentSize(t, dir); size != before {
+		t.Errorf("segment is %d bytes, want it left at %d", size, before)
+	}
+}
+
+func TestDiskCacheCompact(t *testing.T) {
+	dir := t.TempDir()
+	dc := openDisk(t, dir)
+	for i := 0; i < 100; i++ {
+		dc.Set(Key{value: "hot"}, Value{value: i})
+	}
+	dc.Set(Key{value: "cold"}, Value{value: "x"})
+	before := segmentSize(t, dir)
+
+	if err := dc.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if after := segmentSize(t, dir); after*10 > before {
+		t.Errorf("segment went from %d to %d bytes, the overwritten records were kept", before, after)
+	}
+	if _, err := os.Stat(filepath.Join(dir, compactFileName)); !os.IsNotExist(err) {
+		t.Error("compaction file left behind")
+	}
+
+	// the compacted segment is written to and read back like the old one
+	dc.Set(Key{value: "new"}, Value{value: 1})
+	dc.Close()
+	dc = openDisk(t, dir)
+	defer dc.Close()
+	for key, want := range map[string]interface{}{"hot": 99, "cold": "x", "new": 1} {
+		if value, found := dc.Get(Key{value: key}); !found || value.value != want {
+			t.Errorf("%s = %v %v, want %v", key, value.value, found, want)
+		}
+	}
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type EventType int
+
+const (
+	EventSet EventType = iota
+	EventEvict
+	EventExpire
+	EventDelete
+)
+
+func (e EventType) String() string {
+	switch e {
+	case EventSet:
+		return "SET"
+	case EventEvict:
+		return "EVICT"
+	case EventExpire:
+		return "EXPIRE"
+	case EventDelete:
+		return "DELETE"
+	default:
+		return "UNKNOWN"
+	}
+}
+
+// EvictReason says why a key left memory
+type EvictReason int
+
+const (
+	// EvictCapacity - memory was full, the key was demoted to disk
+	EvictCapacity EvictReason = iota
+	// EvictResize - ChangeCapacity shrank memory, the key was demoted to disk
+	EvictResize
+	// EvictInvalidated - another cache on the bus changed the key, it was dropped
+	EvictInvalidated
+)
+
+func (r EvictReason) String() string {
+	switch r {
+	case EvictCapacity:
+		return "CAPACITY"
+	case EvictResize:
+		return "RESIZE"
+	case EvictInvalidated:
+		return "INVALIDATED"
+	default:
+		return "UNKNOWN"
+	}
+}
+
+type Event struct {
+	Type   EventType
+	Key    Key
+	Value  Value       // set events only
+	Reason EvictReason // evict events only
+	Time   time.Time
+}
+
+// Subscription receives cache events on C. Delivery never blocks the cache,
+// events that do not fit in the buffer are dropped and counted.
+type Subscription struct {
+	C       <-chan Event
+	events  chan Event
+	dropped atomic.Int64
+}
+
+// Dropped returns how many events were lost because the buffer was full
+func (s *Subscription) Dropped() int64 {
+	return s.dropped.Load()
+}
+
+// Subscribe returns a subscription buffering up to buffer events
+func (mu *MultiCache) Subscribe(buffer int) *Subscription {
+	events := make(chan Event, buffer)
+	sub := &Subscription{C: events, events: events}
+
+	mu.mut.Lock()
+	defer mu.mut.Unlock()
+	mu.subs[sub] = struct{}{}
+	return sub
+}
+
+// Unsubscribe stops delivery and closes sub.C
+func (mu *MultiCache) Unsubscribe(sub *Subscription) {
+	mu.mut.Lock()
+	defer mu.mut.Unlock()
+
+	if _, exists := mu.subs[sub]; exists {
+		delete(mu.subs, sub)
+		close(sub.events)
+	}
+}
+
+// publish hands e to every subscriber, mu.mut must be held
+func (mu *MultiCache) publish(e Event) {
+	if e.Type == EventSet || e.Type == EventDelete {
+		for queue := range mu.busQueues {
+			queue.push(e.Key)
+		}
+	}
+	if len(mu.subs) == 0 {
+		return
+	}
+	e.Time = time.Now()
+	for sub := range mu.subs {
+		select {
+		case sub.events <- e:
+		default:
+			sub.dropped.Add(1)
+		}
+	}
+}
+
+func (mu *MultiCache) closeSubscriptions() {
+	mu.mut.Lock()
+	defer mu.mut.Unlock()
+
+	for sub := range mu.subs {
+		delete(mu.subs, sub)
+		close(sub.events)
+	}
+	for queue := range mu.busQueues {
+		delete(mu.busQueues, queue)
+		queue.close()
+	}
+}
+
+// Invalidate drops key from both tiers because it changed somewhere else. It
+// does not touch the backing store and is not sent back to the bus.
+func (mu *MultiCache) Invalidate(key Key) {
+	mu.mut.Lock()
+	defer mu.mut.Unlock()
+
+	_, inMemory := mu.c.store[key]
+	if !inMemory && !mu.dc.Exists(key) {
+		return
+	}
+	mu.dropKey(key)
+	mu.publish(Event{Type: EventEvict, Key: key, Reason: EvictInvalidated})
+}
+
+// invalidationQueue carries the keys of local writes to the bus. Unlike a
+// Subscription it never drops: keys wait until the sender gets to them, a key
+// written again before that is queued once since peers only need the key.
+type invalidationQueue struct {
+	keys   []Key
+	queued map[Key]bool
+	closed bool
+	cond   *sync.Cond
+	mu     sync.Mutex
+}
+
+func newInvalidationQueue() *invalidationQueue {
+	q := &invalidationQueue{queued: make(map[Key]bool)}
+	q.cond = sync.NewCond(&q.mu)
+	return q
+}
+
+func (q *invalidationQueue) push(key Key) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed || q.queued[key] {
+		return
+	}
+	q.queued[key] = true
+	q.keys = append(q.keys, key)
+	q.cond.Signal()
+}
+
+// take waits for queued keys and returns all of them, ok is false once the
+// queue is closed and empty
+func (q *invalidationQueue) take() (keys []Key, ok bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for len(q.keys) == 0 && !q.closed {
+		q.cond.Wait()
+	}
+	keys = q.keys
+	q.keys = nil
+	clear(q.queued)
+	return keys, len(keys) > 0
+}
+
+// close lets take return what is left and then stop
+func (q *invalidationQueue) close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.closed = true
+	q.cond.Broadcast()
+}
+
+// ConnectBus sends the keys of local sets and deletes to bus and invalidates
+// the keys other members send. The returned function sends what is still
+// queued and disconnects.
+func (mu *MultiCache) ConnectBus(bus InvalidationBus) func() {
+	queue := newInvalidationQueue()
+	mu.mut.Lock()
+	mu.busQueues[queue] = struct{}{}
+	mu.mut.Unlock()
+	member := bus.Join(mu.Invalidate)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			keys, ok := queue.take()
+			if !ok {
+				return
+			}
+			for _, key := range keys {
+				if err := member.Publish(key); err != nil {
+					fmt.Println("unable to publish invalidation for key ", key.value, " : ", err)
+				}
+			}
+		}
+	}()
+
+	return func() {
+		mu.mut.Lock()
+		delete(mu.busQueues, queue)
+		mu.mut.Unlock()
+		queue.close()
+		<-done
+		member.Leave()
+	}
+}
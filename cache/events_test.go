@@ -0,0 +1,198 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func nextEvent(t *testing.T, sub *Subscription) Event {
+	t.Helper()
+
+	select {
+	case e, ok := <-sub.C:
+		if !ok {
+			t.Fatal("subscription closed")
+		}
+		return e
+	case <-time.After(time.Second):
+		t.Fatal("no event within a second")
+	}
+	return Event{}
+}
+
+func TestEventStream(t *testing.T) {
+	mu, err := NewMultiCache(1, newLRU(1), t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mu.Close()
+	sub := mu.Subscribe(16)
+
+	mu.SetKey(Key{value: "a"}, Value{value: 1})
+	mu.SetKey(Key{value: "b"}, Value{value: 2})
+	mu.DeleteKey(Key{value: "a"})
+	mu.SetKeyWithTTL(Key{value: "c"}, Value{value: 3}, time.Millisecond)
+
+	want := []struct {
+		typ    EventType
+		key    string
+		reason EvictReason
+	}{
+		{EventSet, "a", 0},
+		{EventEvict, "a", EvictCapacity},
+		{EventSet, "b", 0},
+		{EventDelete, "a", 0},
+		{EventEvict, "b", EvictCapacity},
+		{EventSet, "c", 0},
+		{EventExpire, "c", 0},
+	}
+	for _, w := range want {
+		e := nextEvent(t, sub)
+		if e.Type != w.typ || e.Key.value != w.key || e.Reason != w.reason {
+			t.Fatalf("got %v %v %v, want %v %v %v", e.Type, e.Key.value, e.Reason, w.typ, w.key, w.reason)
+		}
+	}
+
+	mu.Unsubscribe(sub)
+	if _, ok := <-sub.C; ok {
+		t.Error("subscription still open after Unsubscribe")
+	}
+}
+
+func TestSlowSubscriberDropsEvents(t *testing.T) {
+	mu, err := NewMultiCache(10, newLRU(10), t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub := mu.Subscribe(2)
+
+	for i := 0; i < 5; i++ {
+		mu.SetKey(Key{value: i}, Value{value: i})
+	}
+	if sub.Dropped() != 3 {
+		t.Errorf("%d events dropped, want 3", sub.Dropped())
+	}
+
+	mu.Close()
+	for range sub.C {
+	}
+}
+
+// waitMissing polls until key is gone from mu, invalidations are asynchronous
+func waitMissing(t *testing.T, mu *MultiCache, key Key) {
+	t.Helper()
+
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		if _, found := mu.KeyTTL(key); !found {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("key %v was not invalidated", key.value)
+}
+
+func testInvalidation(t *testing.T, first, second InvalidationBus) {
+	caches := make([]*MultiCache, 2)
+	for i, bus := range []InvalidationBus{first, second} {
+		mu, err := NewMultiCache(2, newLRU(2), t.TempDir())
+		if err != nil {
+			t.Fatal(err)
+		}
+		disconnect := mu.ConnectBus(bus)
+		t.Cleanup(func() {
+			disconnect()
+			mu.Close()
+		})
+		caches[i] = mu
+	}
+	a, b := caches[0], caches[1]
+
+	key := Key{value: "user:1"}
+	b.SetKey(key, Value{value: "stale"})
+	// b's own set goes to a, which does not have the key
+	time.Sleep(10 * time.Millisecond)
+
+	a.SetKey(key, Value{value: "fresh"})
+	waitMissing(t, b, key)
+	if value, found := a.LookupKey(key); !found || value.value != "fresh" {
+		t.Errorf("writer lost its own value, got %v %v", value.value, found)
+	}
+
+	b.SetKey(Key{value: "user:2"}, Value{value: 2})
+	a.SetKey(Key{value: "user:2"}, Value{value: 2})
+	a.DeleteKey(Key{value: "user:2"})
+	waitMissing(t, b, Key{value: "user:2"})
+}
+
+// stalledBus records what its member publishes, Publish waits for release
+type stalledBus struct {
+	release   chan struct{}
+	published map[Key]bool
+	mu        sync.Mutex
+}
+
+func (b *stalledBus) Join(invalidate func(key Key)) BusMember {
+	return b
+}
+
+func (b *stalledBus) Publish(key Key) error {
+	<-b.release
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.published[key] = true
+	return nil
+}
+
+func (b *stalledBus) Leave() {}
+
+func TestStalledBusDropsNoInvalidations(t *testing.T) {
+	mu, err := NewMultiCache(10, newLRU(10), t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mu.Close()
+	bus := &stalledBus{release: make(chan struct{}), published: map[Key]bool{}}
+	disconnect := mu.ConnectBus(bus)
+
+	// far more writes than any subscription buffer while the bus is stuck
+	const writes = 10000
+	for i := 0; i < writes; i++ {
+		mu.SetKey(Key{value: i % 100}, Value{value: i})
+		mu.SetKey(Key{value: i}, Value{value: i})
+	}
+	close(bus.release)
+	disconnect()
+
+	if len(bus.published) != writes {
+		t.Fatalf("%d of %d keys published", len(bus.published), writes)
+	}
+}
+
+func TestLocalBusInvalidation(t *testing.T) {
+	bus := NewLocalBus()
+	testInvalidation(t, bus, bus)
+}
+
+func TestTCPBusInvalidation(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hub := NewBusHub()
+	go hub.Serve(l)
+	t.Cleanup(func() { hub.Close() })
+
+	buses := make([]*TCPBus, 2)
+	for i := range buses {
+		bus, err := DialBus(l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { bus.Close() })
+		buses[i] = bus
+	}
+	testInvalidation(t, buses[0], buses[1])
+}
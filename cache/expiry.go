@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// wheelTick is the resolution of the background expiry
+const wheelTick = 100 * time.Millisecond
+
+// SetDefaultTTL sets the TTL SetKey uses, a ttl <= 0 means keys never expire
+func (mu *MultiCache) SetDefaultTTL(ttl time.Duration) {
+	mu.mut.Lock()
+	defer mu.mut.Unlock()
+	mu.defaultTTL = ttl
+}
+
+func (v Value) expired(now time.Time) bool {
+	return !v.expiry.IsZero() && !now.Before(v.expiry)
+}
+
+// setExpiry stamps value with its expiry and (re)schedules key on the wheel
+func (mu *MultiCache) setExpiry(key Key, value *Value, ttl time.Duration) {
+	if ttl <= 0 {
+		value.expiry = time.Time{}
+		mu.wheel.Remove(key)
+		return
+	}
+	value.expiry = time.Now().Add(ttl)
+	mu.wheel.Add(key, value.expiry)
+}
+
+// expireKey drops key if the copy it finds in memory or on disk is expired.
+// The wheel may fire for a key that has been set again with a later expiry,
+// so the stored value decides, not the wheel.
+func (mu *MultiCache) expireKey(key Key, now time.Time) {
+	if value, exists := mu.c.store[key]; exists {
+		if !value.expired(now) {
+			return
+		}
+		delete(mu.c.store, key)
+		mu.c.epolicy.removeKey(key)
+	} else if value, exists := mu.dc.Get(key); exists {
+		if !value.expired(now) {
+			return
+		}
+		if err := mu.dc.Remove(key); err != nil {
+			fmt.Println("unable to remove expired key ", key.value, " from disk cache : ", err)
+		}
+	} else {
+		return
+	}
+
+	mu.wheel.Remove(key)
+	mu.stats.expirations.Add(1)
+	mu.publish(Event{Type: EventExpire, Key: key})
+}
+
+// runExpiry advances the timing wheel until the cache is closed
+func (mu *MultiCache) runExpiry() {
+	defer close(mu.expiryStopped)
+	ticker := time.NewTicker(wheelTick)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-mu.done:
+			return
+		case now := <-ticker.C:
+			mu.mut.Lock()
+			for _, key := range mu.wheel.Advance(now) {
+				mu.expireKey(key, now)
+			}
+			mu.mut.Unlock()
+		}
+	}
+}
+
+// KeyTTL returns how long key has left, -1 if it never expires. found is
+// false if key is missing or already expired. It does not touch the
+// statistics or the eviction policy.
+func (mu *MultiCache) KeyTTL(key Key) (time.Duration, bool) {
+	mu.mut.Lock()
+	defer mu.mut.Unlock()
+
+	now := time.Now()
+	value, exists := mu.c.store[key]
+	if !exists {
+		value, exists = mu.dc.Get(key)
+	}
+	if !exists || value.expired(now) {
+		return 0, false
+	}
+	if value.expiry.IsZero() {
+		return -1, true
+	}
+	return value.expiry.Sub(now), true
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+var wheelStart = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// ticks is the time n ticks of a one second wheel after wheelStart
+func ticks(n int64) time.Time {
+	return wheelStart.Add(time.Duration(n) * time.Second)
+}
+
+func TestTimingWheelFiresOnTimeAcrossLevels(t *testing.T) {
+	tw := NewTimingWheel(time.Second, wheelStart)
+
+	// level 0, the edges of levels 1 and 2, and past the top level
+	due := []int64{1, 63, 64, 65, 4095, 4096, 4097, 300000, 1<<24 + 5}
+	for _, at := range due {
+		tw.Add(Key{value: at}, ticks(at))
+	}
+
+	for _, at := range due {
+		if fired := tw.Advance(ticks(at - 1)); len(fired) != 0 {
+			t.Fatalf("%v fired before tick %d", fired, at)
+		}
+		fired := tw.Advance(ticks(at))
+		if len(fired) != 1 || fired[0].value != at {
+			t.Fatalf("tick %d fired %v", at, fired)
+		}
+	}
+	if tw.Len() != 0 {
+		t.Errorf("%d keys left on the wheel", tw.Len())
+	}
+}
+
+func TestTimingWheelRoundsUpAndReschedules(t *testing.T) {
+	tw := NewTimingWheel(time.Second, wheelStart)
+	half, moved, removed := Key{value: "half"}, Key{value: "moved"}, Key{value: "removed"}
+
+	tw.Add(half, wheelStart.Add(1500*time.Millisecond))
+	tw.Add(moved, ticks(2))
+	tw.Add(moved, ticks(100))
+	tw.Add(removed, ticks(2))
+	tw.Remove(removed)
+
+	if fired := tw.Advance(ticks(1)); len(fired) != 0 {
+		t.Errorf("tick 1 fired %v, half a tick early", fired)
+	}
+	if fired := tw.Advance(ticks(2)); len(fired) != 1 || fired[0] != half {
+		t.Errorf("tick 2 fired %v, want only half", fired)
+	}
+	if fired := tw.Advance(ticks(100)); len(fired) != 1 || fired[0] != moved {
+		t.Errorf("tick 100 fired %v, want moved", fired)
+	}
+
+	// a key already due fires on the next tick
+	tw.Add(half, ticks(50))
+	if fired := tw.Advance(ticks(101)); len(fired) != 1 {
+		t.Errorf("past key fired %v", fired)
+	}
+}
+
+func TestLazyExpiry(t *testing.T) {
+	mu, err := NewMultiCache(2, newLRU(2), t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mu.Close()
+
+	key := Key{value: "a"}
+	mu.SetKeyWithTTL(key, Value{value: 1}, 20*time.Millisecond)
+	if ttl, found := mu.KeyTTL(key); !found || ttl <= 0 || ttl > 20*time.Millisecond {
+		t.Fatalf("ttl %v %v", ttl, found)
+	}
+	mu.SetKey(Key{value: "forever"}, Value{value: 2})
+	if ttl, found := mu.KeyTTL(Key{value: "forever"}); !found || ttl != -1 {
+		t.Errorf("key without a ttl: %v %v", ttl, found)
+	}
+
+	// well before the first wheel tick the read itself finds it expired
+	time.Sleep(30 * time.Millisecond)
+	if _, found := mu.LookupKey(key); found {
+		t.Error("expired key served")
+	}
+	if _, found := mu.KeyTTL(key); found {
+		t.Error("expired key has a ttl")
+	}
+	if got := mu.Stats().Expirations; got != 1 {
+		t.Errorf("%d expirations, want 1", got)
+	}
+}
+
+func TestBackgroundExpiry(t *testing.T) {
+	mu, err := NewMultiCache(1, newLRU(1), t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mu.Close()
+	sub := mu.Subscribe(10)
+
+	onDisk, inMem, renewed := Key{value: "disk"}, Key{value: "memory"}, Key{value: "renewed"}
+	mu.SetKeyWithTTL(onDisk, Value{value: 1}, 50*time.Millisecond)
+	mu.SetKeyWithTTL(renewed, Value{value: 2}, 50*time.Millisecond)
+	mu.SetKeyWithTTL(renewed, Value{value: 2}, time.Hour)
+	mu.SetKeyWithTTL(inMem, Value{value: 3}, 50*time.Millisecond)
+	if !mu.dc.Exists(onDisk) {
+		t.Fatal("key not demoted to disk")
+	}
+
+	// nobody reads, the wheel drops both tiers
+	expired := map[Key]bool{}
+	deadline := time.After(2 * time.Second)
+	for len(expired) < 2 {
+		select {
+		case e := <-sub.C:
+			if e.Type == EventExpire {
+				expired[e.Key] = true
+			}
+		case <-deadline:
+			t.Fatalf("only %v expired", expired)
+		}
+	}
+	if !expired[onDisk] || !expired[inMem] {
+		t.Errorf("expired %v", expired)
+	}
+	if mu.dc.Exists(onDisk) || inMemory(mu, inMem) {
+		t.Error("expired keys still stored")
+	}
+	// the wheel fired for the old ttl, the value decides
+	if _, found := mu.KeyTTL(renewed); !found {
+		t.Error("renewed key expired on its old ttl")
+	}
+}
+
+func TestCloseTwice(t *testing.T) {
+	mu, err := NewMultiCache(1, newLRU(1), t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		mu.SetKeyWithTTL(Key{value: i}, Value{value: i}, time.Millisecond)
+	}
+	time.Sleep(wheelTick)
+	if err := mu.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := mu.Close(); err != nil {
+		t.Errorf("second Close: %v", err)
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/gob"
+	"time"
+)
+
+// KeyStore is the untyped API shared by MultiCache and ShardedCache
+type KeyStore interface {
+	LookupKey(key Key) (Value, bool)
+	PeekKey(key Key) (Value, bool)
+	SetKey(key Key, value Value) error
+	SetKeyWithTTL(key Key, value Value, ttl time.Duration) error
+	DeleteKey(key Key) (bool, error)
+	RecordLoad(key Key, latency time.Duration, err error)
+}
+
+// Cache is a type safe view of a KeyStore. Tiers, eviction and admission
+// policies and TTLs are whatever the wrapped store is configured with.
+type Cache[K comparable, V any] struct {
+	store KeyStore
+	loads loadGroup[K, V]
+}
+
+// NewCache wraps store, K and V get registered with gob so they can be
+// demoted to the disk tier. A store with a disk tier replays it when it is
+// opened, before this runs, use OpenCache for those when K or V is not a
+// builtin type.
+func NewCache[K comparable, V any](store KeyStore) *Cache[K, V] {
+	registerTypes[K, V]()
+	return &Cache[K, V]{store: store}
+}
+
+// OpenCache registers K and V with gob and only then calls open, so records
+// of those types already on disk decode when the store replays its segment.
+//
+//	points, mu, err := OpenCache[string, Point](func() (*MultiCache, error) {
+//		return NewMultiCache(100, policy, dir)
+//	})
+func OpenCache[K comparable, V any, S KeyStore](open func() (S, error)) (*Cache[K, V], S, error) {
+	registerTypes[K, V]()
+	store, err := open()
+	if err != nil {
+		var zero S
+		return nil, zero, err
+	}
+	return &Cache[K, V]{store: store}, store, nil
+}
+
+// registerTypes registers the concrete types of K and V, an interface type
+// has a nil zero value which gob.Register panics on, the concrete types
+// behind it are up to the caller
+func registerTypes[K comparable, V any]() {
+	var key K
+	var value V
+	if any(key) != nil {
+		gob.Register(key)
+	}
+	if any(value) != nil {
+		gob.Register(value)
+	}
+}
+
+// Get returns the value of key, found is false if the stored value is not a V
+// (it was set through the untyped API or another Cache on the same store)
+func (c *Cache[K, V]) Get(key K) (V, bool) {
+	value, found := c.store.LookupKey(Key{value: key})
+	return typed[V](value, found)
+}
+
+func typed[V any](value Value, found bool) (V, bool) {
+	if !found {
+		var zero V
+		return zero, false
+	}
+	v, ok := value.value.(V)
+	return v, ok
+}
+
+// Set stores value with the MultiCache default TTL
+func (c *Cache[K, V]) Set(key K, value V) error {
+	return c.store.SetKey(Key{value: key}, Value{value: value})
+}
+
+func (c *Cache[K, V]) SetWithTTL(key K, value V, ttl time.Duration) error {
+	return c.store.SetKeyWithTTL(Key{value: key}, Value{value: value}, ttl)
+}
+
+func (c *Cache[K, V]) Delete(key K) (bool, error) {
+	return c.store.DeleteKey(Key{value: key})
+}
+
+// GetOrLoad returns the cached value or calls loader to fill it. Concurrent
+// misses on the same key share one loader call. Failed loads are not cached.
+func (c *Cache[K, V]) GetOrLoad(key K, loader func(K) (V, error)) (V, error) {
+	if value, found := c.Get(key); found {
+		return value, nil
+	}
+
+	value, err, _ := c.loads.Do(key, func() (V, error) {
+		// a caller that missed just before another load finished finds its
+		// value here, PeekKey so the miss is not counted twice
+		if value, found := typed[V](c.store.PeekKey(Key{value: key})); found {
+			return value, nil
+		}
+		start := time.Now()
+		value, err := loader(key)
+		c.store.RecordLoad(Key{value: key}, time.Since(start), err)
+		if err != nil {
+			return value, err
+		}
+		return value, c.Set(key, value)
+	})
+	return value, err
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"encoding/gob"
+	"errors"
+	"io"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newTestMultiCache(t *testing.T, capacity int) *MultiCache {
+	t.Helper()
+	mu, err := NewMultiCache(capacity, newLRU(capacity), t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { mu.Close() })
+	return mu
+}
+
+func TestCacheTyped(t *testing.T) {
+	mu := newTestMultiCache(t, 1)
+	ages := NewCache[string, int](mu)
+
+	ages.Set("alice", 30)
+	ages.Set("bob", 40) // demotes alice, the value survives the disk tier
+	if age, found := ages.Get("alice"); !found || age != 30 {
+		t.Errorf("alice = %v %v, want 30", age, found)
+	}
+	if found, err := ages.Delete("bob"); !found || err != nil {
+		t.Errorf("delete bob: %v %v", found, err)
+	}
+	if _, found := ages.Get("bob"); found {
+		t.Error("deleted key found")
+	}
+
+	// a value of another type is not a hit with a zero value
+	mu.SetKey(Key{value: "carol"}, Value{value: "forty"})
+	if age, found := ages.Get("carol"); found {
+		t.Errorf("string value returned as int %d", age)
+	}
+}
+
+// reopenPoint is only ever registered through OpenCache
+type reopenPoint struct {
+	X, Y int
+}
+
+func TestOpenCacheRegistersBeforeReplay(t *testing.T) {
+	dir := t.TempDir()
+	open := func() (*MultiCache, error) {
+		// gob registrations are process wide, so check the order directly
+		// instead of relying on a fresh process to replay the segment
+		record := diskRecord{Value: reopenPoint{}}
+		if err := gob.NewEncoder(io.Discard).Encode(&record); err != nil {
+			t.Errorf("store opened before V was registered: %v", err)
+		}
+		return NewMultiCache(1, newLRU(1), dir)
+	}
+
+	points, mu, err := OpenCache[string, reopenPoint](open)
+	if err != nil {
+		t.Fatal(err)
+	}
+	points.Set("a", reopenPoint{1, 2})
+	points.Set("b", reopenPoint{3, 4}) // demotes a to disk
+	mu.Close()
+
+	points, mu, err = OpenCache[string, reopenPoint](open)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mu.Close()
+	if point, found := points.Get("a"); !found || point != (reopenPoint{1, 2}) {
+		t.Errorf("a = %v %v after reopening, want {1 2}", point, found)
+	}
+}
+
+func TestNewCacheInterfaceTypes(t *testing.T) {
+	mu := newTestMultiCache(t, 10)
+	// the zero value of an interface is nil, registering it would panic
+	anything := NewCache[interface{}, interface{}](mu)
+	anything.Set(1, "one")
+	if value, found := anything.Get(1); !found || value != "one" {
+		t.Errorf("1 = %v %v, want one", value, found)
+	}
+}
+
+func TestGetOrLoad(t *testing.T) {
+	names := NewCache[int, string](newTestMultiCache(t, 10))
+	calls := 0
+	loader := func(id int) (string, error) {
+		calls++
+		if id < 0 {
+			return "", errors.New("no such user")
+		}
+		return "user", nil
+	}
+
+	for i := 0; i < 3; i++ {
+		if name, err := names.GetOrLoad(1, loader); err != nil || name != "user" {
+			t.Fatalf("GetOrLoad = %q %v", name, err)
+		}
+	}
+	if calls != 1 {
+		t.Errorf("loader called %d times for a cached key", calls)
+	}
+
+	// failed loads are not cached
+	names.GetOrLoad(-1, loader)
+	if _, err := names.GetOrLoad(-1, loader); err == nil || calls != 3 {
+		t.Errorf("failed load: %v after %d calls, want an error and a retry", err, calls)
+	}
+}
+
+func TestGetOrLoadSingleflight(t *testing.T) {
+	for name, store := range map[string]KeyStore{
+		"multi":   newTestMultiCache(t, 10),
+		"sharded": newTestSharded(t),
+	} {
+		cache := NewCache[string, int](store)
+		var calls atomic.Int64
+		release := make(chan struct{})
+		loader := func(string) (int, error) {
+			calls.Add(1)
+			<-release
+			return 42, nil
+		}
+
+		var wg sync.WaitGroup
+		for i := 0; i < 50; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if value, err := cache.GetOrLoad("answer", loader); err != nil || value != 42 {
+					t.Errorf("%s: GetOrLoad = %d %v", name, value, err)
+				}
+			}()
+		}
+		time.Sleep(20 * time.Millisecond)
+		close(release)
+		wg.Wait()
+
+		if got := calls.Load(); got != 1 {
+			t.Errorf("%s: loader ran %d times, want 1", name, got)
+		}
+	}
+}
+
+func newTestSharded(t *testing.T) *ShardedCache {
+	t.Helper()
+	sc, err := NewShardedCache(4, 10, newLRU, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sc.Close() })
+	return sc
+}
+
+// staleLookups misses every LookupKey, like a caller that looked just before
+// a concurrent load stored the value
+type staleLookups struct {
+	*MultiCache
+}
+
+func (s staleLookups) LookupKey(key Key) (Value, bool) {
+	return Value{}, false
+}
+
+func TestGetOrLoadRechecksBeforeLoading(t *testing.T) {
+	mu := newTestMultiCache(t, 10)
+	mu.SetKey(Key{value: "k"}, Value{value: 7})
+	cache := NewCache[string, int](staleLookups{mu})
+
+	value, err := cache.GetOrLoad("k", func(string) (int, error) {
+		t.Error("loader ran for a value that is already cached")
+		return 0, nil
+	})
+	if err != nil || value != 7 {
+		t.Errorf("GetOrLoad = %d %v, want 7", value, err)
+	}
+	if stats := mu.Stats(); stats.Misses != 0 || stats.Loads != 0 {
+		t.Errorf("recheck counted %d misses and %d loads", stats.Misses, stats.Loads)
+	}
+}
@@ -3,6 +3,8 @@ package main
 import (
 	"container/list"
 	"fmt"
+	"os"
+	"path/filepath"
 	"sync"
 	"time"
 )
@@ -11,6 +13,7 @@ import (
 
 EvictionPolicy - interface{}
   check()
+  victim()
   setValue()
 
   LRU - struct
@@ -18,57 +21,78 @@ EvictionPolicy - interface{}
   - queue<time.Time> Key
 
   LFU - struct
-  - map[Key]int
-  - queue<time.Time> Key
+  - map[Key]*list.Element
+  - map[freq]list<Key>
+
+  ARC, TwoQ, Clock - struct (see arc.go, twoq.go, clock.go)
 
 - KeyTime struct
 	- key Key
 	- value - Time.Time
 
+Cache[K, V] - generic typed wrapper around MultiCache (see generic.go)
+- Get / Set / Delete / GetOrLoad
+
 Key - struct
 - value interface{}
-- expiry time.Time
 
 Value - struct
 - value interface{}
+- expiry time.Time (zero means the key never expires)
+
+for removing Expired Keys (see expiry.go)
+- GetKey drops an expired key lazily
+- a go routine advances a TimingWheel under the cache lock and expires due keys
 
-for removing Expired Keys. we will have a go routine
+AdmissionPolicy - interface{} (see admission.go)
+  decides if a disk hit / new key may push the eviction victim out of memory
+  victim is demoted to the DiskCache
 
-go routines func
-- removeExpiredKeys
+BackingStore - interface{} (see backing.go)
+  system of record behind the cache
+  write-through, write-behind (batched and coalesced) and read-through
+
+Event stream (see events.go)
+- set, evict (with reason), expire and delete events to buffered subscribers
+- InvalidationBus carries sets / deletes to other caches, in process or over TCP (see bus.go)
 
 DiskCache
-- map[Key][Value]
+- append only segment file on disk (see disk.go)
+- map[Key]diskEntry index rebuilt on start
 
-Cache struct
+MemoryCache struct
 - capacity
 - map[Key]Value
-- hits
-- misses
-- evictionCounts
-- RWmutex
+
+cacheStats struct (see stats.go)
+- atomic counters for memory/disk hits, misses, evictions, expirations, loads
+- load latency histogram
+- Stats() returns a snapshot, MetricsHandler serves it to Prometheus
 
 
 */
 
 type MultiCache struct {
 	dc *DiskCache
-	c *Cache
+	c *MemoryCache
+	admission AdmissionPolicy
+	wheel *TimingWheel
+	defaultTTL time.Duration
+	stats *cacheStats
+	backing *backingLink
+	subs map[*Subscription]struct{}
+	busQueues map[*invalidationQueue]struct{}
+	done chan struct{}
+	expiryStopped chan struct{}
+	closeOnce sync.Once
+	closeErr error
 	mut *sync.Mutex
 }
 
-type DiskCache struct {
-	store map[Key]Value
-}
-
-
-type Cache struct {
+type MemoryCache struct {
 	capacity int
 	store map[Key]Value
 	epolicy EvictionPolicy
-	hits int
-	misses int
-	evictionCounts int
 }
 
 type KeyTime struct {
@@ -78,6 +102,7 @@ type KeyTime struct {
 
 type EvictionPolicy interface {
 	check() Key
+	victim() Key
 	setValue(Key)
 	removeKey(Key)
 	Initalize()
@@ -114,22 +139,19 @@ func (q *Queue) Dequeue() (KeyTime, bool) {
 
 type Key struct {
 	value interface{}
-	expiry time.Time
 }
 
 type Value struct {
 	value interface{}
+	expiry time.Time
 }
 
-/*
-  
-*/
+// LFU evicts the least frequently used key, ties go to the oldest one.
+// Like LRU it does not lock on its own, MultiCache holds mu.mut around it.
 type LFU struct {
-	capacity int
 	store    map[Key]*list.Element
 	freqMap  map[int]*list.List
 	minFreq  int
-	mut      *sync.Mutex
 }
 
 type Node struct {
@@ -138,28 +160,19 @@ type Node struct {
 	freq  int
 }
 
-func (lfu *LFU) Initialize(capacity int) {
-	lfu.capacity = capacity
+func (lfu *LFU) Initalize() {
 	lfu.store = make(map[Key]*list.Element)
 	lfu.freqMap = make(map[int]*list.List)
 	lfu.minFreq = 0
-	lfu.mut = &sync.Mutex{}
 }
 
 func (lfu *LFU) setValue(key Key) {
-	lfu.mut.Lock()
-	defer lfu.mut.Unlock()
-
 	if elem, exists := lfu.store[key]; exists {
 		node := elem.Value.(*Node)
 		lfu.updateFrequency(node)
 		return
 	}
 
-	if len(lfu.store) >= lfu.capacity {
-		lfu.check()
-	}
-
 	node := &Node{key: key, freq: 1}
 	if lfu.freqMap[1] == nil {
 		lfu.freqMap[1] = list.New()
@@ -185,23 +198,44 @@ func (lfu *LFU) check() Key {
 
 	if list.Len() == 0 {
 		delete(lfu.freqMap, lfu.minFreq)
+		lfu.resetMinFreq()
 	}
 
 	return node.key
 }
 
-func (lfu *LFU) removeKey(key Key) {
-
-	lfu.mut.Lock()
-	defer lfu.mut.Unlock()
+// victim returns the key check would evict, without evicting it
+func (lfu *LFU) victim() Key {
+	list := lfu.freqMap[lfu.minFreq]
+	if list == nil || list.Front() == nil {
+		return Key{}
+	}
+	return list.Front().Value.(*Node).key
+}
 
+func (lfu *LFU) removeKey(key Key) {
 	if elem, exists := lfu.store[key]; exists {
 		node := elem.Value.(*Node)
-		lfu.freqMap[node.freq].Remove(lfu.store[node.key])
+		lfu.freqMap[node.freq].Remove(elem)
 		delete(lfu.store, node.key)
-		return
+
+		if lfu.freqMap[node.freq].Len() == 0 {
+			delete(lfu.freqMap, node.freq)
+			if lfu.minFreq == node.freq {
+				lfu.resetMinFreq()
+			}
+		}
 	}
+}
 
+// resetMinFreq finds the lowest frequency left after a list ran empty
+func (lfu *LFU) resetMinFreq() {
+	lfu.minFreq = 0
+	for freq := range lfu.freqMap {
+		if lfu.minFreq == 0 || freq < lfu.minFreq {
+			lfu.minFreq = freq
+		}
+	}
 }
 
 func (lfu *LFU) updateFrequency(node *Node) {
@@ -245,6 +279,15 @@ func (lr *LRU) check() Key {
 	return Key{}
 }
 
+// victim returns the key check would evict, without evicting it
+func (lr *LRU) victim() Key {
+	elem := lr.q.Back()
+	if elem == nil {
+		return Key{}
+	}
+	return elem.Value.(Key)
+}
+
 func (lru *LRU) removeKey(key Key) {
 
 	if elem, found := lru.m[key]; found {
@@ -256,141 +299,315 @@ func (lru *LRU) removeKey(key Key) {
 func (mu *MultiCache) ChangeCapacity(capacity int) {
 	mu.mut.Lock()
 	defer mu.mut.Unlock()
-   for mu.c.capacity > capacity {
+   for len(mu.c.store) > capacity {
 	evictedKey := mu.c.epolicy.check()
-	mu.dc.store[evictedKey] = mu.c.store[evictedKey]
-	mu.c.evictionCounts++
+	mu.demote(evictedKey)
+	mu.stats.evictions.Add(1)
+	mu.publish(Event{Type: EventEvict, Key: evictedKey, Reason: EvictResize})
 
 	delete(mu.c.store, evictedKey)
-	mu.c.capacity--
 }
+   mu.c.capacity = capacity
 }
 
 
 func(mu *MultiCache) GetStatstics()  {
-	
-	fmt.Println("hits ", mu.c.hits)
-	fmt.Println("misses ", mu.c.misses)
-	fmt.Println("evictionCounts ", mu.c.evictionCounts)
+	mu.Stats().Print()
 }
 
 func(mu *MultiCache) GetKey(key Key) Value {
+	value, found := mu.LookupKey(key)
+	if !found {
+		fmt.Println("Key requested is not present on cache and disk cache") 
+	}
+	return value
+}
+
+// LookupKey is GetKey without the logging, found is false on a miss so a
+// stored nil value can be told apart from a missing key. With a read-through
+// backing store a miss in both tiers is loaded from the store.
+func (mu *MultiCache) LookupKey(key Key) (Value, bool) {
+	mu.mut.Lock()
+	value, found := mu.lookup(key)
+	backing := mu.backing
+	mu.mut.Unlock()
 
+	if found || backing == nil || !backing.options.ReadThrough {
+		return value, found
+	}
+	return mu.readThrough(backing, key)
+}
+
+// PeekKey is LookupKey for callers that only check, it does not touch the
+// statistics, the admission and eviction policies or the backing store
+func (mu *MultiCache) PeekKey(key Key) (Value, bool) {
+	mu.mut.Lock()
+	defer mu.mut.Unlock()
+
+	value, exists := mu.c.store[key]
+	if !exists {
+		value, exists = mu.dc.Get(key)
+	}
+	if !exists || value.expired(time.Now()) {
+		return Value{}, false
+	}
+	return value, true
+}
+
+// lookup checks memory then disk, mu.mut must be held
+func (mu *MultiCache) lookup(key Key) (Value, bool) {
+	now := time.Now()
+	mu.admission.Record(key)
 	value, exists := mu.c.store[key]
 
-	if exists {
+	if exists && !value.expired(now) {
 		//check the evictionPolicy
-		mu.c.hits++
+		mu.stats.memoryHits.Add(1)
 		mu.c.epolicy.setValue(key) 
-		return value
+		return value, true
 	}
 
-	mu.c.misses++
-	value, exists = mu.dc.store[key]
 	if exists {
-		return value
+		mu.stats.misses.Add(1)
+		mu.expireKey(key, now)
+		return Value{}, false
 	}
-	fmt.Println("Key requested is not present on cache and disk cache") 
 
-	return Value{}
+	value, exists = mu.dc.Get(key)
+	if exists && !value.expired(now) {
+		mu.stats.diskHits.Add(1)
+		mu.promote(key, value)
+		return value, true
+	}
+	mu.stats.misses.Add(1)
+	if exists {
+		mu.expireKey(key, now)
+	}
+	return Value{}, false
 }
 
-func(mu *MultiCache) removeKey(key Key)  {
+// DeleteKey removes key from both tiers and from the backing store, found is
+// false if key was not cached
+func (mu *MultiCache) DeleteKey(key Key) (bool, error) {
 	mu.mut.Lock()
 	defer mu.mut.Unlock()
-	delete(mu.c.store , key)
-	mu.c.epolicy.setValue(key)
+
+	if err := mu.backing.delete(key); err != nil {
+		return false, err
+	}
+
+	_, inMemory := mu.c.store[key]
+	found := inMemory || mu.dc.Exists(key)
+	mu.dropKey(key)
+	if found {
+		mu.publish(Event{Type: EventDelete, Key: key})
+	}
+	return found, nil
 }
 
+// dropKey removes key from both tiers and from the timing wheel
+func (mu *MultiCache) dropKey(key Key) {
+	if _, exists := mu.c.store[key]; exists {
+		delete(mu.c.store, key)
+		mu.c.epolicy.removeKey(key)
+	}
+	mu.dropFromDisk(key)
+	mu.wheel.Remove(key)
+}
 
-func(mu *MultiCache) SetKey(key Key, value Value) {
-	//check the capacity
+
+// SetKey stores the value with the default TTL, see SetKeyWithTTL
+func(mu *MultiCache) SetKey(key Key, value Value) error {
 	mu.mut.Lock()
-	defer mu.mut.Unlock()
+	ttl := mu.defaultTTL
+	mu.mut.Unlock()
 
-	_, exists := mu.c.store[key]
+	return mu.SetKeyWithTTL(key, value, ttl)
+}
 
-	if !exists && mu.c.capacity == len(mu.c.store) {
-		//check the evictionPolicy
+// SetKeyWithTTL stores the value for ttl, a ttl <= 0 never expires. In
+// write-through mode the cache is left untouched if the store write fails,
+// the write runs under mu.mut so the store sees writes in cache order.
+func(mu *MultiCache) SetKeyWithTTL(key Key, value Value, ttl time.Duration) error {
+	mu.mut.Lock()
+	defer mu.mut.Unlock()
 
-		evictedKey := mu.c.epolicy.check()
-		mu.dc.store[evictedKey] = mu.c.store[evictedKey]
-		mu.c.evictionCounts++
+	if err := mu.backing.write(key, value); err != nil {
+		return err
+	}
+	mu.set(key, value, ttl)
+	mu.publish(Event{Type: EventSet, Key: key, Value: value})
+	return nil
+}
 
-		delete(mu.c.store, evictedKey)
-		mu.c.store[key] = value
-		mu.c.epolicy.setValue(key)
+// set puts key in memory, or on disk if admission keeps it out. mu.mut must be held.
+func (mu *MultiCache) set(key Key, value Value, ttl time.Duration) {
+	//check the capacity
+	mu.setExpiry(key, &value, ttl)
+	mu.admission.Record(key)
+	_, exists := mu.c.store[key]
 
+	if !exists && !mu.makeRoom(key) {
+		// memory keeps its hotter keys, the new value only goes to disk
+		if err := mu.dc.Set(key, value); err != nil {
+			fmt.Println("unable to write key ", key.value, " to disk cache : ", err)
+		}
 		return
 	}
 
 	mu.c.store[key] = value
 	mu.c.epolicy.setValue(key) 
+	mu.dropFromDisk(key)
 }
 
-func NewDiskCache() *DiskCache {
-	store := make(map[Key]Value)
+// promote moves a disk hit back into memory if the admission policy lets it in
+func (mu *MultiCache) promote(key Key, value Value) {
+	if !mu.makeRoom(key) {
+		return
+	}
+	mu.c.store[key] = value
+	mu.c.epolicy.setValue(key)
+	mu.dropFromDisk(key)
+}
 
-	return &DiskCache{
-		store: store,
+// makeRoom demotes the eviction victim to disk when memory is full. It returns
+// false if the admission policy would rather keep the victim than admit key.
+func (mu *MultiCache) makeRoom(key Key) bool {
+	if mu.c.capacity <= 0 {
+		return false
+	}
+	if len(mu.c.store) < mu.c.capacity {
+		return true
+	}
+
+	if !mu.admission.Admit(key, mu.c.epolicy.victim()) {
+		return false
+	}
+
+	evictedKey := mu.c.epolicy.check()
+	mu.demote(evictedKey)
+	mu.stats.evictions.Add(1)
+	mu.publish(Event{Type: EventEvict, Key: evictedKey, Reason: EvictCapacity})
+	delete(mu.c.store, evictedKey)
+	return true
+}
+
+// SetAdmissionPolicy replaces the policy deciding which keys get into memory
+func (mu *MultiCache) SetAdmissionPolicy(admission AdmissionPolicy) {
+	mu.mut.Lock()
+	defer mu.mut.Unlock()
+	mu.admission = admission
+}
+
+// demote writes an evicted key to the disk tier so it survives a restart
+func (mu *MultiCache) demote(key Key) {
+	if err := mu.dc.Set(key, mu.c.store[key]); err != nil {
+		fmt.Println("unable to write evicted key ", key.value, " to disk cache : ", err)
+	}
+}
+
+// dropFromDisk removes an older copy of the key from the disk tier, the
+// memory copy is the latest one now
+func (mu *MultiCache) dropFromDisk(key Key) {
+	if !mu.dc.Exists(key) {
+		return
+	}
+	if err := mu.dc.Remove(key); err != nil {
+		fmt.Println("unable to remove key ", key.value, " from disk cache : ", err)
 	}
 }
 
+// Close flushes pending write-behind writes, stops the expiry and closes the
+// disk tier. Closing again returns the error of the first Close.
+func (mu *MultiCache) Close() error {
+	mu.closeOnce.Do(func() {
+		mu.mut.Lock()
+		backing := mu.backing
+		mu.mut.Unlock()
+
+		flushErr := backing.close()
+		close(mu.done)
+		// the expiry must not touch the disk tier once it is closed
+		<-mu.expiryStopped
+		mu.closeSubscriptions()
+		if err := mu.dc.Close(); err != nil {
+			mu.closeErr = err
+			return
+		}
+		mu.closeErr = flushErr
+	})
+	return mu.closeErr
+}
+
 func(lr *LRU) Initalize() {
 	lr.m = make(map[Key]*list.Element)
 	lr.q = list.New()
 
 }
 
-func  NewCache(capacity int, ePolicy EvictionPolicy) *Cache  {
+func  NewMemoryCache(capacity int, ePolicy EvictionPolicy) *MemoryCache  {
 	store := make(map[Key]Value)
-	return &Cache{
+	return &MemoryCache{
 		capacity:  capacity,
 		store: store,
 		epolicy: ePolicy,
 	}
 }
 
-func NewMultiCache(capacity int, ePolicy EvictionPolicy) *MultiCache  {
+// NewMultiCache opens (or recovers) the disk tier stored in dir
+func NewMultiCache(capacity int, ePolicy EvictionPolicy, dir string) (*MultiCache, error)  {
 	
-	dc := NewDiskCache()
-	c := NewCache(capacity, ePolicy)
+	dc, err := NewDiskCache(dir)
+	if err != nil {
+		return nil, err
+	}
+	c := NewMemoryCache(capacity, ePolicy)
 	mu := MultiCache{}
 
 	mu.dc = dc
 	mu.c = c
+	mu.admission = &AlwaysAdmit{}
+	mu.wheel = NewTimingWheel(wheelTick, time.Now())
+	mu.stats = &cacheStats{}
+	mu.subs = make(map[*Subscription]struct{})
+	mu.busQueues = make(map[*invalidationQueue]struct{})
+	mu.done = make(chan struct{})
+	mu.expiryStopped = make(chan struct{})
 	mu.mut = &sync.Mutex{}
-	return &mu
+
+	// keys recovered from disk keep their expiry
+	dc.forEachExpiry(func(key Key, expiry time.Time) {
+		mu.wheel.Add(key, expiry)
+	})
+	go mu.runExpiry()
+
+	return &mu, nil
 }
 
 
 func main() {
 	lru := LRU{}
 	lru.Initalize()
-	mu := NewMultiCache(3, &lru)
-
-	go func(mu *MultiCache) {
-		
-		for {
-			for k, v := range mu.c.store {
-				if time.Now().After(k.expiry) {
-					
-					fmt.Println("Key ", k.value, " with value ", v, "is expired")
-					mu.removeKey(k)
-				}
-			}
-			time.Sleep(1* time.Second)
-			
-		}
-	}(mu)
-	mu.SetKey(Key{value: "1", expiry: time.Now().Add(3* time.Second)}, Value{1})
-	mu.SetKey(Key{value: "2", expiry: time.Now().Add(1* time.Second)}, Value{1})
-	mu.SetKey(Key{value: "3", expiry: time.Now().Add(2* time.Second)}, Value{1})
-	mu.SetKey(Key{value: "4", expiry: time.Now().Add(3* time.Second)}, Value{1})
+	mu, err := NewMultiCache(3, &lru, filepath.Join(os.TempDir(), "multicache"))
+	if err != nil {
+		fmt.Println("unable to open the cache ", err)
+		return
+	}
+	defer mu.Close()
+
+	mu.SetDefaultTTL(3* time.Second)
+	mu.SetKey(Key{value: "1"}, Value{value: 1})
+	mu.SetKeyWithTTL(Key{value: "2"}, Value{value: 1}, 1* time.Second)
+	mu.SetKeyWithTTL(Key{value: "3"}, Value{value: 1}, 2* time.Second)
+	mu.SetKey(Key{value: "4"}, Value{value: 1})
 
-	mu.GetKey(Key{value: "2"})
+	fmt.Println("value of 2 ", mu.GetKey(Key{value: "2"}).value)
+	time.Sleep(4* time.Second)
 	mu.GetStatstics()
 
-		// Prevent main from exiting
-		select {}
+	names := NewCache[string, string](mu)
+	name, err := names.GetOrLoad("user:1", func(id string) (string, error) {
+		return "name of " + id, nil
+	})
+	fmt.Println("loaded ", name, err)
 }
\ No newline at end of file
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+)
+
+// StatsSource is anything that can report cache statistics
+type StatsSource interface {
+	Stats() Stats
+}
+
+// MetricsHandler serves the statistics of source in the Prometheus text format
+func MetricsHandler(source StatsSource) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		writeMetrics(w, source.Stats())
+	})
+}
+
+func writeMetrics(w io.Writer, s Stats) {
+	writeHeader(w, "multicache_hits_total", "counter", "Lookups served from a cache tier.")
+	fmt.Fprintf(w, "multicache_hits_total{tier=\"memory\"} %d\n", s.MemoryHits)
+	fmt.Fprintf(w, "multicache_hits_total{tier=\"disk\"} %d\n", s.DiskHits)
+
+	writeHeader(w, "multicache_misses_total", "counter", "Lookups not found in any tier.")
+	fmt.Fprintf(w, "multicache_misses_total %d\n", s.Misses)
+
+	writeHeader(w, "multicache_hit_ratio", "gauge", "Hits over all lookups since start.")
+	fmt.Fprintf(w, "multicache_hit_ratio %s\n", formatFloat(s.HitRatio))
+
+	writeHeader(w, "multicache_evictions_total", "counter", "Keys evicted from memory to disk.")
+	fmt.Fprintf(w, "multicache_evictions_total %d\n", s.Evictions)
+
+	writeHeader(w, "multicache_expirations_total", "counter", "Keys removed because their TTL ran out.")
+	fmt.Fprintf(w, "multicache_expirations_total %d\n", s.Expirations)
+
+	writeHeader(w, "multicache_loads_total", "counter", "GetOrLoad calls that ran the loader.")
+	fmt.Fprintf(w, "multicache_loads_total %d\n", s.Loads)
+
+	writeHeader(w, "multicache_load_errors_total", "counter", "Loader calls that returned an error.")
+	fmt.Fprintf(w, "multicache_load_errors_total %d\n", s.LoadErrors)
+
+	writeHeader(w, "multicache_keys", "gauge", "Keys currently held per tier.")
+	fmt.Fprintf(w, "multicache_keys{tier=\"memory\"} %d\n", s.MemoryKeys)
+	fmt.Fprintf(w, "multicache_keys{tier=\"disk\"} %d\n", s.DiskKeys)
+
+	writeHeader(w, "multicache_load_duration_seconds", "histogram", "Latency of loader calls.")
+	var cumulative int64
+	for i, bound := range s.LoadLatency.Buckets {
+		cumulative += s.LoadLatency.Counts[i]
+		fmt.Fprintf(w, "multicache_load_duration_seconds_bucket{le=\"%s\"} %d\n", formatFloat(bound.Seconds()), cumulative)
+	}
+	fmt.Fprintf(w, "multicache_load_duration_seconds_bucket{le=\"+Inf\"} %d\n", s.LoadLatency.Count)
+	fmt.Fprintf(w, "multicache_load_duration_seconds_sum %s\n", formatFloat(s.LoadLatency.Sum.Seconds()))
+	fmt.Fprintf(w, "multicache_load_duration_seconds_count %d\n", s.LoadLatency.Count)
+}
+
+func writeHeader(w io.Writer, name string, kind string, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"math/rand"
+	"testing"
+)
+
+// policies returns a fresh instance of every eviction policy sized for capacity
+func policies(capacity int) map[string]EvictionPolicy {
+	lru := &LRU{}
+	lru.Initalize()
+	lfu := &LFU{}
+	lfu.Initalize()
+
+	return map[string]EvictionPolicy{
+		"LRU":   lru,
+		"LFU":   lfu,
+		"ARC":   NewARC(capacity),
+		"2Q":    NewTwoQ(capacity),
+		"CLOCK": NewClock(),
+	}
+}
+
+// replayTrace runs trace through a cache of the given capacity managed by
+// policy and returns the hit ratio
+func replayTrace(policy EvictionPolicy, capacity int, trace []Key) float64 {
+	resident := make(map[Key]bool, capacity)
+	hits := 0
+	for _, key := range trace {
+		if resident[key] {
+			hits++
+		} else if len(resident) >= capacity {
+			delete(resident, policy.check())
+		}
+		resident[key] = true
+		policy.setValue(key)
+	}
+	return float64(hits) / float64(len(trace))
+}
+
+func zipfTrace(n int, keys uint64, seed int64) []Key {
+	r := rand.New(rand.NewSource(seed))
+	zipf := rand.NewZipf(r, 1.1, 1, keys-1)
+	trace := make([]Key, n)
+	for i := range trace {
+		trace[i] = Key{value: int(zipf.Uint64())}
+	}
+	return trace
+}
+
+// scanTrace is a zipf workload with a long one-off scan every few thousand requests
+func scanTrace(n int, keys uint64, seed int64) []Key {
+	trace := zipfTrace(n, keys, seed)
+	next := int(keys)
+	for i := 0; i+5000 < len(trace); i += 5000 {
+		for j := 0; j < 1000; j++ {
+			trace[i+j] = Key{value: next}
+			next++
+		}
+	}
+	return trace
+}
+
+// loopTrace cycles over slightly more keys than fit in the cache
+func loopTrace(n int, keys int) []Key {
+	trace := make([]Key, n)
+	for i := range trace {
+		trace[i] = Key{value: i % keys}
+	}
+	return trace
+}
+
+func TestPoliciesEvictResidentKeys(t *testing.T) {
+	const capacity = 50
+	trace := scanTrace(20000, 500, 1)
+
+	for name, policy := range policies(capacity) {
+		resident := make(map[Key]bool)
+		for i, key := range trace {
+			if !resident[key] && len(resident) >= capacity {
+				victim := policy.victim()
+				evicted := policy.check()
+				if victim != evicted {
+					t.Fatalf("%s: victim %v but check evicted %v at %d", name, victim.value, evicted.value, i)
+				}
+				if !resident[evicted] {
+					t.Fatalf("%s: evicted non resident key %v at %d", name, evicted.value, i)
+				}
+				delete(resident, evicted)
+			}
+			resident[key] = true
+			policy.setValue(key)
+
+			if i%7 == 0 {
+				policy.removeKey(key)
+				delete(resident, key)
+			}
+		}
+	}
+}
+
+func TestPoliciesWithMultiCache(t *testing.T) {
+	for name, policy := range policies(3) {
+		mu, err := NewMultiCache(3, policy, t.TempDir())
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		for i := 0; i < 10; i++ {
+			mu.SetKey(Key{value: i}, Value{value: i})
+		}
+		for i := 0; i < 10; i++ {
+			if got := mu.GetKey(Key{value: i}); got.value != i {
+				t.Errorf("%s: key %d returned %v", name, i, got.value)
+			}
+		}
+		mu.Close()
+	}
+}
+
+func BenchmarkPolicyHitRatio(b *testing.B) {
+	const capacity = 1000
+	traces := map[string][]Key{
+		"zipf": zipfTrace(200000, 20000, 1),
+		"scan": scanTrace(200000, 20000, 2),
+		"loop": loopTrace(200000, capacity+capacity/10),
+	}
+
+	for traceName, trace := range traces {
+		for _, name := range []string{"LRU", "LFU", "ARC", "2Q", "CLOCK"} {
+			b.Run(traceName+"/"+name, func(b *testing.B) {
+				var ratio float64
+				for i := 0; i < b.N; i++ {
+					ratio = replayTrace(policies(capacity)[name], capacity, trace)
+				}
+				b.ReportMetric(ratio*100, "hit%")
+			})
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+/*
+
+RESP (REdis Serialization Protocol) subset
+- requests are arrays of bulk strings  *2\r\n$3\r\nGET\r\n$3\r\nfoo\r\n
+  or inline commands                   GET foo\r\n
+- replies are simple strings (+), errors (-), integers (:), bulk strings ($)
+  and the null bulk string ($-1)
+
+*/
+
+// limits on what a client can make the server allocate before it sent the bytes
+const (
+	maxMultibulkLen = 1024 * 1024      // arguments per command
+	maxBulkLen      = 64 * 1024 * 1024 // bytes per argument
+	maxLineLen      = 64 * 1024        // bytes per inline command or header line
+)
+
+var errProtocol = errors.New("protocol error")
+
+// readCommand reads one request and returns its arguments
+func readCommand(r *bufio.Reader) ([]string, error) {
+	line, err := readLine(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 {
+		return nil, nil
+	}
+	if line[0] != '*' {
+		return strings.Fields(line), nil
+	}
+
+	n, err := strconv.Atoi(line[1:])
+	if err != nil || n < 0 || n > maxMultibulkLen {
+		return nil, fmt.Errorf("%w: invalid multibulk length", errProtocol)
+	}
+
+	args := make([]string, 0, min(n, 64))
+	for i := 0; i < n; i++ {
+		line, err := readLine(r)
+		if err != nil {
+			return nil, err
+		}
+		if len(line) == 0 || line[0] != '$' {
+			return nil, fmt.Errorf("%w: expected '$', got '%s'", errProtocol, line)
+		}
+		size, err := strconv.Atoi(line[1:])
+		if err != nil || size < 0 || size > maxBulkLen {
+			return nil, fmt.Errorf("%w: invalid bulk length", errProtocol)
+		}
+
+		// grows with what actually arrives, a length alone allocates nothing
+		var buf bytes.Buffer
+		if _, err := io.CopyN(&buf, r, int64(size)+2); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		bulk := buf.Bytes()
+		if bulk[size] != '\r' || bulk[size+1] != '\n' {
+			return nil, fmt.Errorf("%w: bulk string not terminated", errProtocol)
+		}
+		args = append(args, string(bulk[:size]))
+	}
+	return args, nil
+}
+
+// readLine reads up to \n, lines longer than maxLineLen are a protocol error
+func readLine(r *bufio.Reader) (string, error) {
+	var line []byte
+	for {
+		chunk, err := r.ReadSlice('\n')
+		if len(line)+len(chunk) > maxLineLen {
+			return "", fmt.Errorf("%w: line too long", errProtocol)
+		}
+		line = append(line, chunk...)
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimRight(string(line), "\r\n"), nil
+	}
+}
+
+// respWriter buffers replies until the connection flushes them
+type respWriter struct {
+	w *bufio.Writer
+}
+
+func (rw *respWriter) simple(s string) {
+	rw.w.WriteString("+" + s + "\r\n")
+}
+
+func (rw *respWriter) err(msg string) {
+	rw.w.WriteString("-ERR " + msg + "\r\n")
+}
+
+func (rw *respWriter) integer(n int64) {
+	rw.w.WriteString(":" + strconv.FormatInt(n, 10) + "\r\n")
+}
+
+func (rw *respWriter) bulk(s string) {
+	rw.w.WriteString("$" + strconv.Itoa(len(s)) + "\r\n" + s + "\r\n")
+}
+
+func (rw *respWriter) null() {
+	rw.w.WriteString("$-1\r\n")
+}
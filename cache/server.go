@@ -0,0 +1,306 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+
+Server - TCP server speaking a RESP subset, so redis clients can use the cache
+
+  GET key
+  SET key value [EX seconds | PX milliseconds]
+  DEL key [key ...]
+  EXISTS key [key ...]
+  TTL key
+  INFO
+  PING [message]
+
+Commands are dispatched through the handlers table, the same way root main.go
+maps handlerGet / handlerSet / handlerDelete.
+
+*/
+
+// ServerStore is what the server needs from the cache, MultiCache and
+// ShardedCache both provide it
+type ServerStore interface {
+	KeyStore
+	StatsSource
+	KeyTTL(key Key) (time.Duration, bool)
+}
+
+type Handler func(store ServerStore, w *respWriter, args ...string)
+
+var handlers = map[string]Handler{
+	"GET":    handlerGet,
+	"SET":    handlerSet,
+	"DEL":    handlerDelete,
+	"EXISTS": handlerExists,
+	"TTL":    handlerTTL,
+	"INFO":   handlerInfo,
+	"PING":   handlerPing,
+}
+
+// arity is the minimum number of arguments after the command name
+var arity = map[string]int{
+	"GET":    1,
+	"SET":    2,
+	"DEL":    1,
+	"EXISTS": 1,
+	"TTL":    1,
+	"INFO":   0,
+	"PING":   0,
+}
+
+type Server struct {
+	store    ServerStore
+	listener net.Listener
+	conns    map[net.Conn]struct{}
+	closed   bool
+	wg       sync.WaitGroup
+	mu       sync.Mutex
+}
+
+func NewServer(store ServerStore) *Server {
+	return &Server{
+		store: store,
+		conns: make(map[net.Conn]struct{}),
+	}
+}
+
+func (s *Server) ListenAndServe(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(l)
+}
+
+// Serve accepts connections on l until Close is called
+func (s *Server) Serve(l net.Listener) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		l.Close()
+		return net.ErrClosed
+	}
+	s.listener = l
+	s.mu.Unlock()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			s.mu.Unlock()
+			if closed {
+				return nil
+			}
+			return err
+		}
+
+		s.mu.Lock()
+		s.conns[conn] = struct{}{}
+		s.mu.Unlock()
+
+		s.wg.Add(1)
+		go s.serveConn(conn)
+	}
+}
+
+// Close stops accepting, drops open connections and waits for them to finish
+func (s *Server) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	var err error
+	if s.listener != nil {
+		err = s.listener.Close()
+	}
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+
+	s.wg.Wait()
+	return err
+}
+
+func (s *Server) serveConn(conn net.Conn) {
+	defer func() {
+		// a bad request only costs its own connection
+		if r := recover(); r != nil {
+			fmt.Println("cache server: dropping connection ", conn.RemoteAddr(), " : ", r)
+		}
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+		conn.Close()
+		s.wg.Done()
+	}()
+
+	r := bufio.NewReader(conn)
+	w := &respWriter{w: bufio.NewWriter(conn)}
+	for {
+		args, err := readCommand(r)
+		if err != nil {
+			if errors.Is(err, errProtocol) {
+				w.err(err.Error())
+				w.w.Flush()
+			}
+			return
+		}
+		if len(args) == 0 {
+			continue
+		}
+
+		name := strings.ToUpper(args[0])
+		if name == "QUIT" {
+			w.simple("OK")
+			w.w.Flush()
+			return
+		}
+		s.dispatch(w, name, args[1:])
+
+		// pipelined commands get their replies in one write
+		if r.Buffered() == 0 {
+			if err := w.w.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (s *Server) dispatch(w *respWriter, name string, args []string) {
+	handler, exists := handlers[name]
+	if !exists {
+		w.err(fmt.Sprintf("unknown command '%s'", name))
+		return
+	}
+	if len(args) < arity[name] {
+		w.err(fmt.Sprintf("wrong number of arguments for '%s' command", strings.ToLower(name)))
+		return
+	}
+	handler(s.store, w, args...)
+}
+
+func handlerGet(store ServerStore, w *respWriter, args ...string) {
+	value, found := store.LookupKey(Key{value: args[0]})
+	if !found {
+		w.null()
+		return
+	}
+	switch v := value.value.(type) {
+	case string:
+		w.bulk(v)
+	case []byte:
+		w.bulk(string(v))
+	default:
+		w.bulk(fmt.Sprint(v))
+	}
+}
+
+func handlerSet(store ServerStore, w *respWriter, args ...string) {
+	key, value := Key{value: args[0]}, Value{value: args[1]}
+
+	var ttl time.Duration
+	for i := 2; i < len(args); i++ {
+		option := strings.ToUpper(args[i])
+		if (option != "EX" && option != "PX") || i+1 >= len(args) || ttl != 0 {
+			w.err("syntax error")
+			return
+		}
+		n, err := strconv.ParseInt(args[i+1], 10, 64)
+		if err != nil || n <= 0 {
+			w.err("invalid expire time in 'set' command")
+			return
+		}
+		if option == "EX" {
+			ttl = time.Duration(n) * time.Second
+		} else {
+			ttl = time.Duration(n) * time.Millisecond
+		}
+		i++
+	}
+
+	var err error
+	if ttl > 0 {
+		err = store.SetKeyWithTTL(key, value, ttl)
+	} else {
+		err = store.SetKey(key, value)
+	}
+	if err != nil {
+		w.err(err.Error())
+		return
+	}
+	w.simple("OK")
+}
+
+func handlerDelete(store ServerStore, w *respWriter, args ...string) {
+	var deleted int64
+	for _, key := range args {
+		found, err := store.DeleteKey(Key{value: key})
+		if err != nil {
+			w.err(err.Error())
+			return
+		}
+		if found {
+			deleted++
+		}
+	}
+	w.integer(deleted)
+}
+
+func handlerExists(store ServerStore, w *respWriter, args ...string) {
+	var found int64
+	for _, key := range args {
+		if _, exists := store.KeyTTL(Key{value: key}); exists {
+			found++
+		}
+	}
+	w.integer(found)
+}
+
+func handlerTTL(store ServerStore, w *respWriter, args ...string) {
+	ttl, exists := store.KeyTTL(Key{value: args[0]})
+	switch {
+	case !exists:
+		w.integer(-2)
+	case ttl < 0:
+		w.integer(-1)
+	default:
+		// round to the nearest second like redis does
+		w.integer(int64((ttl + 500*time.Millisecond) / time.Second))
+	}
+}
+
+func handlerInfo(store ServerStore, w *respWriter, args ...string) {
+	s := store.Stats()
+	var b strings.Builder
+	b.WriteString("# Stats\r\n")
+	fmt.Fprintf(&b, "keyspace_hits:%d\r\n", s.Hits())
+	fmt.Fprintf(&b, "keyspace_misses:%d\r\n", s.Misses)
+	fmt.Fprintf(&b, "memory_hits:%d\r\n", s.MemoryHits)
+	fmt.Fprintf(&b, "disk_hits:%d\r\n", s.DiskHits)
+	fmt.Fprintf(&b, "hit_ratio:%s\r\n", formatFloat(s.HitRatio))
+	fmt.Fprintf(&b, "evicted_keys:%d\r\n", s.Evictions)
+	fmt.Fprintf(&b, "expired_keys:%d\r\n", s.Expirations)
+	b.WriteString("\r\n# Keyspace\r\n")
+	fmt.Fprintf(&b, "memory_keys:%d\r\n", s.MemoryKeys)
+	fmt.Fprintf(&b, "disk_keys:%d\r\n", s.DiskKeys)
+	w.bulk(b.String())
+}
+
+func handlerPing(store ServerStore, w *respWriter, args ...string) {
+	if len(args) > 0 {
+		w.bulk(args[0])
+		return
+	}
+	w.simple("PONG")
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+)
+
+// startServer serves a fresh MultiCache on a loopback port
+func startServer(t *testing.T) (net.Conn, *bufio.Reader) {
+	t.Helper()
+
+	mu, err := NewMultiCache(2, newLRU(2), t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := NewServer(mu)
+	go server.Serve(l)
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		conn.Close()
+		server.Close()
+		mu.Close()
+	})
+	return conn, bufio.NewReader(conn)
+}
+
+// send writes args as a RESP array, the way redis clients do
+func send(t *testing.T, conn net.Conn, args ...string) {
+	t.Helper()
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if _, err := conn.Write([]byte(b.String())); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// reply reads one reply and returns it without the trailing \r\n, bulk
+// strings are returned as their payload
+func reply(t *testing.T, r *bufio.Reader) string {
+	t.Helper()
+
+	line, err := readLine(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if line[0] != '$' || line == "$-1" {
+		return line
+	}
+	payload, err := readLine(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return payload
+}
+
+func TestServerCommands(t *testing.T) {
+	conn, r := startServer(t)
+
+	steps := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"PING"}, "+PONG"},
+		{[]string{"GET", "missing"}, "$-1"},
+		{[]string{"SET", "name", "multicache"}, "+OK"},
+		{[]string{"GET", "name"}, "multicache"},
+		{[]string{"TTL", "name"}, ":-1"},
+		{[]string{"SET", "session", "abc", "EX", "100"}, "+OK"},
+		{[]string{"TTL", "session"}, ":100"},
+		{[]string{"TTL", "missing"}, ":-2"},
+		{[]string{"SET", "other", "x"}, "+OK"},
+		{[]string{"EXISTS", "name", "session", "other", "missing"}, ":3"},
+		{[]string{"GET", "name"}, "multicache"},
+		{[]string{"DEL", "name", "missing"}, ":1"},
+		{[]string{"GET", "name"}, "$-1"},
+		{[]string{"SET", "k", "v", "EX", "zero"}, "-ERR invalid expire time in 'set' command"},
+		{[]string{"SET", "k", "v", "NX"}, "-ERR syntax error"},
+		{[]string{"GET"}, "-ERR wrong number of arguments for 'get' command"},
+		{[]string{"FLUSHALL"}, "-ERR unknown command 'FLUSHALL'"},
+	}
+	for _, step := range steps {
+		send(t, conn, step.args...)
+		if got := reply(t, r); got != step.want {
+			t.Errorf("%v: got %q, want %q", step.args, got, step.want)
+		}
+	}
+
+	send(t, conn, "INFO")
+	if info := reply(t, r); info != "# Stats" {
+		t.Errorf("INFO starts with %q", info)
+	}
+}
+
+func TestServerPipelineAndInline(t *testing.T) {
+	conn, r := startServer(t)
+
+	// three commands in one write, the last one inline like telnet would send it
+	pipeline := "*3\r\n$3\r\nSET\r\n$1\r\na\r\n$1\r\n1\r\n" +
+		"*2\r\n$3\r\nGET\r\n$1\r\na\r\n" +
+		"EXISTS a\r\n"
+	if _, err := conn.Write([]byte(pipeline)); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"+OK", "1", ":1"} {
+		if got := reply(t, r); got != want {
+			t.Errorf("got %q, want %q", got, want)
+		}
+	}
+}
+
+// expectProtocolError checks that request is answered with a protocol error
+// and the connection closed, and that the server still takes new clients
+func expectProtocolError(t *testing.T, request string) {
+	t.Helper()
+	conn, r := startServer(t)
+
+	go conn.Write([]byte(request))
+	if got := reply(t, r); !strings.HasPrefix(got, "-ERR protocol error") {
+		t.Errorf("%.20q: got %q, want a protocol error", request, got)
+	}
+	if _, err := r.ReadByte(); err == nil {
+		t.Errorf("%.20q: connection still open", request)
+	}
+
+	other, err := net.Dial("tcp", conn.RemoteAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	send(t, other, "PING")
+	if got := reply(t, bufio.NewReader(other)); got != "+PONG" {
+		t.Errorf("server after a bad client: %q", got)
+	}
+}
+
+func TestServerLimits(t *testing.T) {
+	expectProtocolError(t, "*99999999999999\r\n")
+	expectProtocolError(t, fmt.Sprintf("*%d\r\n", maxMultibulkLen+1))
+	expectProtocolError(t, fmt.Sprintf("*1\r\n$%d\r\n", maxBulkLen+1))
+	expectProtocolError(t, strings.Repeat("a", maxLineLen+1)+"\r\n")
+	expectProtocolError(t, "*1\r\n$"+strings.Repeat("1", maxLineLen)+"\r\n")
+}
+
+// panicStore fails every GET with a panic
+type panicStore struct {
+	*MultiCache
+}
+
+func (p panicStore) LookupKey(key Key) (Value, bool) {
+	panic("lookup failed")
+}
+
+func TestServerRecoversPerConnection(t *testing.T) {
+	mu := newTestMultiCache(t, 2)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := NewServer(panicStore{mu})
+	go server.Serve(l)
+	defer server.Close()
+
+	bad, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bad.Close()
+	send(t, bad, "GET", "k")
+	if _, err := bufio.NewReader(bad).ReadByte(); err == nil {
+		t.Error("connection that panicked got a reply")
+	}
+
+	good, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer good.Close()
+	send(t, good, "PING")
+	if got := reply(t, bufio.NewReader(good)); got != "+PONG" {
+		t.Errorf("server after a panic: %q", got)
+	}
+}
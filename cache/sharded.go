@@ -0,0 +1,155 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"time"
+)
+
+/*
+
+ShardedCache
+- N independent MultiCache shards, a key always lands on shard hashKey(key) % N
+- every shard has its own lock, eviction policy, disk segment and statistics
+- capacity is split evenly across the shards
+
+*/
+
+type ShardedCache struct {
+	shards []*MultiCache
+}
+
+// NewShardedCache creates shards MultiCaches sharing capacity between them.
+// newPolicy is called once per shard with that shard's capacity, shard i
+// keeps its disk tier in dir/shard-i.
+func NewShardedCache(shards int, capacity int, newPolicy func(capacity int) EvictionPolicy, dir string) (*ShardedCache, error) {
+	if shards <= 0 {
+		return nil, fmt.Errorf("number of shards must be positive, got %d", shards)
+	}
+
+	sc := &ShardedCache{shards: make([]*MultiCache, shards)}
+	for i := range sc.shards {
+		shardCapacity := shardCapacity(capacity, shards, i)
+		shard, err := NewMultiCache(shardCapacity, newPolicy(shardCapacity), filepath.Join(dir, fmt.Sprintf("shard-%d", i)))
+		if err != nil {
+			sc.closeShards(i)
+			return nil, err
+		}
+		sc.shards[i] = shard
+	}
+	return sc, nil
+}
+
+// shardCapacity gives the first capacity%shards shards one extra slot
+func shardCapacity(capacity int, shards int, i int) int {
+	c := capacity / shards
+	if i < capacity%shards {
+		c++
+	}
+	return c
+}
+
+func (sc *ShardedCache) shard(key Key) *MultiCache {
+	return sc.shards[hashKey(key)%uint64(len(sc.shards))]
+}
+
+func (sc *ShardedCache) GetKey(key Key) Value {
+	return sc.shard(key).GetKey(key)
+}
+
+func (sc *ShardedCache) LookupKey(key Key) (Value, bool) {
+	return sc.shard(key).LookupKey(key)
+}
+
+func (sc *ShardedCache) PeekKey(key Key) (Value, bool) {
+	return sc.shard(key).PeekKey(key)
+}
+
+func (sc *ShardedCache) SetKey(key Key, value Value) error {
+	return sc.shard(key).SetKey(key, value)
+}
+
+func (sc *ShardedCache) SetKeyWithTTL(key Key, value Value, ttl time.Duration) error {
+	return sc.shard(key).SetKeyWithTTL(key, value, ttl)
+}
+
+func (sc *ShardedCache) DeleteKey(key Key) (bool, error) {
+	return sc.shard(key).DeleteKey(key)
+}
+
+func (sc *ShardedCache) KeyTTL(key Key) (time.Duration, bool) {
+	return sc.shard(key).KeyTTL(key)
+}
+
+func (sc *ShardedCache) SetDefaultTTL(ttl time.Duration) {
+	for _, shard := range sc.shards {
+		shard.SetDefaultTTL(ttl)
+	}
+}
+
+// SetAdmissionPolicy gives every shard its own policy from newAdmission
+func (sc *ShardedCache) SetAdmissionPolicy(newAdmission func() AdmissionPolicy) {
+	for _, shard := range sc.shards {
+		shard.SetAdmissionPolicy(newAdmission())
+	}
+}
+
+// SetBackingStore attaches store to every shard, each shard flushes its own
+// write-behind queue
+func (sc *ShardedCache) SetBackingStore(store BackingStore, options StoreOptions) error {
+	for _, shard := range sc.shards {
+		if err := shard.SetBackingStore(store, options); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (sc *ShardedCache) Flush() error {
+	var firstErr error
+	for _, shard := range sc.shards {
+		if err := shard.Flush(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+func (sc *ShardedCache) ChangeCapacity(capacity int) {
+	for i, shard := range sc.shards {
+		shard.ChangeCapacity(shardCapacity(capacity, len(sc.shards), i))
+	}
+}
+
+// Stats sums the statistics of all shards
+func (sc *ShardedCache) Stats() Stats {
+	var total Stats
+	for _, shard := range sc.shards {
+		total = total.merge(shard.Stats())
+	}
+	return total
+}
+
+// RecordLoad records a GetOrLoad on the shard owning key
+func (sc *ShardedCache) RecordLoad(key Key, latency time.Duration, err error) {
+	sc.shard(key).RecordLoad(key, latency, err)
+}
+
+func (sc *ShardedCache) GetStatstics() {
+	fmt.Println("shards ", len(sc.shards))
+	sc.Stats().Print()
+}
+
+func (sc *ShardedCache) Close() error {
+	return sc.closeShards(len(sc.shards))
+}
+
+func (sc *ShardedCache) closeShards(n int) error {
+	var firstErr error
+	for _, shard := range sc.shards[:n] {
+		if err := shard.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
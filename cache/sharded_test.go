@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func newLRU(capacity int) EvictionPolicy {
+	lru := &LRU{}
+	lru.Initalize()
+	return lru
+}
+
+// run with go test -race, every shard is hit from many goroutines at once
+func TestShardedCacheConcurrent(t *testing.T) {
+	sc, err := NewShardedCache(8, 64, newLRU, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sc.Close()
+
+	var wg sync.WaitGroup
+	for g := 0; g < 16; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				key := Key{value: strconv.Itoa(g*1000 + i%50)}
+				sc.SetKey(key, Value{value: i})
+				sc.LookupKey(key)
+				if i%10 == 0 {
+					sc.DeleteKey(key)
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	// every key still set must be readable, either from memory or from disk
+	for g := 0; g < 16; g++ {
+		key := Key{value: strconv.Itoa(g*1000 + 49)}
+		if _, found := sc.LookupKey(key); !found {
+			t.Errorf("key %v lost", key.value)
+		}
+	}
+}
+
+func TestShardedCacheCapacityAndStatistics(t *testing.T) {
+	sc, err := NewShardedCache(4, 10, newLRU, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sc.Close()
+
+	total := 0
+	for _, shard := range sc.shards {
+		total += shard.c.capacity
+	}
+	if total != 10 {
+		t.Fatalf("shard capacities add up to %d, want 10", total)
+	}
+
+	for i := 0; i < 100; i++ {
+		sc.SetKey(Key{value: i}, Value{value: i})
+	}
+	for i := 0; i < 100; i++ {
+		if value, found := sc.LookupKey(Key{value: i}); !found || value.value != i {
+			t.Fatalf("key %d returned %v %v", i, value.value, found)
+		}
+	}
+
+	for _, shard := range sc.shards {
+		if len(shard.c.store) > shard.c.capacity {
+			t.Errorf("shard holds %d keys over capacity %d", len(shard.c.store), shard.c.capacity)
+		}
+	}
+	stats := sc.Stats()
+	if stats.Hits() != 100 || stats.Misses != 0 {
+		t.Errorf("hits %d misses %d, want 100 hits", stats.Hits(), stats.Misses)
+	}
+	if stats.MemoryKeys != 10 || stats.DiskKeys != 90 {
+		t.Errorf("%d keys in memory, %d on disk, want 10 and 90", stats.MemoryKeys, stats.DiskKeys)
+	}
+}
+
+func BenchmarkShardedCacheParallel(b *testing.B) {
+	for _, shards := range []int{1, 4, 16, 64} {
+		b.Run(fmt.Sprintf("shards=%d", shards), func(b *testing.B) {
+			sc, err := NewShardedCache(shards, 100000, newLRU, b.TempDir())
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer sc.Close()
+
+			keys := make([]Key, 10000)
+			for i := range keys {
+				keys[i] = Key{value: strconv.Itoa(i)}
+				sc.SetKey(keys[i], Value{value: i})
+			}
+
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				i := 0
+				for pb.Next() {
+					key := keys[i%len(keys)]
+					if i%4 == 0 {
+						sc.SetKey(key, Value{value: i})
+					} else {
+						sc.LookupKey(key)
+					}
+					i++
+				}
+			})
+		})
+	}
+}
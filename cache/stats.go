@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// loadBuckets are the upper bounds of the load latency histogram, an array
+// so the histogram can size its counters from it
+var loadBuckets = [...]time.Duration{
+	100 * time.Microsecond,
+	500 * time.Microsecond,
+	time.Millisecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	5 * time.Second,
+}
+
+// cacheStats is updated lock free, the hot paths only do atomic adds
+type cacheStats struct {
+	memoryHits  atomic.Int64
+	diskHits    atomic.Int64
+	misses      atomic.Int64
+	evictions   atomic.Int64
+	expirations atomic.Int64
+	loads       atomic.Int64
+	loadErrors  atomic.Int64
+	loadLatency histogram
+}
+
+type histogram struct {
+	// counts[i] counts observations <= loadBuckets[i], the last one is +Inf
+	counts [len(loadBuckets) + 1]atomic.Int64
+	sum    atomic.Int64
+	count  atomic.Int64
+}
+
+func (h *histogram) observe(d time.Duration) {
+	i := 0
+	for i < len(loadBuckets) && d > loadBuckets[i] {
+		i++
+	}
+	h.counts[i].Add(1)
+	h.sum.Add(int64(d))
+	h.count.Add(1)
+}
+
+func (h *histogram) snapshot() Histogram {
+	snap := Histogram{
+		Buckets: loadBuckets[:],
+		Counts:  make([]int64, len(h.counts)),
+		Sum:     time.Duration(h.sum.Load()),
+		Count:   h.count.Load(),
+	}
+	for i := range h.counts {
+		snap.Counts[i] = h.counts[i].Load()
+	}
+	return snap
+}
+
+// Histogram is a point in time copy of a latency histogram. Counts are per
+// bucket (not cumulative), Counts[len(Buckets)] holds everything above the
+// last bound.
+type Histogram struct {
+	Buckets []time.Duration
+	Counts  []int64
+	Sum     time.Duration
+	Count   int64
+}
+
+// Stats is a point in time copy of the cache statistics
+type Stats struct {
+	MemoryHits  int64
+	DiskHits    int64
+	Misses      int64
+	HitRatio    float64
+	Evictions   int64
+	Expirations int64
+	Loads       int64
+	LoadErrors  int64
+	LoadLatency Histogram
+	MemoryKeys  int
+	DiskKeys    int
+}
+
+func (s Stats) Hits() int64 {
+	return s.MemoryHits + s.DiskHits
+}
+
+func (s Stats) Print() {
+	fmt.Println("hits ", s.Hits(), " (memory ", s.MemoryHits, ", disk ", s.DiskHits, ")")
+	fmt.Println("misses ", s.Misses)
+	fmt.Printf("hitRatio %.2f\n", s.HitRatio)
+	fmt.Println("evictionCounts ", s.Evictions)
+	fmt.Println("expirations ", s.Expirations)
+	fmt.Println("loads ", s.Loads, " (errors ", s.LoadErrors, ")")
+	fmt.Println("keys ", s.MemoryKeys, " in memory, ", s.DiskKeys, " on disk")
+}
+
+// merge adds other to s, used to sum up shards
+func (s Stats) merge(other Stats) Stats {
+	s.MemoryHits += other.MemoryHits
+	s.DiskHits += other.DiskHits
+	s.Misses += other.Misses
+	s.Evictions += other.Evictions
+	s.Expirations += other.Expirations
+	s.Loads += other.Loads
+	s.LoadErrors += other.LoadErrors
+	s.MemoryKeys += other.MemoryKeys
+	s.DiskKeys += other.DiskKeys
+
+	if s.LoadLatency.Counts == nil {
+		s.LoadLatency = Histogram{Buckets: loadBuckets[:], Counts: make([]int64, len(loadBuckets)+1)}
+	} else {
+		s.LoadLatency.Counts = append([]int64(nil), s.LoadLatency.Counts...)
+	}
+	for i, c := range other.LoadLatency.Counts {
+		s.LoadLatency.Counts[i] += c
+	}
+	s.LoadLatency.Sum += other.LoadLatency.Sum
+	s.LoadLatency.Count += other.LoadLatency.Count
+
+	s.HitRatio = hitRatio(s.Hits(), s.Misses)
+	return s
+}
+
+func hitRatio(hits int64, misses int64) float64 {
+	if hits+misses == 0 {
+		return 0
+	}
+	return float64(hits) / float64(hits+misses)
+}
+
+// Stats returns a snapshot of the counters, the key counts are read under the lock
+func (mu *MultiCache) Stats() Stats {
+	mu.mut.Lock()
+	memoryKeys := len(mu.c.store)
+	mu.mut.Unlock()
+
+	s := Stats{
+		MemoryHits:  mu.stats.memoryHits.Load(),
+		DiskHits:    mu.stats.diskHits.Load(),
+		Misses:      mu.stats.misses.Load(),
+		Evictions:   mu.stats.evictions.Load(),
+		Expirations: mu.stats.expirations.Load(),
+		Loads:       mu.stats.loads.Load(),
+		LoadErrors:  mu.stats.loadErrors.Load(),
+		LoadLatency: mu.stats.loadLatency.snapshot(),
+		MemoryKeys:  memoryKeys,
+		DiskKeys:    mu.dc.Len(),
+	}
+	s.HitRatio = hitRatio(s.Hits(), s.Misses)
+	return s
+}
+
+// RecordLoad records a GetOrLoad call that went to the loader
+func (mu *MultiCache) RecordLoad(key Key, latency time.Duration, err error) {
+	mu.stats.loads.Add(1)
+	if err != nil {
+		mu.stats.loadErrors.Add(1)
+	}
+	mu.stats.loadLatency.observe(latency)
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// statsFixture runs a fixed workload on a one key cache
+func statsFixture(t *testing.T, mu *MultiCache) {
+	t.Helper()
+	a, b := Key{value: "a"}, Key{value: "b"}
+	mu.SetKey(a, Value{value: 1})
+	mu.SetKey(b, Value{value: 2}) // evicts a
+	mu.LookupKey(b)               // memory hit
+	mu.LookupKey(a)               // disk hit, evicts b
+	mu.LookupKey(Key{value: "c"}) // miss
+	mu.RecordLoad(a, 200*time.Microsecond, nil)
+	mu.RecordLoad(a, 10*time.Second, errors.New("timeout"))
+}
+
+func TestStats(t *testing.T) {
+	mu := newTestMultiCache(t, 1)
+	statsFixture(t, mu)
+
+	s := mu.Stats()
+	got := [...]int64{s.MemoryHits, s.DiskHits, s.Misses, s.Evictions, s.Loads, s.LoadErrors, int64(s.MemoryKeys), int64(s.DiskKeys)}
+	if want := [...]int64{1, 1, 1, 2, 2, 1, 1, 1}; got != want {
+		t.Errorf("hits, misses, evictions, loads, errors, keys: %v, want %v", got, want)
+	}
+	if s.HitRatio < 0.66 || s.HitRatio > 0.67 {
+		t.Errorf("hit ratio %v, want 2/3", s.HitRatio)
+	}
+
+	h := s.LoadLatency
+	if len(h.Counts) != len(h.Buckets)+1 || h.Count != 2 || h.Sum != 10*time.Second+200*time.Microsecond {
+		t.Fatalf("histogram %+v", h)
+	}
+	for i, c := range h.Counts {
+		want := int64(0)
+		if i == 1 || i == len(h.Buckets) {
+			want = 1 // 200µs is <= 500µs, 10s is above the last bound
+		}
+		if c != want {
+			t.Errorf("bucket %d counts %d, want %d", i, c, want)
+		}
+	}
+}
+
+func TestHistogramBounds(t *testing.T) {
+	var h histogram
+	for _, bound := range loadBuckets {
+		h.observe(bound)
+	}
+	h.observe(loadBuckets[len(loadBuckets)-1] + 1)
+
+	for i, c := range h.snapshot().Counts {
+		if c != 1 {
+			t.Errorf("bucket %d counts %d, want 1", i, c)
+		}
+	}
+}
+
+func TestShardedStatsSum(t *testing.T) {
+	sc := newTestSharded(t)
+	for i := 0; i < 20; i++ {
+		sc.SetKey(Key{value: i}, Value{value: i})
+		sc.LookupKey(Key{value: i})
+		sc.LookupKey(Key{value: -i - 1})
+		sc.RecordLoad(Key{value: i}, time.Millisecond, nil)
+	}
+	s := sc.Stats()
+	if s.MemoryHits != 20 || s.Misses != 20 || s.Loads != 20 || s.LoadLatency.Count != 20 {
+		t.Errorf("summed stats %+v", s)
+	}
+	if s.HitRatio != 0.5 {
+		t.Errorf("hit ratio %v, want 0.5", s.HitRatio)
+	}
+}
+
+func TestMetricsHandler(t *testing.T) {
+	mu := newTestMultiCache(t, 1)
+	statsFixture(t, mu)
+
+	w := httptest.NewRecorder()
+	MetricsHandler(mu).ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("content type %q", ct)
+	}
+	body, _ := io.ReadAll(w.Body)
+	lines := map[string]bool{}
+	for _, line := range strings.Split(string(body), "\n") {
+		lines[line] = true
+	}
+
+	for _, want := range []string{
+		"# TYPE multicache_hits_total counter",
+		`multicache_hits_total{tier="memory"} 1`,
+		`multicache_hits_total{tier="disk"} 1`,
+		"multicache_misses_total 1",
+		"multicache_evictions_total 2",
+		"multicache_load_errors_total 1",
+		`multicache_keys{tier="disk"} 1`,
+		"# TYPE multicache_load_duration_seconds histogram",
+		// buckets are cumulative
+		`multicache_load_duration_seconds_bucket{le="0.0001"} 0`,
+		`multicache_load_duration_seconds_bucket{le="0.0005"} 1`,
+		`multicache_load_duration_seconds_bucket{le="5"} 1`,
+		`multicache_load_duration_seconds_bucket{le="+Inf"} 2`,
+		"multicache_load_duration_seconds_sum 10.0002",
+		"multicache_load_duration_seconds_count 2",
+	} {
+		if !lines[want] {
+			t.Errorf("missing %q in\n%s", want, body)
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import "time"
+
+/*
+
+TimingWheel - hierarchical
+- wheelLevels levels of wheelSlots slots each
+- level 0 slot = 1 tick, level 1 slot = 64 ticks, level 2 slot = 64*64 ticks ...
+- a key sits in the lowest level whose span covers its remaining ticks
+- when a higher level slot comes around its keys cascade down to lower levels
+- keys further out than the top level sit in the top level and get re-placed
+  every time their slot comes around
+
+The wheel does not lock, MultiCache advances it under mu.mut.
+
+*/
+
+const (
+	wheelLevels   = 4
+	wheelSlotBits = 6
+	wheelSlots    = 1 << wheelSlotBits
+	wheelSlotMask = wheelSlots - 1
+)
+
+type wheelRef struct {
+	level int
+	slot  int
+}
+
+type TimingWheel struct {
+	tick    time.Duration
+	start   time.Time
+	current int64
+	slots   [wheelLevels][wheelSlots]map[Key]int64
+	refs    map[Key]wheelRef
+}
+
+func NewTimingWheel(tick time.Duration, start time.Time) *TimingWheel {
+	tw := &TimingWheel{
+		tick:  tick,
+		start: start,
+		refs:  make(map[Key]wheelRef),
+	}
+	for level := range tw.slots {
+		for slot := range tw.slots[level] {
+			tw.slots[level][slot] = make(map[Key]int64)
+		}
+	}
+	return tw
+}
+
+// Add schedules key to expire at expiry, replacing any earlier schedule
+func (tw *TimingWheel) Add(key Key, expiry time.Time) {
+	tw.Remove(key)
+
+	// round up so a key never fires before its expiry
+	at := int64((expiry.Sub(tw.start) + tw.tick - 1) / tw.tick)
+	tw.place(key, at)
+}
+
+func (tw *TimingWheel) Remove(key Key) {
+	if ref, exists := tw.refs[key]; exists {
+		delete(tw.slots[ref.level][ref.slot], key)
+		delete(tw.refs, key)
+	}
+}
+
+func (tw *TimingWheel) Len() int {
+	return len(tw.refs)
+}
+
+// Advance moves the wheel up to now and returns the keys that came due
+func (tw *TimingWheel) Advance(now time.Time) []Key {
+	target := int64(now.Sub(tw.start) / tw.tick)
+	var due []Key
+
+	for tw.current < target {
+		tw.current++
+
+		// cascade the higher levels whose slot just came around
+		for level := 1; level < wheelLevels; level++ {
+			if tw.current&(1<<(wheelSlotBits*level)-1) != 0 {
+				break
+			}
+			slot := int(tw.current>>(wheelSlotBits*level)) & wheelSlotMask
+			entries := tw.slots[level][slot]
+			tw.slots[level][slot] = make(map[Key]int64)
+			for key, at := range entries {
+				delete(tw.refs, key)
+				// due on this very tick, place would push it to the next one
+				if at <= tw.current {
+					due = append(due, key)
+					continue
+				}
+				tw.place(key, at)
+			}
+		}
+
+		slot := int(tw.current) & wheelSlotMask
+		for key := range tw.slots[0][slot] {
+			due = append(due, key)
+			delete(tw.refs, key)
+		}
+		if len(tw.slots[0][slot]) > 0 {
+			tw.slots[0][slot] = make(map[Key]int64)
+		}
+	}
+	return due
+}
+
+func (tw *TimingWheel) place(key Key, at int64) {
+	// anything already due fires on the next tick
+	if at <= tw.current {
+		at = tw.current + 1
+	}
+
+	delta := at - tw.current
+	level := 0
+	for level < wheelLevels-1 && delta >= 1<<(wheelSlotBits*(level+1)) {
+		level++
+	}
+
+	pos := at
+	if max := int64(1) << (wheelSlotBits * wheelLevels); delta >= max {
+		// out of range, park it in the last top level slot and re-place it later
+		pos = tw.current + max - 1
+	}
+	slot := int(pos>>(wheelSlotBits*level)) & wheelSlotMask
+
+	tw.slots[level][slot][key] = at
+	tw.refs[key] = wheelRef{level: level, slot: slot}
+}
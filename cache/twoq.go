@@ -0,0 +1,104 @@
+package main
+
+import "container/list"
+
+/*
+
+TwoQ - full 2Q
+- a1in  : FIFO of resident keys seen once, about a quarter of the capacity
+- a1out : FIFO of ghost keys pushed out of a1in, about half of the capacity
+- am    : LRU of resident keys seen again after leaving a1in
+
+A one-off scan only churns a1in, the keys in am survive it.
+
+*/
+
+type TwoQ struct {
+	capacity int
+	kin      int
+	kout     int
+	a1in     *list.List
+	a1out    *list.List
+	am       *list.List
+	where    map[Key]*list.Element
+	lists    map[Key]*list.List
+}
+
+func NewTwoQ(capacity int) *TwoQ {
+	q := &TwoQ{capacity: capacity}
+	q.Initalize()
+	return q
+}
+
+func (q *TwoQ) Initalize() {
+	q.kin = max(q.capacity/4, 1)
+	q.kout = max(q.capacity/2, 1)
+	q.a1in = list.New()
+	q.a1out = list.New()
+	q.am = list.New()
+	q.where = make(map[Key]*list.Element)
+	q.lists = make(map[Key]*list.List)
+}
+
+func (q *TwoQ) setValue(key Key) {
+	switch q.lists[key] {
+	case q.am:
+		q.am.MoveToFront(q.where[key])
+	case q.a1in:
+		// correlated references inside a1in do not count
+	case q.a1out:
+		q.move(key, q.am)
+	default:
+		q.move(key, q.a1in)
+	}
+}
+
+func (q *TwoQ) check() Key {
+	from := q.evictFrom()
+	if from == nil {
+		return Key{}
+	}
+	key := from.Back().Value.(Key)
+	if from == q.a1in {
+		q.move(key, q.a1out)
+		for q.a1out.Len() > q.kout {
+			q.removeKey(q.a1out.Back().Value.(Key))
+		}
+	} else {
+		q.removeKey(key)
+	}
+	return key
+}
+
+// victim returns the key check would evict, without evicting it
+func (q *TwoQ) victim() Key {
+	from := q.evictFrom()
+	if from == nil {
+		return Key{}
+	}
+	return from.Back().Value.(Key)
+}
+
+func (q *TwoQ) removeKey(key Key) {
+	if l, exists := q.lists[key]; exists {
+		l.Remove(q.where[key])
+		delete(q.where, key)
+		delete(q.lists, key)
+	}
+}
+
+func (q *TwoQ) evictFrom() *list.List {
+	if q.a1in.Len() > 0 && (q.a1in.Len() > q.kin || q.am.Len() == 0) {
+		return q.a1in
+	}
+	if q.am.Len() > 0 {
+		return q.am
+	}
+	return nil
+}
+
+func (q *TwoQ) move(key Key, l *list.List) {
+	q.removeKey(key)
+	q.where[key] = l.PushFront(key)
+	q.lists[key] = l
+}
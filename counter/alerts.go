@@ -0,0 +1,327 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+/*
+Threshold alerts - callbacks when a condition on an ad becomes true
+
+- an AlertRule has a Condition, e.g. ImpressionsWithoutClick(100, 2) for
+  "100 impressions without a click in the last 2 days", and an OnFire callback
+  that can pause the campaign
+- the AlertEngine is a subscriber of the manager, after every event it checks
+  the rules that apply to the event's ad
+- a rule fires when its condition goes from false to true, not on every event
+  while it stays true. Once the condition is false again, e.g. the
+  impressions left the window, the rule is re-armed for the ad.
+- conditions are evaluated through ExecuteQuery, so they see the manager
+  clock and watermark policy like every other query. They see the storage as
+  it is when the engine gets to the event, events added meanwhile included.
+- conditions that turn true by time passing alone can be checked with
+  EvaluateAd, e.g. from a ticker
+- OnFire runs on a callback goroutine of its own, in firing order. The engine
+  queues alerts without a bound and never waits for a callback, so OnFire may
+  add events even under BLOCK, and add or remove rules. A Condition runs on
+  the engine goroutine under its lock and must not add events.
+- a rule whose condition fails is skipped for that evaluation, the error goes
+  to the handler set with SetErrorHandler
+*/
+
+// AlertCondition is checked for an ad after each of its events
+type AlertCondition interface {
+	Holds(aem *AdEventManager, adID int64) (bool, error)
+}
+
+// ConditionFunc adapts a function to AlertCondition
+type ConditionFunc func(aem *AdEventManager, adID int64) (bool, error)
+
+// Holds calls f
+func (f ConditionFunc) Holds(aem *AdEventManager, adID int64) (bool, error) {
+	return f(aem, adID)
+}
+
+// QueryCondition holds when a query strategy returning a bool returns true
+type QueryCondition struct {
+	Query  QueryStrategy
+	Params interface{}
+}
+
+// Holds executes the query for adID
+func (c QueryCondition) Holds(aem *AdEventManager, adID int64) (bool, error) {
+	result, err := aem.ExecuteQuery(adID, c.Query, c.Params)
+	if err != nil {
+		return false, err
+	}
+	holds, ok := result.(bool)
+	if !ok {
+		return false, fmt.Errorf("query returned %T, not bool", result)
+	}
+	return holds, nil
+}
+
+// ImpressionsWithoutClick holds when an ad has x impressions without a click in the last withinDays days
+func ImpressionsWithoutClick(x int, withinDays int) AlertCondition {
+	return QueryCondition{
+		Query:  &ImpressionsWithoutClickQuery{},
+		Params: ImpressionsWithoutClickQueryParams{X: x, WithinDays: withinDays},
+	}
+}
+
+// Alert is passed to OnFire when a rule fires
+type Alert struct {
+	Rule  string
+	AdID  int64
+	Event *Event // the event after which the condition held, nil from EvaluateAd
+	Time  time.Time
+}
+
+// AlertRule fires OnFire when Condition becomes true for one of AdIDs, or
+// for any ad if AdIDs is empty
+type AlertRule struct {
+	Name      string
+	AdIDs     []int64
+	Condition AlertCondition
+	OnFire    func(Alert)
+}
+
+func (r *AlertRule) appliesTo(adID int64) bool {
+	if len(r.AdIDs) == 0 {
+		return true
+	}
+	for _, id := range r.AdIDs {
+		if id == adID {
+			return true
+		}
+	}
+	return false
+}
+
+// alertKey is one rule on one ad
+type alertKey struct {
+	rule string
+	adID int64
+}
+
+// firedAlert is an alert waiting for the OnFire of its rule
+type firedAlert struct {
+	alert  Alert
+	onFire func(Alert)
+}
+
+// alertQueue hands fired alerts to the callback goroutine, push never blocks
+type alertQueue struct {
+	alerts []firedAlert
+	closed bool
+	cond   *sync.Cond
+	mu     sync.Mutex
+}
+
+func newAlertQueue() *alertQueue {
+	q := &alertQueue{}
+	q.cond = sync.NewCond(&q.mu)
+	return q
+}
+
+// push queues fired, alerts pushed after close are dropped
+func (q *alertQueue) push(fired ...firedAlert) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return
+	}
+	q.alerts = append(q.alerts, fired...)
+	q.cond.Signal()
+}
+
+// take waits for queued alerts, ok is false once the queue is closed and empty
+func (q *alertQueue) take() (fired []firedAlert, ok bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for len(q.alerts) == 0 && !q.closed {
+		q.cond.Wait()
+	}
+	fired, q.alerts = q.alerts, nil
+	return fired, len(fired) > 0
+}
+
+func (q *alertQueue) close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.closed = true
+	q.cond.Broadcast()
+}
+
+// AlertEngine evaluates alert rules on the events of a manager
+type AlertEngine struct {
+	manager   *AdEventManager
+	sub       *Subscription
+	rules     []*AlertRule
+	firing    map[alertKey]bool
+	onError   func(rule string, adID int64, err error)
+	mu        sync.Mutex
+	pending   *alertQueue
+	done      chan struct{}
+	delivered chan struct{}
+	stop      sync.Once
+}
+
+// NewAlertEngine subscribes to manager with the given buffer and policy and
+// starts evaluating rules. Under DROP_NEWEST or DROP_OLDEST a lost event is
+// only seen by the rules with the next event of the same ad.
+func NewAlertEngine(manager *AdEventManager, buffer int, policy BackpressurePolicy) *AlertEngine {
+	e := &AlertEngine{
+		manager:   manager,
+		sub:       manager.Subscribe(buffer, policy),
+		firing:    make(map[alertKey]bool),
+		onError:   printRuleError,
+		pending:   newAlertQueue(),
+		done:      make(chan struct{}),
+		delivered: make(chan struct{}),
+	}
+	go e.run()
+	go e.deliver()
+	return e
+}
+
+func printRuleError(rule string, adID int64, err error) {
+	fmt.Printf("Warning: alert rule %q error for ad %d: %v\n", rule, adID, err)
+}
+
+// SetErrorHandler sets what gets the errors of failing conditions, by default
+// and with a nil handler they are printed. handler runs on the goroutine
+// evaluating the rule.
+func (e *AlertEngine) SetErrorHandler(handler func(rule string, adID int64, err error)) {
+	if handler == nil {
+		handler = printRuleError
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.onError = handler
+}
+
+// AddRule adds a rule, names must be unique
+func (e *AlertEngine) AddRule(rule AlertRule) error {
+	if rule.Name == "" || rule.Condition == nil || rule.OnFire == nil {
+		return errors.New("rule needs a name, a condition and a callback")
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	for _, existing := range e.rules {
+		if existing.Name == rule.Name {
+			return fmt.Errorf("rule %q already exists", rule.Name)
+		}
+	}
+	e.rules = append(e.rules, &rule)
+	return nil
+}
+
+// RemoveRule removes the rule with the given name
+func (e *AlertEngine) RemoveRule(name string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	for i, rule := range e.rules {
+		if rule.Name == name {
+			e.rules = append(e.rules[:i], e.rules[i+1:]...)
+			break
+		}
+	}
+	for key := range e.firing {
+		if key.rule == name {
+			delete(e.firing, key)
+		}
+	}
+}
+
+// Stop unsubscribes the engine and waits for the event being evaluated and
+// the callbacks of the alerts already fired, it must not be called from OnFire
+func (e *AlertEngine) Stop() {
+	e.stop.Do(func() {
+		e.manager.Unsubscribe(e.sub)
+		<-e.done
+		e.pending.close()
+		<-e.delivered
+	})
+}
+
+func (e *AlertEngine) run() {
+	defer close(e.done)
+	for event := range e.sub.C {
+		e.evaluate(event.AdID, event)
+	}
+}
+
+// deliver runs the callbacks of fired alerts until Stop
+func (e *AlertEngine) deliver() {
+	defer close(e.delivered)
+	for {
+		fired, ok := e.pending.take()
+		if !ok {
+			return
+		}
+		for _, f := range fired {
+			f.onFire(f.alert)
+		}
+	}
+}
+
+// EvaluateAd checks the rules of adID now, without an event
+func (e *AlertEngine) EvaluateAd(adID int64) {
+	e.evaluate(adID, nil)
+}
+
+func (e *AlertEngine) evaluate(adID int64, event *Event) {
+	type ruleError struct {
+		rule string
+		err  error
+	}
+
+	e.mu.Lock()
+	var fired []firedAlert
+	var failed []ruleError
+	for _, rule := range e.rules {
+		if !rule.appliesTo(adID) {
+			continue
+		}
+		holds, err := rule.Condition.Holds(e.manager, adID)
+		if err != nil {
+			// report it and keep evaluating the other rules
+			failed = append(failed, ruleError{rule: rule.Name, err: err})
+			continue
+		}
+
+		key := alertKey{rule: rule.Name, adID: adID}
+		if holds && !e.firing[key] {
+			fired = append(fired, firedAlert{
+				alert: Alert{
+					Rule:  rule.Name,
+					AdID:  adID,
+					Event: event,
+					Time:  e.manager.config.TimeSource.Now(),
+				},
+				onFire: rule.OnFire,
+			})
+		}
+		if holds {
+			e.firing[key] = true
+		} else {
+			delete(e.firing, key)
+		}
+	}
+	onError := e.onError
+	e.mu.Unlock()
+
+	// the error handler runs outside the lock, it may add or remove rules
+	for _, f := range failed {
+		onError(f.rule, adID, f.err)
+	}
+	if len(fired) > 0 {
+		e.pending.push(fired...)
+	}
+}
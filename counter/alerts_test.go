@@ -0,0 +1,185 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// flushAd has a rule that fires on its next event, the callback of that rule
+// shows the engine got through the events and callbacks before
+const flushAd = 99
+
+func newTestEngine(t *testing.T, manager *AdEventManager) (*AlertEngine, func()) {
+	t.Helper()
+
+	engine := NewAlertEngine(manager, 16, BLOCK)
+	t.Cleanup(engine.Stop)
+
+	flushes := 0
+	flush := func() {
+		t.Helper()
+		flushes++
+		name := fmt.Sprintf("flush %d", flushes)
+		flushed := make(chan struct{})
+		engine.AddRule(AlertRule{
+			Name:  name,
+			AdIDs: []int64{flushAd},
+			Condition: ConditionFunc(func(*AdEventManager, int64) (bool, error) {
+				return true, nil
+			}),
+			OnFire: func(Alert) { close(flushed) },
+		})
+		defer engine.RemoveRule(name)
+
+		go manager.AddEvent(flushAd, IMPRESSION)
+		select {
+		case <-flushed:
+		case <-time.After(5 * time.Second):
+			t.Fatal("engine did not get to the flush event")
+		}
+	}
+	return engine, flush
+}
+
+func TestAlertFiresOnceWhenConditionBecomesTrue(t *testing.T) {
+	manager, clock := newClockedManager(WatermarkPolicy{})
+	engine, flush := newTestEngine(t, manager)
+
+	var alerts []Alert
+	err := engine.AddRule(AlertRule{
+		Name:      "pause",
+		AdIDs:     []int64{1},
+		Condition: ImpressionsWithoutClick(3, 1),
+		OnFire:    func(a Alert) { alerts = append(alerts, a) },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := engine.AddRule(AlertRule{Name: "pause", Condition: ImpressionsWithoutClick(1, 1), OnFire: func(Alert) {}}); err == nil {
+		t.Error("duplicate rule name accepted")
+	}
+
+	step := func(eventType EventType) {
+		clock.SetTime(clock.Now().Add(time.Minute))
+		manager.AddEvent(1, eventType)
+	}
+	for i := 0; i < 2; i++ {
+		step(IMPRESSION)
+	}
+	flush()
+	if len(alerts) != 0 {
+		t.Fatalf("fired after 2 impressions: %+v", alerts)
+	}
+
+	// fires on the third impression, stays quiet while the condition holds
+	for i := 0; i < 3; i++ {
+		step(IMPRESSION)
+	}
+	manager.AddEvent(2, IMPRESSION)
+	flush()
+	if len(alerts) != 1 || alerts[0].AdID != 1 || alerts[0].Event == nil || alerts[0].Event.Type != IMPRESSION {
+		t.Fatalf("alerts %+v, want one for ad 1", alerts)
+	}
+	if alerts[0].Rule != "pause" || !alerts[0].Time.Equal(clock.Now()) {
+		t.Errorf("alert %+v", alerts[0])
+	}
+}
+
+func TestAlertEvaluateAdAndRemoveRule(t *testing.T) {
+	manager, clock := newClockedManager(WatermarkPolicy{})
+	engine, flush := newTestEngine(t, manager)
+
+	fired := 0
+	engine.AddRule(AlertRule{
+		Name:      "quiet",
+		AdIDs:     []int64{1, 3},
+		Condition: ImpressionsWithoutClick(1, 1),
+		OnFire:    func(Alert) { fired++ },
+	})
+	manager.AddEvent(1, IMPRESSION)
+	flush()
+	if fired != 1 {
+		t.Fatalf("fired %d times, want 1", fired)
+	}
+
+	// the impression ages out of the window, the rule re-arms without an event
+	clock.SetTime(baseTime.Add(25 * time.Hour))
+	engine.EvaluateAd(1)
+	clock.SetTime(baseTime.Add(26 * time.Hour))
+	manager.AddEvent(1, IMPRESSION)
+	flush()
+	if fired != 2 {
+		t.Errorf("fired %d times, want 2 after re-arming", fired)
+	}
+
+	engine.RemoveRule("quiet")
+	manager.AddEvent(3, IMPRESSION)
+	flush()
+	if fired != 2 {
+		t.Errorf("removed rule fired, %d times", fired)
+	}
+}
+
+func TestAlertCallbackAddsEventsUnderBlock(t *testing.T) {
+	manager, _ := newClockedManager(WatermarkPolicy{})
+	engine := NewAlertEngine(manager, 1, BLOCK)
+	defer engine.Stop()
+
+	// the callback adds far more events than the subscription buffer holds
+	done := make(chan struct{})
+	engine.AddRule(AlertRule{
+		Name:      "echo",
+		AdIDs:     []int64{1},
+		Condition: ImpressionsWithoutClick(1, 1),
+		OnFire: func(Alert) {
+			for i := 0; i < 100; i++ {
+				manager.AddEvent(2, IMPRESSION)
+			}
+			close(done)
+		},
+	})
+	manager.AddEvent(1, IMPRESSION)
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("callback adding events deadlocked the engine")
+	}
+}
+
+func TestAlertRuleErrorsGoToHandler(t *testing.T) {
+	manager, _ := newClockedManager(WatermarkPolicy{})
+	engine, flush := newTestEngine(t, manager)
+
+	type report struct {
+		rule string
+		adID int64
+		err  error
+	}
+	errBroken := errors.New("broken")
+	reports := make(chan report, 1)
+	engine.SetErrorHandler(func(rule string, adID int64, err error) {
+		reports <- report{rule, adID, err}
+	})
+	engine.AddRule(AlertRule{
+		Name:  "broken",
+		AdIDs: []int64{1},
+		Condition: ConditionFunc(func(*AdEventManager, int64) (bool, error) {
+			return false, errBroken
+		}),
+		OnFire: func(Alert) {},
+	})
+	manager.AddEvent(1, IMPRESSION)
+	flush()
+
+	select {
+	case r := <-reports:
+		if r.rule != "broken" || r.adID != 1 || r.err != errBroken {
+			t.Errorf("reported %+v", r)
+		}
+	default:
+		t.Error("rule error not reported")
+	}
+}
@@ -0,0 +1,465 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+HTTP/JSON API in front of AdEventManager
+
+POST /ads/{id}/events
+  body: {"type": "CLICK"} or [{"type": "IMPRESSION", "timestamp": "..."}, ...]
+  timestamp is the optional RFC3339 event time, it defaults to now
+  payload is required for types registered with a schema, {"type":
+  "CONVERSION", "payload": {"value": 9.99}}, and rejected with 400 if invalid
+  the whole batch is validated before any event is added, an event behind
+  the watermark under DROP_LATE fails the batch with 422
+  event_id is the optional client event ID. With deduplication enabled an
+  event whose ID was already ingested is skipped, so a retried batch is safe.
+  201 {"accepted": n, "duplicates": m}, 409 with the same body if every
+  event of the request was a duplicate
+
+GET /ads/{id}/events?from=&to=&limit=&cursor=
+  from / to are RFC3339, limit defaults to 100 (max 1000)
+  200 {"events": [...], "next_cursor": "..."}, next_cursor is only set if
+  there are more events. The cursor is the (timestamp, id) of the last event
+  returned, so events added meanwhile do not shift the pages. A page is read
+  from the cursor on, storages implementing PagedStorage stop reading once
+  the page is full.
+
+GET /ads/{id}/queries/impressions-without-click?x=&days=
+  200 {"ad_id": 1, "x": 3, "days": 2, "result": true}
+
+Event types go in and out by their name in the manager's ManagerConfig.Registry,
+the same registry that validates their payloads.
+Errors are {"error": "..."} with 400 for bad input, 404 for an unknown ad,
+413 for a body over maxBodyBytes, 409 for a duplicate event, 422 for a late
+event and 500 for everything else.
+*/
+
+const (
+	defaultPageSize = 100
+	maxPageSize     = 1000
+	maxBodyBytes    = 1 << 20
+)
+
+// APIServer serves the HTTP API of an AdEventManager
+type APIServer struct {
+	manager *AdEventManager
+	mux     *http.ServeMux
+}
+
+// NewAPIServer creates the API for manager, event type names are resolved
+// with the manager's registry
+func NewAPIServer(manager *AdEventManager) *APIServer {
+	s := &APIServer{
+		manager: manager,
+		mux:     http.NewServeMux(),
+	}
+	s.mux.HandleFunc("POST /ads/{id}/events", s.handleAddEvents)
+	s.mux.HandleFunc("GET /ads/{id}/events", s.handleGetEvents)
+	s.mux.HandleFunc("GET /ads/{id}/queries/impressions-without-click", s.handleImpressionsWithoutClick)
+	return s
+}
+
+func (s *APIServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+// apiError is an error with the status code it should be answered with
+type apiError struct {
+	status  int
+	message string
+}
+
+func (e *apiError) Error() string {
+	return e.message
+}
+
+func badRequest(format string, args ...interface{}) error {
+	return &apiError{status: http.StatusBadRequest, message: fmt.Sprintf(format, args...)}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	var apiErr *apiError
+	var maxBytesErr *http.MaxBytesError
+	switch {
+	case errors.As(err, &apiErr):
+		status = apiErr.status
+	case errors.As(err, &maxBytesErr):
+		status = http.StatusRequestEntityTooLarge
+	case errors.Is(err, ErrDuplicateEvent):
+		status = http.StatusConflict
+	case errors.Is(err, ErrLateEvent):
+		status = http.StatusUnprocessableEntity
+	}
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+// adID parses the {id} path value and checks the ad exists
+func (s *APIServer) adID(r *http.Request, mustExist bool) (int64, error) {
+	adID, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil || adID <= 0 {
+		return 0, badRequest("ad id must be a positive integer")
+	}
+	if mustExist && !s.manager.AdExists(adID) {
+		return 0, &apiError{status: http.StatusNotFound, message: fmt.Sprintf("adID %d not found", adID)}
+	}
+	return adID, nil
+}
+
+// eventRequest is one event in a POST body
+type eventRequest struct {
+	Type      string                 `json:"type"`
+	Timestamp *time.Time             `json:"timestamp"`
+	Payload   map[string]interface{} `json:"payload"`
+	EventID   string                 `json:"event_id"`
+}
+
+// eventResponse is the JSON form of an Event
+type eventResponse struct {
+	ID         int64                  `json:"id"`
+	AdID       int64                  `json:"ad_id"`
+	Type       string                 `json:"type"`
+	Timestamp  time.Time              `json:"timestamp"`
+	IngestTime time.Time              `json:"ingest_time"`
+	Payload    map[string]interface{} `json:"payload,omitempty"`
+	EventID    string                 `json:"event_id,omitempty"`
+}
+
+func (s *APIServer) toResponse(event *Event) eventResponse {
+	return eventResponse{
+		ID:         event.ID,
+		AdID:       event.AdID,
+		Type:       s.manager.config.Registry.nameOf(event.Type),
+		Timestamp:  event.Timestamp,
+		IngestTime: event.IngestTime,
+		Payload:    event.Payload,
+		EventID:    event.ClientEventID,
+	}
+}
+
+// decodeEvents accepts a single event object or an array of them
+func decodeEvents(body io.Reader) ([]eventRequest, error) {
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return nil, err
+	}
+	data = bytes.TrimSpace(data)
+
+	var events []eventRequest
+	if len(data) > 0 && data[0] == '[' {
+		err = json.Unmarshal(data, &events)
+	} else {
+		var event eventRequest
+		err = json.Unmarshal(data, &event)
+		events = []eventRequest{event}
+	}
+	if err != nil {
+		return nil, badRequest("invalid JSON body: %v", err)
+	}
+	if len(events) == 0 {
+		return nil, badRequest("no events in body")
+	}
+	return events, nil
+}
+
+func (s *APIServer) handleAddEvents(w http.ResponseWriter, r *http.Request) {
+	adID, err := s.adID(r, !s.manager.config.AutoRegister)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	requests, err := decodeEvents(http.MaxBytesReader(w, r.Body, maxBodyBytes))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	now := s.manager.config.TimeSource.Now()
+	watermark := s.manager.config.Watermark
+	registry := s.manager.config.Registry
+	types := make([]EventType, len(requests))
+	times := make([]time.Time, len(requests))
+	for i, req := range requests {
+		eventType, found := registry.Get(req.Type)
+		if !found {
+			writeError(w, badRequest("event %d: unknown event type %q", i, req.Type))
+			return
+		}
+		if _, err := registry.Validate(eventType, req.Payload); err != nil {
+			writeError(w, badRequest("event %d: %v", i, err))
+			return
+		}
+		types[i] = eventType
+		times[i] = now
+		if req.Timestamp != nil {
+			times[i] = *req.Timestamp
+		}
+		if watermark.Late == DROP_LATE && watermark.IsLate(&Event{Timestamp: times[i], IngestTime: now}) {
+			writeError(w, &apiError{
+				status:  http.StatusUnprocessableEntity,
+				message: fmt.Sprintf("event %d: %v", i, ErrLateEvent),
+			})
+			return
+		}
+	}
+
+	accepted, duplicates := 0, 0
+	for i, eventType := range types {
+		// the ingest time is the now the event time defaulted to and the
+		// lateness was checked against
+		err := s.manager.addEvent(adID, requests[i].EventID, eventType, times[i], now, requests[i].Payload)
+		switch {
+		case err == nil:
+			accepted++
+		case errors.Is(err, ErrDuplicateEvent):
+			duplicates++
+		default:
+			status := http.StatusInternalServerError
+			if errors.Is(err, ErrLateEvent) {
+				status = http.StatusUnprocessableEntity
+			}
+			writeJSON(w, status, map[string]interface{}{
+				"error":      err.Error(),
+				"accepted":   accepted,
+				"duplicates": duplicates,
+			})
+			return
+		}
+	}
+	status := http.StatusCreated
+	if accepted == 0 {
+		status = http.StatusConflict
+	}
+	writeJSON(w, status, map[string]int{"accepted": accepted, "duplicates": duplicates})
+}
+
+// pageCursor is the position after the last event of a page
+type pageCursor struct {
+	timestamp time.Time
+	id        int64
+}
+
+func (c pageCursor) encode() string {
+	raw := fmt.Sprintf("%d:%d", c.timestamp.UnixNano(), c.id)
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+func decodeCursor(s string) (pageCursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return pageCursor{}, badRequest("invalid cursor")
+	}
+	nanos, id, found := strings.Cut(string(raw), ":")
+	if !found {
+		return pageCursor{}, badRequest("invalid cursor")
+	}
+	n, err1 := strconv.ParseInt(nanos, 10, 64)
+	i, err2 := strconv.ParseInt(id, 10, 64)
+	if err1 != nil || err2 != nil {
+		return pageCursor{}, badRequest("invalid cursor")
+	}
+	return pageCursor{timestamp: time.Unix(0, n), id: i}, nil
+}
+
+// eventBefore orders events by timestamp, then by ID
+func eventBefore(a *Event, b *Event) bool {
+	if !a.Timestamp.Equal(b.Timestamp) {
+		return a.Timestamp.Before(b.Timestamp)
+	}
+	return a.ID < b.ID
+}
+
+// firstInOrder sorts events by timestamp and ID and keeps the first limit
+func firstInOrder(events []*Event, limit int) []*Event {
+	sort.SliceStable(events, func(i, j int) bool {
+		return eventBefore(events[i], events[j])
+	})
+	if len(events) > limit {
+		events = events[:limit]
+	}
+	return events
+}
+
+// PagedStorage is an EventStorage that reads a page without the rest of the range
+type PagedStorage interface {
+	EventStorage
+	// GetEventsPage returns the first limit events of [from, to] that come
+	// after `after` in timestamp, ID order. A nil after starts at from.
+	GetEventsPage(adID int64, from, to time.Time, after *Event, limit int) ([]*Event, error)
+}
+
+// GetEventsPage returns the first limit events of adID in [from, to] after
+// `after`, ordered by timestamp and ID
+func (aem *AdEventManager) GetEventsPage(adID int64, from, to time.Time, after *Event, limit int) ([]*Event, error) {
+	if adID <= 0 {
+		return nil, errors.New("adID must be positive")
+	}
+	if from.After(to) {
+		return nil, errors.New("from time must be before to time")
+	}
+	if storage, ok := aem.config.Storage.(PagedStorage); ok {
+		return storage.GetEventsPage(adID, from, to, after, limit)
+	}
+
+	events, err := aem.config.Storage.GetEventsInRange(adID, from, to)
+	if err != nil {
+		return nil, err
+	}
+	if after != nil {
+		kept := events[:0:0]
+		for _, event := range events {
+			if eventBefore(after, event) {
+				kept = append(kept, event)
+			}
+		}
+		events = kept
+	}
+	return firstInOrder(events, limit), nil
+}
+
+func parseTimeParam(r *http.Request, name string, fallback time.Time) (time.Time, error) {
+	value := r.URL.Query().Get(name)
+	if value == "" {
+		return fallback, nil
+	}
+	t, err := time.Parse(time.RFC3339Nano, value)
+	if err != nil {
+		return time.Time{}, badRequest("%s must be an RFC3339 time", name)
+	}
+	return t, nil
+}
+
+func parsePositiveParam(r *http.Request, name string, fallback int) (int, error) {
+	value := r.URL.Query().Get(name)
+	if value == "" {
+		if fallback > 0 {
+			return fallback, nil
+		}
+		return 0, badRequest("%s is required", name)
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n <= 0 {
+		return 0, badRequest("%s must be a positive integer", name)
+	}
+	return n, nil
+}
+
+func (s *APIServer) handleGetEvents(w http.ResponseWriter, r *http.Request) {
+	adID, err := s.adID(r, true)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	from, err := parseTimeParam(r, "from", time.Unix(0, 0))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	to, err := parseTimeParam(r, "to", s.manager.config.TimeSource.Now())
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if from.After(to) {
+		writeError(w, badRequest("from must not be after to"))
+		return
+	}
+	limit, err := parsePositiveParam(r, "limit", defaultPageSize)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	limit = min(limit, maxPageSize)
+
+	var after *Event
+	if value := r.URL.Query().Get("cursor"); value != "" {
+		c, err := decodeCursor(value)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		if c.timestamp.After(to) {
+			writeError(w, badRequest("cursor is after to"))
+			return
+		}
+		after = &Event{ID: c.id, Timestamp: c.timestamp}
+		if c.timestamp.After(from) {
+			from = c.timestamp
+		}
+	}
+
+	// one event more than the page tells whether there is a next one
+	events, err := s.manager.GetEventsPage(adID, from, to, after, limit+1)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	page := events
+	if len(page) > limit {
+		page = page[:limit]
+	}
+	response := struct {
+		Events     []eventResponse `json:"events"`
+		NextCursor string          `json:"next_cursor,omitempty"`
+	}{Events: make([]eventResponse, len(page))}
+	for i, event := range page {
+		response.Events[i] = s.toResponse(event)
+	}
+	if len(events) > limit {
+		last := page[len(page)-1]
+		response.NextCursor = pageCursor{timestamp: last.Timestamp, id: last.ID}.encode()
+	}
+	writeJSON(w, http.StatusOK, response)
+}
+
+func (s *APIServer) handleImpressionsWithoutClick(w http.ResponseWriter, r *http.Request) {
+	adID, err := s.adID(r, true)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	x, err := parsePositiveParam(r, "x", 0)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	days, err := parsePositiveParam(r, "days", 0)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	result, err := s.manager.HasXImpressionsWithoutClick(adID, x, days)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"ad_id":  adID,
+		"x":      x,
+		"days":   days,
+		"result": result,
+	})
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestAPI(t *testing.T) (*httptest.Server, *MockTimeSource) {
+	t.Helper()
+
+	clock := NewMockTimeSource(baseTime)
+	config := DefaultConfig()
+	config.TimeSource = clock
+	config.Registry.Register("VIEW", EventType(7))
+
+	server := httptest.NewServer(NewAPIServer(NewAdEventManagerWithConfig(config)))
+	t.Cleanup(server.Close)
+	return server, clock
+}
+
+func call(t *testing.T, method string, url string, body string, into interface{}) int {
+	t.Helper()
+
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if into != nil {
+		if err := json.NewDecoder(resp.Body).Decode(into); err != nil {
+			t.Fatalf("%s %s: %v", method, url, err)
+		}
+	}
+	return resp.StatusCode
+}
+
+func TestAPIAddAndPage(t *testing.T) {
+	server, clock := newTestAPI(t)
+
+	if status := call(t, "POST", server.URL+"/ads/5/events", `{"type":"IMPRESSION"}`, nil); status != http.StatusCreated {
+		t.Fatalf("single event: status %d", status)
+	}
+	for i := 1; i <= 4; i++ {
+		clock.SetTime(baseTime.Add(time.Duration(i) * time.Minute))
+		var got map[string]int
+		status := call(t, "POST", server.URL+"/ads/5/events", `[{"type":"CLICK"},{"type":"VIEW"}]`, &got)
+		if status != http.StatusCreated || got["accepted"] != 2 {
+			t.Fatalf("batch: status %d, %v", status, got)
+		}
+	}
+
+	var ids []int64
+	cursor := ""
+	pages := 0
+	for {
+		query := url.Values{"limit": {"3"}, "to": {baseTime.Add(time.Hour).Format(time.RFC3339)}}
+		if cursor != "" {
+			query.Set("cursor", cursor)
+		}
+		var page struct {
+			Events []struct {
+				ID   int64  `json:"id"`
+				Type string `json:"type"`
+			} `json:"events"`
+			NextCursor string `json:"next_cursor"`
+		}
+		if status := call(t, "GET", server.URL+"/ads/5/events?"+query.Encode(), "", &page); status != http.StatusOK {
+			t.Fatalf("page %d: status %d", pages, status)
+		}
+		for _, e := range page.Events {
+			ids = append(ids, e.ID)
+		}
+		if pages == 0 && (page.Events[0].Type != "IMPRESSION" || page.Events[2].Type != "VIEW") {
+			t.Errorf("first page types %+v", page.Events)
+		}
+		pages++
+		if cursor = page.NextCursor; cursor == "" {
+			break
+		}
+	}
+	if pages != 3 || len(ids) != 9 {
+		t.Fatalf("%d pages with %d events, want 3 pages with 9", pages, len(ids))
+	}
+	for i := 1; i < len(ids); i++ {
+		if ids[i] <= ids[i-1] {
+			t.Errorf("events out of order: %v", ids)
+		}
+	}
+
+	var result map[string]interface{}
+	status := call(t, "GET", server.URL+"/ads/5/queries/impressions-without-click?x=1&days=1", "", &result)
+	if status != http.StatusOK || result["result"] != true || result["x"] != 1.0 {
+		t.Errorf("query: status %d, %v", status, result)
+	}
+}
+
+func TestAPIErrors(t *testing.T) {
+	server, _ := newTestAPI(t)
+	call(t, "POST", server.URL+"/ads/1/events", `{"type":"CLICK"}`, nil)
+
+	tests := []struct {
+		method, path, body string
+		want               int
+	}{
+		{"POST", "/ads/abc/events", `{"type":"CLICK"}`, http.StatusBadRequest},
+		{"POST", "/ads/-3/events", `{"type":"CLICK"}`, http.StatusBadRequest},
+		{"POST", "/ads/1/events", `{"type":"PURCHASE"}`, http.StatusBadRequest},
+		{"POST", "/ads/1/events", `[{"type":"CLICK"},{"type":"nope"}]`, http.StatusBadRequest},
+		{"POST", "/ads/1/events", `[]`, http.StatusBadRequest},
+		{"POST", "/ads/1/events", `{"type":"CLICK","payload":{"value":1}}`, http.StatusBadRequest},
+		{"POST", "/ads/1/events", `{"type":`, http.StatusBadRequest},
+		{"POST", "/ads/1/events", `{"type":"` + strings.Repeat("x", maxBodyBytes) + `"}`, http.StatusRequestEntityTooLarge},
+		{"GET", "/ads/2/events", "", http.StatusNotFound},
+		{"GET", "/ads/1/events?from=yesterday", "", http.StatusBadRequest},
+		{"GET", "/ads/1/events?from=2024-02-01T00:00:00Z&to=2024-01-01T00:00:00Z", "", http.StatusBadRequest},
+		{"GET", "/ads/1/events?limit=0", "", http.StatusBadRequest},
+		{"GET", "/ads/1/events?cursor=!!", "", http.StatusBadRequest},
+		{"GET", "/ads/1/events?to=2024-01-01T00:00:00Z&cursor=" + pageCursor{timestamp: baseTime, id: 1}.encode(), "", http.StatusBadRequest},
+		{"GET", "/ads/1/queries/impressions-without-click?x=2", "", http.StatusBadRequest},
+		{"GET", "/ads/2/queries/impressions-without-click?x=2&days=1", "", http.StatusNotFound},
+		{"DELETE", "/ads/1/events", "", http.StatusMethodNotAllowed},
+	}
+	for _, tt := range tests {
+		var body map[string]interface{}
+		var into interface{} = &body
+		if tt.want == http.StatusMethodNotAllowed {
+			into = nil
+		}
+		if status := call(t, tt.method, server.URL+tt.path, tt.body, into); status != tt.want {
+			t.Errorf("%s %s: status %d, want %d", tt.method, tt.path, status, tt.want)
+		} else if into != nil && body["error"] == nil {
+			t.Errorf("%s %s: no error message", tt.method, tt.path)
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+/*
+Idempotent ingestion
+
+- a client may send a ClientEventID with an event, SDK retries resend it
+- per ad the manager remembers the IDs it ingested in the last Window, and at
+  most MaxIDsPerAd of them, whichever is smaller. An ID that falls out of the
+  window is forgotten and a later copy is stored again.
+- the ID is reserved before the event is stored, so parallel copies race on
+  the reservation and exactly one of them is stored. If storing fails the
+  reservation is released so the retry can go through.
+*/
+
+// ErrDuplicateEvent is returned for an event whose ClientEventID was already ingested
+var ErrDuplicateEvent = errors.New("duplicate event")
+
+const defaultMaxIDsPerAd = 100000
+
+// DedupConfig configures deduplication on ClientEventID. The zero value
+// disables it, events are then stored however often they are sent.
+type DedupConfig struct {
+	Window      time.Duration
+	MaxIDsPerAd int // 0 means defaultMaxIDsPerAd
+}
+
+func (c DedupConfig) enabled() bool {
+	return c.Window > 0
+}
+
+// dedupIndex remembers the recent client event IDs of every ad
+type dedupIndex struct {
+	config DedupConfig
+	ads    map[int64]*adDedup
+	mu     sync.Mutex
+}
+
+// adDedup holds the IDs of one ad in the order they were ingested
+type adDedup struct {
+	seen  map[string]time.Time
+	order []seenID
+	head  int
+}
+
+type seenID struct {
+	id string
+	at time.Time
+}
+
+func newDedupIndex(config DedupConfig) *dedupIndex {
+	if config.MaxIDsPerAd <= 0 {
+		config.MaxIDsPerAd = defaultMaxIDsPerAd
+	}
+	return &dedupIndex{
+		config: config,
+		ads:    make(map[int64]*adDedup),
+	}
+}
+
+// reserve records clientID for adID at now, it fails with ErrDuplicateEvent
+// if the ID is still remembered
+func (d *dedupIndex) reserve(adID int64, clientID string, now time.Time) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	ad, exists := d.ads[adID]
+	if !exists {
+		ad = &adDedup{seen: make(map[string]time.Time)}
+		d.ads[adID] = ad
+	}
+	cutoff := now.Add(-d.config.Window)
+	ad.expire(cutoff, d.config.MaxIDsPerAd)
+
+	if _, seen := ad.seen[clientID]; seen {
+		return fmt.Errorf("%w: client event id %q for adID %d", ErrDuplicateEvent, clientID, adID)
+	}
+	ad.seen[clientID] = now
+	ad.order = append(ad.order, seenID{id: clientID, at: now})
+	ad.expire(cutoff, d.config.MaxIDsPerAd)
+	return nil
+}
+
+// release forgets a reservation whose event could not be stored
+func (d *dedupIndex) release(adID int64, clientID string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	// the order entry stays behind, expire skips entries no longer in seen
+	if ad, exists := d.ads[adID]; exists {
+		delete(ad.seen, clientID)
+	}
+}
+
+// expire drops the IDs seen before cutoff and the oldest ones over max
+func (ad *adDedup) expire(cutoff time.Time, max int) {
+	for ad.head < len(ad.order) {
+		oldest := ad.order[ad.head]
+		at, current := ad.seen[oldest.id]
+		stale := !current || !at.Equal(oldest.at)
+		if !stale && !oldest.at.Before(cutoff) && len(ad.seen) <= max {
+			break
+		}
+		if !stale {
+			delete(ad.seen, oldest.id)
+		}
+		ad.head++
+	}
+
+	// reclaim the consumed part of the queue once it is half of it
+	if ad.head > 0 && ad.head*2 >= len(ad.order) {
+		ad.order = append(ad.order[:0], ad.order[ad.head:]...)
+		ad.head = 0
+	}
+}
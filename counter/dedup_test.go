@@ -0,0 +1,174 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newDedupManager(dedup DedupConfig) (*AdEventManager, *MockTimeSource) {
+	clock := NewMockTimeSource(baseTime)
+	config := DefaultConfig()
+	config.TimeSource = clock
+	config.Dedup = dedup
+	return NewAdEventManagerWithConfig(config), clock
+}
+
+func addWithID(manager *AdEventManager, adID int64, clientEventID string) error {
+	return manager.AddEventWithClientID(adID, clientEventID, IMPRESSION, manager.config.TimeSource.Now(), nil)
+}
+
+func TestDuplicateWithinWindow(t *testing.T) {
+	manager, clock := newDedupManager(DedupConfig{Window: time.Hour})
+
+	if err := addWithID(manager, 1, "a"); err != nil {
+		t.Fatal(err)
+	}
+	clock.SetTime(baseTime.Add(59 * time.Minute))
+	if err := addWithID(manager, 1, "a"); !errors.Is(err, ErrDuplicateEvent) {
+		t.Errorf("retry inside the window returned %v, want ErrDuplicateEvent", err)
+	}
+	// IDs are per ad and an empty ID is never a duplicate
+	for _, err := range []error{addWithID(manager, 2, "a"), addWithID(manager, 1, ""), addWithID(manager, 1, "")} {
+		if err != nil {
+			t.Errorf("got %v, want the event stored", err)
+		}
+	}
+
+	clock.SetTime(baseTime.Add(time.Hour + time.Second))
+	if err := addWithID(manager, 1, "a"); err != nil {
+		t.Errorf("ID out of the window rejected: %v", err)
+	}
+
+	events, _ := manager.GetAllEvents(1)
+	if len(events) != 4 {
+		t.Fatalf("%d events stored for ad 1, want 4", len(events))
+	}
+	if events[0].ClientEventID != "a" {
+		t.Errorf("ClientEventID stored as %q", events[0].ClientEventID)
+	}
+}
+
+func TestDedupDisabled(t *testing.T) {
+	manager, _ := newDedupManager(DedupConfig{})
+	addWithID(manager, 1, "a")
+	if err := addWithID(manager, 1, "a"); err != nil {
+		t.Fatal(err)
+	}
+	if events, _ := manager.GetAllEvents(1); len(events) != 2 {
+		t.Errorf("%d events stored, want 2 without deduplication", len(events))
+	}
+}
+
+func TestDedupBoundedPerAd(t *testing.T) {
+	manager, _ := newDedupManager(DedupConfig{Window: time.Hour, MaxIDsPerAd: 3})
+	for i := 0; i < 5; i++ {
+		addWithID(manager, 1, fmt.Sprint(i))
+	}
+	// 2 - 4 are still remembered, 0 was pushed out by the bound
+	for _, id := range []int{2, 3, 4} {
+		if err := addWithID(manager, 1, fmt.Sprint(id)); !errors.Is(err, ErrDuplicateEvent) {
+			t.Errorf("ID %d: got %v, want ErrDuplicateEvent", id, err)
+		}
+	}
+	if err := addWithID(manager, 1, "0"); err != nil {
+		t.Errorf("ID 0 past the bound rejected: %v", err)
+	}
+	if ids := len(manager.dedup.ads[1].seen); ids > 3 {
+		t.Errorf("%d IDs remembered, bound is 3", ids)
+	}
+}
+
+func TestFailedEventCanBeRetried(t *testing.T) {
+	manager, _ := newDedupManager(DedupConfig{Window: time.Hour})
+	manager.config.AutoRegister = false
+
+	if err := addWithID(manager, 1, "a"); err == nil || errors.Is(err, ErrDuplicateEvent) {
+		t.Fatalf("unregistered ad returned %v", err)
+	}
+	manager.RegisterAd(1)
+	if err := addWithID(manager, 1, "a"); err != nil {
+		t.Errorf("retry after a failed store returned %v", err)
+	}
+}
+
+func TestParallelDuplicatesStoreOnce(t *testing.T) {
+	for name, newStorage := range storageFactories() {
+		t.Run(name, func(t *testing.T) {
+			manager, _ := newDedupManager(DedupConfig{Window: time.Hour})
+			manager.config.Storage = newStorage(t)
+
+			const ids, copies = 8, 16
+			var wg sync.WaitGroup
+			var mu sync.Mutex
+			stored, duplicates := 0, 0
+			for i := 0; i < ids*copies; i++ {
+				wg.Add(1)
+				go func(id int) {
+					defer wg.Done()
+					err := addWithID(manager, 1, fmt.Sprint("event-", id))
+					mu.Lock()
+					defer mu.Unlock()
+					switch {
+					case err == nil:
+						stored++
+					case errors.Is(err, ErrDuplicateEvent):
+						duplicates++
+					default:
+						t.Error(err)
+					}
+				}(i % ids)
+			}
+			wg.Wait()
+
+			if stored != ids || duplicates != ids*(copies-1) {
+				t.Errorf("%d stored and %d duplicates, want %d and %d", stored, duplicates, ids, ids*(copies-1))
+			}
+			events, _ := manager.GetAllEvents(1)
+			seen := make(map[string]bool)
+			for _, event := range events {
+				if seen[event.ClientEventID] {
+					t.Errorf("%s stored twice", event.ClientEventID)
+				}
+				seen[event.ClientEventID] = true
+			}
+			if len(events) != ids {
+				t.Errorf("%d events in storage, want %d", len(events), ids)
+			}
+		})
+	}
+}
+
+func TestAPIRetriedBatch(t *testing.T) {
+	manager, _ := newDedupManager(DedupConfig{Window: time.Hour})
+	server := httptest.NewServer(NewAPIServer(manager))
+	defer server.Close()
+
+	var got map[string]int
+	status := call(t, "POST", server.URL+"/ads/1/events", `[{"type":"IMPRESSION","event_id":"a"},{"type":"CLICK","event_id":"b"}]`, &got)
+	if status != http.StatusCreated || got["accepted"] != 2 {
+		t.Fatalf("first batch: status %d, %v", status, got)
+	}
+	status = call(t, "POST", server.URL+"/ads/1/events", `[{"type":"IMPRESSION","event_id":"a"},{"type":"CLICK","event_id":"c"}]`, &got)
+	if status != http.StatusCreated || got["accepted"] != 1 || got["duplicates"] != 1 {
+		t.Errorf("partly retried batch: status %d, %v", status, got)
+	}
+	status = call(t, "POST", server.URL+"/ads/1/events", `{"type":"CLICK","event_id":"b"}`, &got)
+	if status != http.StatusConflict || got["duplicates"] != 1 {
+		t.Errorf("retried event: status %d, %v", status, got)
+	}
+
+	var page struct {
+		Events []struct {
+			EventID string `json:"event_id"`
+		} `json:"events"`
+	}
+	call(t, "GET", server.URL+"/ads/1/events?to="+baseTime.Add(time.Hour).Format(time.RFC3339), "", &page)
+	if len(page.Events) != 3 || page.Events[0].EventID == "" {
+		t.Errorf("stored events %+v, want 3 with their IDs", page.Events)
+	}
+}
@@ -0,0 +1,525 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+FileStorage - EventStorage that survives a restart
+
+- one append only log per ad: <dir>/ad-<id>.log
+- record: [length uint32][crc32 uint32][json Event]
+- a torn record at the end of a log (crash during a write) is truncated on open
+
+Sparse index, one entry per indexInterval records of a log
+- offset of the first record of the block
+- maxPrefix[i] = max timestamp of blocks 0..i    (never decreases)
+- minSuffix[i] = min timestamp of blocks i..end  (never decreases)
+GetEventsInRange binary searches the first block that can reach `from` and the
+first block that starts after `to`, and only reads the blocks in between.
+Events mostly arrive in time order, so the blocks read are the ones needed.
+
+Compaction (DeleteBefore) writes the kept records to ad-<id>.log.compact and
+renames it over the log, a crash leaves either the old or the new log.
+*/
+
+// indexInterval is the number of records per sparse index entry
+const indexInterval = 64
+
+const recordHeaderSize = 8
+
+var errCorruptRecord = errors.New("corrupt event record")
+
+var (
+	minNanoTime = time.Unix(0, math.MinInt64)
+	maxNanoTime = time.Unix(0, math.MaxInt64)
+)
+
+// unixNano is t.UnixNano clamped to int64, for times outside 1678-2262
+func unixNano(t time.Time) int64 {
+	if t.Before(minNanoTime) {
+		return math.MinInt64
+	}
+	if t.After(maxNanoTime) {
+		return math.MaxInt64
+	}
+	return t.UnixNano()
+}
+
+// FileStorage is a file backed implementation of EventStorage
+type FileStorage struct {
+	dir string
+	ads map[int64]*adLog
+	mu  sync.RWMutex
+}
+
+// adLog is the log file and sparse index of one ad
+type adLog struct {
+	file      *os.File
+	size      int64
+	count     int
+	offsets   []int64 // first record of each block
+	maxPrefix []int64
+	minSuffix []int64
+	mu        sync.RWMutex
+}
+
+// NewFileStorage opens the logs in dir, creating dir if needed
+func NewFileStorage(dir string) (*FileStorage, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &FileStorage{
+		dir: dir,
+		ads: make(map[int64]*adLog),
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasPrefix(name, "ad-") || !strings.HasSuffix(name, ".log") {
+			continue
+		}
+		adID, err := strconv.ParseInt(strings.TrimSuffix(strings.TrimPrefix(name, "ad-"), ".log"), 10, 64)
+		if err != nil || adID <= 0 {
+			continue
+		}
+		log, err := openAdLog(filepath.Join(dir, name))
+		if err != nil {
+			s.Close()
+			return nil, fmt.Errorf("adID %d: %w", adID, err)
+		}
+		s.ads[adID] = log
+	}
+	return s, nil
+}
+
+func (s *FileStorage) logPath(adID int64) string {
+	return filepath.Join(s.dir, fmt.Sprintf("ad-%d.log", adID))
+}
+
+func (s *FileStorage) RegisterAd(adID int64) error {
+	if adID <= 0 {
+		return errors.New("adID must be positive")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, exists := s.ads[adID]; exists {
+		return fmt.Errorf("adID %d already registered", adID)
+	}
+
+	log, err := openAdLog(s.logPath(adID))
+	if err != nil {
+		return err
+	}
+	s.ads[adID] = log
+	return nil
+}
+
+func (s *FileStorage) Exists(adID int64) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	_, exists := s.ads[adID]
+	return exists
+}
+
+func (s *FileStorage) log(adID int64) (*adLog, error) {
+	s.mu.RLock()
+	log, exists := s.ads[adID]
+	s.mu.RUnlock()
+
+	if !exists {
+		return nil, fmt.Errorf("adID %d not found", adID)
+	}
+	return log, nil
+}
+
+func (s *FileStorage) AddEvent(adID int64, event *Event) error {
+	log, err := s.log(adID)
+	if err != nil {
+		return err
+	}
+	return log.append(event)
+}
+
+func (s *FileStorage) GetEvents(adID int64) ([]*Event, error) {
+	log, err := s.log(adID)
+	if err != nil {
+		return nil, err
+	}
+	return log.read(0, -1, nil)
+}
+
+func (s *FileStorage) GetEventsInRange(adID int64, from, to time.Time) ([]*Event, error) {
+	log, err := s.log(adID)
+	if err != nil {
+		return nil, err
+	}
+	return log.readRange(from, to)
+}
+
+func (s *FileStorage) GetEventsPage(adID int64, from, to time.Time, after *Event, limit int) ([]*Event, error) {
+	log, err := s.log(adID)
+	if err != nil {
+		return nil, err
+	}
+	return log.readPage(from, to, after, limit)
+}
+
+// AdIDs returns the registered ad IDs
+func (s *FileStorage) AdIDs() []int64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	ids := make([]int64, 0, len(s.ads))
+	for adID := range s.ads {
+		ids = append(ids, adID)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+// DeleteBefore rewrites the log of adID without the events older than cutoff
+// and returns the removed events
+func (s *FileStorage) DeleteBefore(adID int64, cutoff time.Time) ([]*Event, error) {
+	log, err := s.log(adID)
+	if err != nil {
+		return nil, err
+	}
+	return log.dropBefore(cutoff)
+}
+
+// Close closes every log
+func (s *FileStorage) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var firstErr error
+	for _, log := range s.ads {
+		if err := log.file.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// openAdLog opens path, rebuilds the index and truncates a torn tail
+func openAdLog(path string) (*adLog, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	log := &adLog{file: file}
+	offset := int64(0)
+	for {
+		event, size, err := readRecord(file, offset, info.Size())
+		if err != nil {
+			break
+		}
+		log.index(offset, unixNano(event.Timestamp))
+		offset += size
+	}
+
+	if info.Size() > offset {
+		if err := file.Truncate(offset); err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
+	log.size = offset
+	return log, nil
+}
+
+// readRecord decodes the record at offset and returns it with its size. A
+// length running past end is a torn or corrupt header, not an allocation.
+func readRecord(r io.ReaderAt, offset int64, end int64) (*Event, int64, error) {
+	header := make([]byte, recordHeaderSize)
+	if _, err := r.ReadAt(header, offset); err != nil {
+		return nil, 0, err
+	}
+	length := binary.LittleEndian.Uint32(header[0:4])
+	sum := binary.LittleEndian.Uint32(header[4:8])
+	if int64(length) > end-offset-recordHeaderSize {
+		return nil, 0, errCorruptRecord
+	}
+
+	payload := make([]byte, length)
+	if _, err := r.ReadAt(payload, offset+recordHeaderSize); err != nil {
+		return nil, 0, err
+	}
+	if crc32.ChecksumIEEE(payload) != sum {
+		return nil, 0, errCorruptRecord
+	}
+
+	event := &Event{}
+	if err := json.Unmarshal(payload, event); err != nil {
+		return nil, 0, errCorruptRecord
+	}
+	return event, recordHeaderSize + int64(length), nil
+}
+
+func encodeRecord(event *Event) ([]byte, error) {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return nil, err
+	}
+	record := make([]byte, recordHeaderSize, recordHeaderSize+len(payload))
+	binary.LittleEndian.PutUint32(record[0:4], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(record[4:8], crc32.ChecksumIEEE(payload))
+	return append(record, payload...), nil
+}
+
+func (log *adLog) append(event *Event) error {
+	record, err := encodeRecord(event)
+	if err != nil {
+		return err
+	}
+
+	log.mu.Lock()
+	defer log.mu.Unlock()
+
+	if _, err := log.file.WriteAt(record, log.size); err != nil {
+		// drop whatever part of the record made it, the log stays readable
+		log.file.Truncate(log.size)
+		return err
+	}
+	log.index(log.size, unixNano(event.Timestamp))
+	log.size += int64(len(record))
+	return nil
+}
+
+// index adds the record at offset to the sparse index, log.mu must be held
+func (log *adLog) index(offset int64, ts int64) {
+	if log.count%indexInterval == 0 {
+		log.offsets = append(log.offsets, offset)
+		prevMax := ts
+		if n := len(log.maxPrefix); n > 0 {
+			prevMax = max(prevMax, log.maxPrefix[n-1])
+		}
+		log.maxPrefix = append(log.maxPrefix, prevMax)
+		log.minSuffix = append(log.minSuffix, ts)
+	}
+
+	last := len(log.offsets) - 1
+	log.maxPrefix[last] = max(log.maxPrefix[last], ts)
+	for i := last; i >= 0 && log.minSuffix[i] > ts; i-- {
+		log.minSuffix[i] = ts
+	}
+	log.count++
+}
+
+func (log *adLog) readRange(from, to time.Time) ([]*Event, error) {
+	// the bounds are block indexes, a dropBefore in between would rewrite
+	// the blocks under them, so they are found and read in one lock hold
+	log.mu.RLock()
+	defer log.mu.RUnlock()
+
+	fromNano, toNano := unixNano(from), unixNano(to)
+	first := sort.Search(len(log.offsets), func(i int) bool {
+		return log.maxPrefix[i] >= fromNano
+	})
+	end := sort.Search(len(log.offsets), func(i int) bool {
+		return log.minSuffix[i] > toNano
+	})
+	return log.readBlocks(first, end, func(event *Event) bool {
+		return !event.Timestamp.Before(from) && !event.Timestamp.After(to)
+	})
+}
+
+// readPage reads the blocks of [from, to] one at a time and stops once no
+// later block can hold an event that sorts before the end of the page
+func (log *adLog) readPage(from, to time.Time, after *Event, limit int) ([]*Event, error) {
+	log.mu.RLock()
+	defer log.mu.RUnlock()
+
+	fromNano, toNano := unixNano(from), unixNano(to)
+	first := sort.Search(len(log.offsets), func(i int) bool {
+		return log.maxPrefix[i] >= fromNano
+	})
+	end := sort.Search(len(log.offsets), func(i int) bool {
+		return log.minSuffix[i] > toNano
+	})
+	keep := func(event *Event) bool {
+		return !event.Timestamp.Before(from) && !event.Timestamp.After(to) &&
+			(after == nil || eventBefore(after, event))
+	}
+
+	page := []*Event{}
+	for block := first; block < end; block++ {
+		if len(page) > 0 && len(page) >= limit {
+			page = firstInOrder(page, limit)
+			if log.minSuffix[block] > unixNano(page[len(page)-1].Timestamp) {
+				break
+			}
+		}
+		stop := log.size
+		if block+1 < len(log.offsets) {
+			stop = log.offsets[block+1]
+		}
+		events, err := log.decode(log.offsets[block], stop, keep)
+		if err != nil {
+			return nil, err
+		}
+		page = append(page, events...)
+	}
+	return firstInOrder(page, limit), nil
+}
+
+// read returns the events of blocks [first, end) that keep accepts, sorted by
+// timestamp. end -1 means up to the end of the log, a nil keep keeps all.
+func (log *adLog) read(first int, end int, keep func(*Event) bool) ([]*Event, error) {
+	log.mu.RLock()
+	defer log.mu.RUnlock()
+
+	return log.readBlocks(first, end, keep)
+}
+
+// readBlocks is read with log.mu held
+func (log *adLog) readBlocks(first int, end int, keep func(*Event) bool) ([]*Event, error) {
+	if end < 0 {
+		end = len(log.offsets)
+	}
+	if first >= end {
+		return []*Event{}, nil
+	}
+	start := log.offsets[first]
+	stop := log.size
+	if end < len(log.offsets) {
+		stop = log.offsets[end]
+	}
+
+	events, err := log.decode(start, stop, keep)
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].Timestamp.Before(events[j].Timestamp)
+	})
+	return events, nil
+}
+
+// decode returns the events of the records in [start, stop) that keep
+// accepts, in log order. log.mu must be held.
+func (log *adLog) decode(start int64, stop int64, keep func(*Event) bool) ([]*Event, error) {
+	data := make([]byte, stop-start)
+	if _, err := log.file.ReadAt(data, start); err != nil {
+		return nil, err
+	}
+
+	reader := bytes.NewReader(data)
+	events := make([]*Event, 0)
+	for offset := int64(0); offset < int64(len(data)); {
+		event, size, err := readRecord(reader, offset, int64(len(data)))
+		if err != nil {
+			return nil, err
+		}
+		offset += size
+		if keep == nil || keep(event) {
+			events = append(events, event)
+		}
+	}
+	return events, nil
+}
+
+// dropBefore rewrites the log without the events older than cutoff
+func (log *adLog) dropBefore(cutoff time.Time) ([]*Event, error) {
+	log.mu.Lock()
+	defer log.mu.Unlock()
+
+	// minSuffix[0] is the oldest event of the log
+	if len(log.offsets) == 0 || log.minSuffix[0] >= unixNano(cutoff) {
+		return []*Event{}, nil
+	}
+
+	events, err := log.decode(0, log.size, nil)
+	if err != nil {
+		return nil, err
+	}
+	kept := make([]*Event, 0, len(events))
+	dropped := make([]*Event, 0)
+	for _, event := range events {
+		if event.Timestamp.Before(cutoff) {
+			dropped = append(dropped, event)
+		} else {
+			kept = append(kept, event)
+		}
+	}
+
+	path := log.file.Name()
+	if err := writeLog(path+".compact", kept); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(path+".compact", path); err != nil {
+		return nil, err
+	}
+	compacted, err := openAdLog(path)
+	if err != nil {
+		return nil, err
+	}
+
+	log.file.Close()
+	log.file = compacted.file
+	log.size = compacted.size
+	log.count = compacted.count
+	log.offsets = compacted.offsets
+	log.maxPrefix = compacted.maxPrefix
+	log.minSuffix = compacted.minSuffix
+
+	sort.SliceStable(dropped, func(i, j int) bool {
+		return dropped[i].Timestamp.Before(dropped[j].Timestamp)
+	})
+	return dropped, nil
+}
+
+// writeLog writes events as a new log at path and syncs it
+func writeLog(path string, events []*Event) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	for _, event := range events {
+		record, err := encodeRecord(event)
+		if err != nil {
+			file.Close()
+			return err
+		}
+		buf.Write(record)
+	}
+	if _, err := file.Write(buf.Bytes()); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
@@ -2,7 +2,10 @@ package main
 
 import (
 	"errors"
+	"flag"
 	"fmt"
+	"net/http"
+	"os"
 	"sort"
 	"sync"
 	"sync/atomic"
@@ -61,11 +64,15 @@ type TimeSource interface {
 
 // ManagerConfig holds configuration for AdEventManager
 type ManagerConfig struct {
-	IDGenerator    IDGenerator
-	Storage        EventStorage
-	TimeSource     TimeSource
-	EventHandlers  []EventHandler
-	AutoRegister   bool // Auto-register ad IDs on first event
+	IDGenerator   IDGenerator
+	Storage       EventStorage
+	TimeSource    TimeSource
+	EventHandlers []EventHandler
+	AutoRegister  bool               // Auto-register ad IDs on first event
+	Watermark     WatermarkPolicy    // How late events are treated, see watermark.go
+	Registry      *EventTypeRegistry // Payload schemas of custom event types, see payload.go
+	Dedup         DedupConfig        // Deduplication on ClientEventID, see dedup.go
+	Retention     RetentionPolicy    // How long raw events are kept, see retention.go
 }
 
 // DefaultConfig returns a default configuration
@@ -76,6 +83,7 @@ func DefaultConfig() *ManagerConfig {
 		TimeSource:    NewSystemTimeSource(),
 		EventHandlers: []EventHandler{},
 		AutoRegister:  true,
+		Registry:      NewEventTypeRegistry(),
 	}
 }
 
@@ -103,14 +111,16 @@ func (e EventType) String() string {
 
 // EventTypeRegistry allows registering custom event types
 type EventTypeRegistry struct {
-	types map[string]EventType
-	mu    sync.RWMutex
+	types   map[string]EventType
+	schemas map[EventType]*PayloadSchema
+	mu      sync.RWMutex
 }
 
 // NewEventTypeRegistry creates a new event type registry
 func NewEventTypeRegistry() *EventTypeRegistry {
 	reg := &EventTypeRegistry{
-		types: make(map[string]EventType),
+		types:   make(map[string]EventType),
+		schemas: make(map[EventType]*PayloadSchema),
 	}
 	// Register default types
 	reg.Register("IMPRESSION", IMPRESSION)
@@ -125,6 +135,40 @@ func (r *EventTypeRegistry) Register(name string, eventType EventType) {
 	r.types[name] = eventType
 }
 
+// RegisterWithSchema registers a new event type whose events carry a payload
+func (r *EventTypeRegistry) RegisterWithSchema(name string, eventType EventType, schema *PayloadSchema) {
+	r.Register(name, eventType)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.schemas[eventType] = schema
+}
+
+// Schema returns the payload schema of eventType
+func (r *EventTypeRegistry) Schema(eventType EventType) (*PayloadSchema, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	schema, exists := r.schemas[eventType]
+	return schema, exists
+}
+
+// Validate checks payload against the schema of eventType and returns it
+// normalized. A type without a schema takes no payload.
+func (r *EventTypeRegistry) Validate(eventType EventType, payload map[string]interface{}) (map[string]interface{}, error) {
+	var schema *PayloadSchema
+	exists := false
+	if r != nil {
+		schema, exists = r.Schema(eventType)
+	}
+	if !exists {
+		if len(payload) > 0 {
+			return nil, payloadError("event type %s takes no payload", r.nameOf(eventType))
+		}
+		return nil, nil
+	}
+	return schema.Validate(payload)
+}
+
 // Get retrieves an event type by name
 func (r *EventTypeRegistry) Get(name string) (EventType, bool) {
 	r.mu.RLock()
@@ -133,23 +177,57 @@ func (r *EventTypeRegistry) Get(name string) (EventType, bool) {
 	return eventType, exists
 }
 
+// Name returns the name eventType was registered under, the first one in
+// sort order if it has several
+func (r *EventTypeRegistry) Name(eventType EventType) (string, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	found := ""
+	for name, t := range r.types {
+		if t == eventType && (found == "" || name < found) {
+			found = name
+		}
+	}
+	return found, found != ""
+}
+
+// nameOf is the name of eventType in r, or its String for a type r does not know
+func (r *EventTypeRegistry) nameOf(eventType EventType) string {
+	if r != nil {
+		if name, found := r.Name(eventType); found {
+			return name
+		}
+	}
+	return eventType.String()
+}
+
 // ==================== Event ====================
 
 // Event represents a single ad event (impression or click)
 type Event struct {
-	ID        int64
-	AdID      int64
-	Type      EventType
-	Timestamp time.Time
+	ID         int64
+	AdID       int64
+	Type       EventType
+	Timestamp  time.Time              // event time, when it happened on the client
+	IngestTime time.Time              // when the manager received it
+	Payload    map[string]interface{} `json:",omitempty"` // typed by the schema of Type
+
+	ClientEventID string `json:",omitempty"` // optional, set by the client to make retries idempotent
 }
 
-// NewEvent creates a new Event with the given parameters
+// NewEvent creates a new Event with the given parameters, received at timestamp
 func NewEvent(adID int64, eventType EventType, timestamp time.Time, idGen IDGenerator) *Event {
+	return NewEventAt(adID, eventType, timestamp, timestamp, idGen)
+}
+
+// NewEventAt creates a new Event that happened at eventTime and was received at ingestTime
+func NewEventAt(adID int64, eventType EventType, eventTime time.Time, ingestTime time.Time, idGen IDGenerator) *Event {
 	return &Event{
-		ID:        idGen.GenerateID(),
-		AdID:      adID,
-		Type:      eventType,
-		Timestamp: timestamp,
+		ID:         idGen.GenerateID(),
+		AdID:       adID,
+		Type:       eventType,
+		Timestamp:  eventTime,
+		IngestTime: ingestTime,
 	}
 }
 
@@ -228,37 +306,104 @@ func (s *InMemoryStorage) GetEventsInRange(adID int64, from, to time.Time) ([]*E
 	return adEventList.getEventsInRange(from, to), nil
 }
 
-// AdEventList manages events for a single ad ID
+func (s *InMemoryStorage) GetEventsPage(adID int64, from, to time.Time, after *Event, limit int) ([]*Event, error) {
+	s.mu.RLock()
+	adEventList, exists := s.adEvents[adID]
+	s.mu.RUnlock()
+
+	if !exists {
+		return nil, fmt.Errorf("adID %d not found", adID)
+	}
+
+	return adEventList.getEventsPage(from, to, after, limit), nil
+}
+
+// AdIDs returns the registered ad IDs
+func (s *InMemoryStorage) AdIDs() []int64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	ids := make([]int64, 0, len(s.adEvents))
+	for adID := range s.adEvents {
+		ids = append(ids, adID)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+// DeleteBefore removes the events of adID older than cutoff and returns them
+func (s *InMemoryStorage) DeleteBefore(adID int64, cutoff time.Time) ([]*Event, error) {
+	s.mu.RLock()
+	adEventList, exists := s.adEvents[adID]
+	s.mu.RUnlock()
+
+	if !exists {
+		return nil, fmt.Errorf("adID %d not found", adID)
+	}
+
+	return adEventList.dropBefore(cutoff), nil
+}
+
+// AdEventList manages events for a single ad ID.
+// The events are kept in chunks of at most maxChunkSize, sorted by timestamp
+// within and across chunks, so an out of order insert only shifts one chunk.
 type AdEventList struct {
 	AdID      int64
-	events    []*Event // sorted by timestamp (ascending)
+	chunks    [][]*Event // sorted by timestamp (ascending), never empty
+	size      int
 	mu        sync.RWMutex
 	lastClick *Event // optimization: track last click for faster queries
 }
 
+// maxChunkSize is the number of events a chunk holds before it is split
+const maxChunkSize = 256
+
 // NewAdEventList creates a new AdEventList for the given ad ID
 func NewAdEventList(adID int64) *AdEventList {
 	return &AdEventList{
 		AdID:   adID,
-		events: make([]*Event, 0),
+		chunks: make([][]*Event, 0),
 	}
 }
 
-// insertEvent inserts an event in sorted order by timestamp
+// chunkReaching returns the first chunk whose last event is not before t
+func (ael *AdEventList) chunkReaching(t time.Time) int {
+	return sort.Search(len(ael.chunks), func(i int) bool {
+		chunk := ael.chunks[i]
+		return !chunk[len(chunk)-1].Timestamp.Before(t)
+	})
+}
+
+// insertEvent inserts an event in sorted order by timestamp, before the
+// events with an equal timestamp
 func (ael *AdEventList) insertEvent(event *Event) {
 	ael.mu.Lock()
 	defer ael.mu.Unlock()
 
-	// Find insertion point using binary search
-	insertPos := sort.Search(len(ael.events), func(i int) bool {
-		return ael.events[i].Timestamp.After(event.Timestamp) ||
-			ael.events[i].Timestamp.Equal(event.Timestamp)
-	})
-
-	// Insert at the found position
-	ael.events = append(ael.events, nil)
-	copy(ael.events[insertPos+1:], ael.events[insertPos:])
-	ael.events[insertPos] = event
+	c := ael.chunkReaching(event.Timestamp)
+	if c == len(ael.chunks) {
+		// the newest event, the common case: append to the last chunk
+		if c == 0 || len(ael.chunks[c-1]) >= maxChunkSize {
+			ael.chunks = append(ael.chunks, make([]*Event, 0, maxChunkSize))
+			c++
+		}
+		ael.chunks[c-1] = append(ael.chunks[c-1], event)
+	} else {
+		// Find insertion point using binary search
+		chunk := ael.chunks[c]
+		insertPos := sort.Search(len(chunk), func(i int) bool {
+			return !chunk[i].Timestamp.Before(event.Timestamp)
+		})
+		chunk = append(chunk, nil)
+		copy(chunk[insertPos+1:], chunk[insertPos:])
+		chunk[insertPos] = event
+		ael.chunks[c] = chunk
+
+		if len(chunk) > maxChunkSize {
+			ael.split(c)
+		}
+	}
+	ael.size++
 
 	// Update last click if this is a click
 	if event.Type == CLICK {
@@ -268,13 +413,29 @@ func (ael *AdEventList) insertEvent(event *Event) {
 	}
 }
 
+// split halves chunk c, ael.mu must be held
+func (ael *AdEventList) split(c int) {
+	chunk := ael.chunks[c]
+	half := len(chunk) / 2
+	upper := make([]*Event, len(chunk)-half, maxChunkSize)
+	copy(upper, chunk[half:])
+	clear(chunk[half:])
+
+	ael.chunks = append(ael.chunks, nil)
+	copy(ael.chunks[c+2:], ael.chunks[c+1:])
+	ael.chunks[c] = chunk[:half]
+	ael.chunks[c+1] = upper
+}
+
 // getEvents returns all events sorted by timestamp (ascending)
 func (ael *AdEventList) getEvents() []*Event {
 	ael.mu.RLock()
 	defer ael.mu.RUnlock()
 
-	result := make([]*Event, len(ael.events))
-	copy(result, ael.events)
+	result := make([]*Event, 0, ael.size)
+	for _, chunk := range ael.chunks {
+		result = append(result, chunk...)
+	}
 	return result
 }
 
@@ -283,23 +444,83 @@ func (ael *AdEventList) getEventsInRange(from, to time.Time) []*Event {
 	ael.mu.RLock()
 	defer ael.mu.RUnlock()
 
-	// Binary search for start position
-	startIdx := sort.Search(len(ael.events), func(i int) bool {
-		return !ael.events[i].Timestamp.Before(from)
-	})
+	result := []*Event{}
+	for c := ael.chunkReaching(from); c < len(ael.chunks); c++ {
+		chunk := ael.chunks[c]
+		if chunk[0].Timestamp.After(to) {
+			break
+		}
 
-	// Binary search for end position
-	endIdx := sort.Search(len(ael.events), func(i int) bool {
-		return ael.events[i].Timestamp.After(to)
-	})
+		// Binary search for start and end position
+		startIdx := sort.Search(len(chunk), func(i int) bool {
+			return !chunk[i].Timestamp.Before(from)
+		})
+		endIdx := sort.Search(len(chunk), func(i int) bool {
+			return chunk[i].Timestamp.After(to)
+		})
+		result = append(result, chunk[startIdx:endIdx]...)
+	}
+	return result
+}
+
+// getEventsPage returns the first limit events of [from, to] after `after`
+// in timestamp, ID order. It stops at the first timestamp past a full page,
+// the events sharing the last timestamp are all read to order them by ID.
+func (ael *AdEventList) getEventsPage(from, to time.Time, after *Event, limit int) []*Event {
+	ael.mu.RLock()
+	defer ael.mu.RUnlock()
+
+	page := []*Event{}
+	for c := ael.chunkReaching(from); c < len(ael.chunks); c++ {
+		chunk := ael.chunks[c]
+		start := sort.Search(len(chunk), func(i int) bool {
+			return !chunk[i].Timestamp.Before(from)
+		})
+		for _, event := range chunk[start:] {
+			if event.Timestamp.After(to) {
+				return firstInOrder(page, limit)
+			}
+			if len(page) > 0 && len(page) >= limit && event.Timestamp.After(page[len(page)-1].Timestamp) {
+				return firstInOrder(page, limit)
+			}
+			if after == nil || eventBefore(after, event) {
+				page = append(page, event)
+			}
+		}
+	}
+	return firstInOrder(page, limit)
+}
 
-	if startIdx >= endIdx {
-		return []*Event{}
+// dropBefore removes the events older than cutoff and returns them
+func (ael *AdEventList) dropBefore(cutoff time.Time) []*Event {
+	ael.mu.Lock()
+	defer ael.mu.Unlock()
+
+	// whole chunks go at once, the first chunk reaching cutoff loses a prefix
+	c := ael.chunkReaching(cutoff)
+	dropped := make([]*Event, 0)
+	for _, chunk := range ael.chunks[:c] {
+		dropped = append(dropped, chunk...)
+	}
+	if c < len(ael.chunks) {
+		chunk := ael.chunks[c]
+		keepFrom := sort.Search(len(chunk), func(i int) bool {
+			return !chunk[i].Timestamp.Before(cutoff)
+		})
+		if keepFrom > 0 {
+			dropped = append(dropped, chunk[:keepFrom]...)
+			kept := make([]*Event, len(chunk)-keepFrom, maxChunkSize)
+			copy(kept, chunk[keepFrom:])
+			ael.chunks[c] = kept
+		}
 	}
+	ael.chunks = append(ael.chunks[:0], ael.chunks[c:]...)
+	ael.size -= len(dropped)
 
-	result := make([]*Event, endIdx-startIdx)
-	copy(result, ael.events[startIdx:endIdx])
-	return result
+	if ael.lastClick != nil && ael.lastClick.Timestamp.Before(cutoff) {
+		ael.lastClick = nil
+	}
+	return dropped
 }
 
 // ==================== ID Generator Implementations ====================
@@ -365,10 +586,17 @@ type ImpressionsWithoutClickQueryParams struct {
 }
 
 // ImpressionsWithoutClickQuery implements the query for X impressions without click
-type ImpressionsWithoutClickQuery struct{}
+type ImpressionsWithoutClickQuery struct {
+	Clock TimeSource // what Execute runs on, nil is the system clock
+}
 
-// Execute executes the impressions without click query
+// Execute executes the impressions without click query at q.Clock
 func (q *ImpressionsWithoutClickQuery) Execute(storage EventStorage, adID int64, params interface{}) (interface{}, error) {
+	return q.ExecuteWithContext(clockContext(q.Clock), storage, adID, params)
+}
+
+// ExecuteWithContext executes the impressions without click query at ctx.Now
+func (q *ImpressionsWithoutClickQuery) ExecuteWithContext(ctx QueryContext, storage EventStorage, adID int64, params interface{}) (interface{}, error) {
 	p, ok := params.(ImpressionsWithoutClickQueryParams)
 	if !ok {
 		return false, errors.New("invalid query parameters")
@@ -379,10 +607,10 @@ func (q *ImpressionsWithoutClickQuery) Execute(storage EventStorage, adID int64,
 	}
 
 	// Calculate cutoff time
-	cutoffTime := time.Now().AddDate(0, 0, -p.WithinDays)
+	cutoffTime := ctx.Now.AddDate(0, 0, -p.WithinDays)
 
 	// Get events in the time range
-	events, err := storage.GetEventsInRange(adID, cutoffTime, time.Now())
+	events, err := storage.GetEventsInRange(adID, cutoffTime, ctx.Now)
 	if err != nil {
 		return false, err
 	}
@@ -395,6 +623,9 @@ func (q *ImpressionsWithoutClickQuery) Execute(storage EventStorage, adID int64,
 	// Count consecutive impressions, reset on any click
 	impressionCount := 0
 	for _, event := range events {
+		if !ctx.Watermark.counts(event) {
+			continue
+		}
 		if event.Type == CLICK {
 			// Reset counter on any click
 			impressionCount = 0
@@ -413,7 +644,11 @@ func (q *ImpressionsWithoutClickQuery) Execute(storage EventStorage, adID int64,
 
 // AdEventManager manages ad events with extensible design
 type AdEventManager struct {
-	config *ManagerConfig
+	config      *ManagerConfig
+	dedup       *dedupIndex // nil unless config.Dedup is enabled
+	subscribers *subscribers
+
+	compactMu sync.Mutex
 }
 
 // NewAdEventManager creates a new AdEventManager with default config
@@ -423,9 +658,17 @@ func NewAdEventManager() *AdEventManager {
 
 // NewAdEventManagerWithConfig creates a new AdEventManager with custom config
 func NewAdEventManagerWithConfig(config *ManagerConfig) *AdEventManager {
-	return &AdEventManager{
-		config: config,
+	if config.Registry == nil {
+		config.Registry = NewEventTypeRegistry()
+	}
+	aem := &AdEventManager{
+		config:      config,
+		subscribers: newSubscribers(),
 	}
+	if config.Dedup.enabled() {
+		aem.dedup = newDedupIndex(config.Dedup)
+	}
+	return aem
 }
 
 // RegisterAd registers a new ad ID
@@ -433,24 +676,69 @@ func (aem *AdEventManager) RegisterAd(adID int64) error {
 	return aem.config.Storage.RegisterAd(adID)
 }
 
-// AddEvent adds an event for the specified ad ID
+// AdExists checks if an ad ID is registered
+func (aem *AdEventManager) AdExists(adID int64) bool {
+	return aem.config.Storage.Exists(adID)
+}
+
+// AddEvent adds an event for the specified ad ID that happened now
 func (aem *AdEventManager) AddEvent(adID int64, eventType EventType) error {
+	// one clock read, a live event is never behind its own ingest time
+	now := aem.config.TimeSource.Now()
+	return aem.addEvent(adID, "", eventType, now, now, nil)
+}
+
+// AddEventAt adds an event for the specified ad ID with a client supplied
+// event time. Under DROP_LATE an event behind the watermark is rejected.
+func (aem *AdEventManager) AddEventAt(adID int64, eventType EventType, eventTime time.Time) error {
+	return aem.AddEventWithPayload(adID, eventType, eventTime, nil)
+}
+
+// AddEventWithPayload adds an event whose payload is validated against the
+// schema its type was registered with in ManagerConfig.Registry
+func (aem *AdEventManager) AddEventWithPayload(adID int64, eventType EventType, eventTime time.Time, payload map[string]interface{}) error {
+	return aem.AddEventWithClientID(adID, "", eventType, eventTime, payload)
+}
+
+// AddEventWithClientID adds an event carrying the client's own ID for it.
+// With deduplication enabled in ManagerConfig.Dedup a second event with the
+// same clientEventID for the ad inside the window fails with
+// ErrDuplicateEvent and is not stored. An empty clientEventID is never deduplicated.
+func (aem *AdEventManager) AddEventWithClientID(adID int64, clientEventID string, eventType EventType, eventTime time.Time, payload map[string]interface{}) error {
+	return aem.addEvent(adID, clientEventID, eventType, eventTime, aem.config.TimeSource.Now(), payload)
+}
+
+// addEvent stores an event received at ingestTime, callers that default the
+// event time to now pass the same clock read for both
+func (aem *AdEventManager) addEvent(adID int64, clientEventID string, eventType EventType, eventTime time.Time, ingestTime time.Time, payload map[string]interface{}) error {
 	if adID <= 0 {
 		return errors.New("adID must be positive")
 	}
 
-	// Auto-register if enabled and ad doesn't exist
-	if aem.config.AutoRegister && !aem.config.Storage.Exists(adID) {
-		if err := aem.config.Storage.RegisterAd(adID); err != nil {
-			return err
-		}
+	payload, err := aem.config.Registry.Validate(eventType, payload)
+	if err != nil {
+		return err
 	}
 
 	// Create new event
-	event := NewEvent(adID, eventType, aem.config.TimeSource.Now(), aem.config.IDGenerator)
+	event := NewEventAt(adID, eventType, eventTime, ingestTime, aem.config.IDGenerator)
+	event.Payload = payload
+	event.ClientEventID = clientEventID
+	if aem.config.Watermark.Late == DROP_LATE && aem.config.Watermark.IsLate(event) {
+		return ErrLateEvent
+	}
 
-	// Add to storage
-	if err := aem.config.Storage.AddEvent(adID, event); err != nil {
+	// Reserve the client ID first so parallel retries store one event
+	deduplicated := aem.dedup != nil && clientEventID != ""
+	if deduplicated {
+		if err := aem.dedup.reserve(adID, clientEventID, event.IngestTime); err != nil {
+			return err
+		}
+	}
+	if err := aem.store(adID, event); err != nil {
+		if deduplicated {
+			aem.dedup.release(adID, clientEventID)
+		}
 		return err
 	}
 
@@ -462,9 +750,26 @@ func (aem *AdEventManager) AddEvent(adID int64, eventType EventType) error {
 		}
 	}
 
+	// Feed the asynchronous subscribers, see subscriptions.go
+	aem.subscribers.publish(event)
+
 	return nil
 }
 
+// store registers the ad if needed and adds event to storage
+func (aem *AdEventManager) store(adID int64, event *Event) error {
+	// Auto-register if enabled and ad doesn't exist, a parallel first
+	// event may register it in between
+	if aem.config.AutoRegister && !aem.config.Storage.Exists(adID) {
+		if err := aem.config.Storage.RegisterAd(adID); err != nil && !aem.config.Storage.Exists(adID) {
+			return err
+		}
+	}
+
+	// Add to storage
+	return aem.config.Storage.AddEvent(adID, event)
+}
+
 // GetAllEvents returns all events for an ad ID sorted by creation date (ascending)
 func (aem *AdEventManager) GetAllEvents(adID int64) ([]*Event, error) {
 	if adID <= 0 {
@@ -491,24 +796,43 @@ func (aem *AdEventManager) HasXImpressionsWithoutClick(adID int64, x int, within
 		X:          x,
 		WithinDays: withinDays,
 	}
-	result, err := query.Execute(aem.config.Storage, adID, params)
+	result, err := query.ExecuteWithContext(aem.queryContext(), aem.config.Storage, adID, params)
 	if err != nil {
 		return false, err
 	}
 	return result.(bool), nil
 }
 
-// ExecuteQuery executes a custom query strategy
+// ExecuteQuery executes a custom query strategy, a ContextQueryStrategy runs
+// on the configured TimeSource and watermark
 func (aem *AdEventManager) ExecuteQuery(adID int64, strategy QueryStrategy, params interface{}) (interface{}, error) {
+	if contextual, ok := strategy.(ContextQueryStrategy); ok {
+		return contextual.ExecuteWithContext(aem.queryContext(), aem.config.Storage, adID, params)
+	}
 	return strategy.Execute(aem.config.Storage, adID, params)
 }
 
+func (aem *AdEventManager) queryContext() QueryContext {
+	return QueryContext{
+		Now:       aem.config.TimeSource.Now(),
+		Watermark: aem.config.Watermark,
+	}
+}
+
+// Watermark returns the event time before which new events are late
+func (aem *AdEventManager) Watermark() time.Time {
+	return aem.config.Watermark.Watermark(aem.config.TimeSource.Now())
+}
+
 // AddEventHandler adds an event handler that will be called when events are added
 func (aem *AdEventManager) AddEventHandler(handler EventHandler) {
 	aem.config.EventHandlers = append(aem.config.EventHandlers, handler)
 }
 
 func main() {
+	addr := flag.String("http", "", "serve the HTTP API on this address after the examples, e.g. :8080")
+	flag.Parse()
+
 	// Example 1: Default usage
 	fmt.Println("=== Example 1: Default Usage ===")
 	manager := NewAdEventManager()
@@ -576,10 +900,26 @@ func main() {
 		return nil
 	})
 
+	// Keep per minute / hour / day rollups next to the raw events
+	rollups := NewRollupStoreWithWatermark(customConfig.Watermark)
+	customManager.AddEventHandler(rollups.Handler())
+
 	adID2 := customManager.config.IDGenerator.GenerateID()
 	customManager.AddEvent(adID2, IMPRESSION)
 	customManager.AddEvent(adID2, CLICK)
 
+	now := customManager.config.TimeSource.Now()
+	summary, err := customManager.ExecuteQuery(adID2, &RollupSummaryQuery{Rollups: rollups}, RollupQueryParams{
+		Granularity: HOUR,
+		From:        now.Add(-time.Hour),
+		To:          now,
+	})
+	if err != nil {
+		fmt.Printf("Error executing rollup query: %v\n", err)
+	} else {
+		fmt.Printf("  Last hour: %+v\n", summary)
+	}
+
 	// Example 3: Using custom query strategy
 	fmt.Println("\n=== Example 3: Custom Query Strategy ===")
 	query := &ImpressionsWithoutClickQuery{}
@@ -593,4 +933,58 @@ func main() {
 	} else {
 		fmt.Printf("Query result: %v\n", result)
 	}
+
+	// Example 4: Events that survive a restart
+	fmt.Println("\n=== Example 4: File Storage ===")
+	dir, err := os.MkdirTemp("", "counter")
+	if err != nil {
+		fmt.Printf("Error creating storage dir: %v\n", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	fileStorage, err := NewFileStorage(dir)
+	if err != nil {
+		fmt.Printf("Error opening file storage: %v\n", err)
+		return
+	}
+	fileConfig := DefaultConfig()
+	fileConfig.Storage = fileStorage
+	fileManager := NewAdEventManagerWithConfig(fileConfig)
+	fileManager.AddEvent(adID, IMPRESSION)
+	fileManager.AddEvent(adID, CLICK)
+	fileStorage.Close()
+
+	reopened, err := NewFileStorage(dir)
+	if err != nil {
+		fmt.Printf("Error reopening file storage: %v\n", err)
+		return
+	}
+	defer reopened.Close()
+	events, err = reopened.GetEvents(adID)
+	fmt.Printf("Events after reopen: %d, err: %v\n", len(events), err)
+
+	// Example 5: Pause a campaign when it stops getting clicks
+	fmt.Println("\n=== Example 5: Alerts ===")
+	alertManager := NewAdEventManager()
+	alerts := NewAlertEngine(alertManager, 64, BLOCK)
+	paused := make(chan Alert, 1)
+	alerts.AddRule(AlertRule{
+		Name:      "pause-no-clicks",
+		Condition: ImpressionsWithoutClick(3, 1),
+		OnFire:    func(alert Alert) { paused <- alert },
+	})
+	for i := 0; i < 3; i++ {
+		alertManager.AddEvent(adID, IMPRESSION)
+	}
+	alert := <-paused
+	fmt.Printf("Rule %s fired, pausing ad %d\n", alert.Rule, alert.AdID)
+	alerts.Stop()
+
+	if *addr != "" {
+		fmt.Printf("\nServing the HTTP API on %s\n", *addr)
+		if err := http.ListenAndServe(*addr, NewAPIServer(manager)); err != nil {
+			fmt.Printf("Error serving HTTP API: %v\n", err)
+		}
+	}
 }
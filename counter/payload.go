@@ -0,0 +1,299 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+/*
+Typed payloads for custom event types
+
+- a type registered with RegisterWithSchema carries a PayloadSchema, e.g.
+    CONVERSION  {"value": NUMBER (required), "currency": STRING}
+    VIDEO_VIEW  {"duration": DURATION (required), "autoplay": BOOL}
+- AddEventWithPayload validates the payload against the schema of its type
+  and stores it normalized: NUMBER -> float64, STRING -> string, BOOL -> bool,
+  DURATION -> float64 seconds. The normalized form survives a JSON round
+  trip, so FileStorage gives back exactly what was stored.
+- types without a schema (IMPRESSION, CLICK) take no payload
+- PayloadQuery counts the events of one type matching PayloadFilters and
+  sums a numeric field, e.g. total conversion value in the last day
+*/
+
+// FieldType is the type of a payload field
+type FieldType int
+
+const (
+	NUMBER FieldType = iota
+	STRING
+	BOOL
+	DURATION
+)
+
+// String returns the string representation of FieldType
+func (f FieldType) String() string {
+	switch f {
+	case NUMBER:
+		return "NUMBER"
+	case STRING:
+		return "STRING"
+	case BOOL:
+		return "BOOL"
+	case DURATION:
+		return "DURATION"
+	default:
+		return "UNKNOWN"
+	}
+}
+
+// FieldSpec describes one payload field
+type FieldSpec struct {
+	Type     FieldType
+	Required bool
+}
+
+// PayloadSchema lists the fields a payload may have, other fields are rejected
+type PayloadSchema struct {
+	Fields map[string]FieldSpec
+}
+
+// ErrInvalidPayload is wrapped by every payload validation error
+var ErrInvalidPayload = errors.New("invalid payload")
+
+func payloadError(format string, args ...interface{}) error {
+	return fmt.Errorf("%w: %s", ErrInvalidPayload, fmt.Sprintf(format, args...))
+}
+
+// Validate checks payload against the schema and returns its normalized copy
+func (s *PayloadSchema) Validate(payload map[string]interface{}) (map[string]interface{}, error) {
+	normalized := make(map[string]interface{}, len(payload))
+	for name, value := range payload {
+		spec, known := s.Fields[name]
+		if !known {
+			return nil, payloadError("unknown field %q", name)
+		}
+		v, err := normalize(spec.Type, value)
+		if err != nil {
+			return nil, payloadError("field %q: %v", name, err)
+		}
+		normalized[name] = v
+	}
+
+	// report missing fields in a stable order
+	names := make([]string, 0, len(s.Fields))
+	for name := range s.Fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if _, present := normalized[name]; s.Fields[name].Required && !present {
+			return nil, payloadError("missing field %q", name)
+		}
+	}
+	return normalized, nil
+}
+
+func toFloat(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case float64:
+		return v, true
+	case float32:
+		return float64(v), true
+	case int:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case int32:
+		return float64(v), true
+	default:
+		return 0, false
+	}
+}
+
+func normalize(fieldType FieldType, value interface{}) (interface{}, error) {
+	switch fieldType {
+	case NUMBER:
+		if f, ok := toFloat(value); ok {
+			return f, nil
+		}
+		return nil, fmt.Errorf("%v is not a number", value)
+	case STRING:
+		if s, ok := value.(string); ok {
+			return s, nil
+		}
+		return nil, fmt.Errorf("%v is not a string", value)
+	case BOOL:
+		if b, ok := value.(bool); ok {
+			return b, nil
+		}
+		return nil, fmt.Errorf("%v is not a bool", value)
+	case DURATION:
+		switch v := value.(type) {
+		case time.Duration:
+			return v.Seconds(), nil
+		case string:
+			d, err := time.ParseDuration(v)
+			if err != nil {
+				return nil, err
+			}
+			return d.Seconds(), nil
+		}
+		// a plain number is taken as seconds
+		if f, ok := toFloat(value); ok {
+			return f, nil
+		}
+		return nil, fmt.Errorf("%v is not a duration", value)
+	default:
+		return nil, fmt.Errorf("unknown field type %d", fieldType)
+	}
+}
+
+// ==================== Payload Query Strategy ====================
+
+// FilterOp compares a payload field with a value
+type FilterOp int
+
+const (
+	EQ FilterOp = iota
+	NE
+	GT
+	GTE
+	LT
+	LTE
+)
+
+// PayloadFilter keeps the events whose Field compares to Value with Op.
+// Numbers (and durations in seconds) compare numerically, strings
+// lexically, bools only with EQ and NE. An event without the field never matches.
+type PayloadFilter struct {
+	Field string
+	Op    FilterOp
+	Value interface{}
+}
+
+func (f PayloadFilter) matches(payload map[string]interface{}) bool {
+	value, present := payload[f.Field]
+	if !present {
+		return false
+	}
+
+	cmp := 0
+	switch v := value.(type) {
+	case float64:
+		want, ok := toFloat(f.Value)
+		if !ok {
+			return false
+		}
+		switch {
+		case v < want:
+			cmp = -1
+		case v > want:
+			cmp = 1
+		}
+	case string:
+		want, ok := f.Value.(string)
+		if !ok {
+			return false
+		}
+		cmp = strings.Compare(v, want)
+	case bool:
+		want, ok := f.Value.(bool)
+		if !ok || (f.Op != EQ && f.Op != NE) {
+			return false
+		}
+		if v != want {
+			cmp = 1
+		}
+	default:
+		return false
+	}
+
+	switch f.Op {
+	case EQ:
+		return cmp == 0
+	case NE:
+		return cmp != 0
+	case GT:
+		return cmp > 0
+	case GTE:
+		return cmp >= 0
+	case LT:
+		return cmp < 0
+	case LTE:
+		return cmp <= 0
+	default:
+		return false
+	}
+}
+
+// PayloadQueryParams holds parameters for PayloadQuery. A zero To means now.
+type PayloadQueryParams struct {
+	Type     EventType
+	From     time.Time
+	To       time.Time
+	Filters  []PayloadFilter
+	SumField string // optional, a NUMBER or DURATION field
+}
+
+// PayloadQueryResult is the number of matching events and the sum of SumField over them
+type PayloadQueryResult struct {
+	Count int
+	Sum   float64
+}
+
+// PayloadQuery filters the events of one type on their payload
+type PayloadQuery struct {
+	Clock TimeSource // what Execute runs on, nil is the system clock
+}
+
+// Execute executes the payload query at q.Clock
+func (q *PayloadQuery) Execute(storage EventStorage, adID int64, params interface{}) (interface{}, error) {
+	return q.ExecuteWithContext(clockContext(q.Clock), storage, adID, params)
+}
+
+// ExecuteWithContext executes the payload query, late events are skipped under IGNORE_LATE
+func (q *PayloadQuery) ExecuteWithContext(ctx QueryContext, storage EventStorage, adID int64, params interface{}) (interface{}, error) {
+	p, ok := params.(PayloadQueryParams)
+	if !ok {
+		return PayloadQueryResult{}, errors.New("invalid query parameters")
+	}
+	to := p.To
+	if to.IsZero() {
+		to = ctx.Now
+	}
+	if p.From.After(to) {
+		return PayloadQueryResult{}, errors.New("from time must be before to time")
+	}
+
+	events, err := storage.GetEventsInRange(adID, p.From, to)
+	if err != nil {
+		return PayloadQueryResult{}, err
+	}
+
+	result := PayloadQueryResult{}
+	for _, event := range events {
+		if event.Type != p.Type || !ctx.Watermark.counts(event) {
+			continue
+		}
+		matched := true
+		for _, filter := range p.Filters {
+			if !filter.matches(event.Payload) {
+				matched = false
+				break
+			}
+		}
+		if !matched {
+			continue
+		}
+		result.Count++
+		if p.SumField != "" {
+			if v, ok := event.Payload[p.SumField].(float64); ok {
+				result.Sum += v
+			}
+		}
+	}
+	return result, nil
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+const (
+	CONVERSION EventType = 100 + iota
+	VIDEO_VIEW
+)
+
+func newPayloadManager() (*AdEventManager, *MockTimeSource) {
+	manager, clock := newClockedManager(WatermarkPolicy{})
+	manager.config.Registry.RegisterWithSchema("CONVERSION", CONVERSION, &PayloadSchema{Fields: map[string]FieldSpec{
+		"value":    {Type: NUMBER, Required: true},
+		"currency": {Type: STRING},
+	}})
+	manager.config.Registry.RegisterWithSchema("VIDEO_VIEW", VIDEO_VIEW, &PayloadSchema{Fields: map[string]FieldSpec{
+		"duration": {Type: DURATION, Required: true},
+		"autoplay": {Type: BOOL},
+	}})
+	return manager, clock
+}
+
+func TestPayloadValidation(t *testing.T) {
+	manager, clock := newPayloadManager()
+	now := clock.Now()
+
+	invalid := []struct {
+		eventType EventType
+		payload   map[string]interface{}
+	}{
+		{CONVERSION, nil},
+		{CONVERSION, map[string]interface{}{"value": "lots"}},
+		{CONVERSION, map[string]interface{}{"value": 1, "coupon": "X"}},
+		{VIDEO_VIEW, map[string]interface{}{"duration": "forever"}},
+		{VIDEO_VIEW, map[string]interface{}{"duration": 3, "autoplay": "yes"}},
+		{IMPRESSION, map[string]interface{}{"value": 1}},
+	}
+	for _, tt := range invalid {
+		if err := manager.AddEventWithPayload(1, tt.eventType, now, tt.payload); !errors.Is(err, ErrInvalidPayload) {
+			t.Errorf("%s %v: got %v, want ErrInvalidPayload", tt.eventType, tt.payload, err)
+		}
+	}
+
+	manager.AddEventWithPayload(1, CONVERSION, now, map[string]interface{}{"value": 5, "currency": "EUR"})
+	manager.AddEventWithPayload(1, VIDEO_VIEW, now.Add(time.Second), map[string]interface{}{"duration": "1m30s"})
+	manager.AddEventWithPayload(1, VIDEO_VIEW, now.Add(2*time.Second), map[string]interface{}{"duration": time.Second, "autoplay": true})
+
+	events, _ := manager.GetAllEvents(1)
+	if len(events) != 3 {
+		t.Fatalf("%d events stored, want 3", len(events))
+	}
+	want := []interface{}{5.0, 90.0, 1.0}
+	for i, field := range []string{"value", "duration", "duration"} {
+		if events[i].Payload[field] != want[i] {
+			t.Errorf("event %d %s normalized to %v, want %v", i, field, events[i].Payload[field], want[i])
+		}
+	}
+	// names belong to the registry, another one does not know CONVERSION
+	if name := manager.config.Registry.nameOf(CONVERSION); name != "CONVERSION" {
+		t.Errorf("registry named CONVERSION %s", name)
+	}
+	if name := NewEventTypeRegistry().nameOf(CONVERSION); name != "UNKNOWN" {
+		t.Errorf("fresh registry named CONVERSION %s", name)
+	}
+}
+
+func TestPayloadQuery(t *testing.T) {
+	manager, clock := newPayloadManager()
+	for i, value := range []float64{10, 25, 40, 5} {
+		clock.SetTime(baseTime.Add(time.Duration(i) * time.Hour))
+		currency := "EUR"
+		if i%2 == 1 {
+			currency = "USD"
+		}
+		manager.AddEventWithPayload(1, CONVERSION, clock.Now(), map[string]interface{}{"value": value, "currency": currency})
+		manager.AddEvent(1, CLICK)
+	}
+
+	tests := []struct {
+		name      string
+		params    PayloadQueryParams
+		wantCount int
+		wantSum   float64
+	}{
+		{"all", PayloadQueryParams{Type: CONVERSION, From: baseTime, SumField: "value"}, 4, 80},
+		{"euro", PayloadQueryParams{Type: CONVERSION, From: baseTime, SumField: "value",
+			Filters: []PayloadFilter{{Field: "currency", Op: EQ, Value: "EUR"}}}, 2, 50},
+		{"big usd", PayloadQueryParams{Type: CONVERSION, From: baseTime, SumField: "value",
+			Filters: []PayloadFilter{{Field: "currency", Op: NE, Value: "EUR"}, {Field: "value", Op: GTE, Value: 10}}}, 1, 25},
+		{"window", PayloadQueryParams{Type: CONVERSION, From: baseTime.Add(90 * time.Minute), SumField: "value"}, 2, 45},
+		{"missing field", PayloadQueryParams{Type: CONVERSION, From: baseTime,
+			Filters: []PayloadFilter{{Field: "coupon", Op: NE, Value: "X"}}}, 0, 0},
+	}
+	for _, tt := range tests {
+		result, err := manager.ExecuteQuery(1, &PayloadQuery{}, tt.params)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		got := result.(PayloadQueryResult)
+		if got.Count != tt.wantCount || got.Sum != tt.wantSum {
+			t.Errorf("%s: %+v, want count %d sum %v", tt.name, got, tt.wantCount, tt.wantSum)
+		}
+	}
+}
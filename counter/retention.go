@@ -0,0 +1,135 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+/*
+Retention - raw events are kept for a window, then compacted away
+
+- RetentionPolicy.Default applies to every ad, PerAd overrides it for single
+  ads. A zero retention keeps the events of the ad forever.
+- the cutoff is on event time: at TimeSource.Now() an ad with retention R
+  loses its events with Timestamp < now - R
+- DROP_EXPIRED deletes them, ROLLUP_EXPIRED counts them into Rollups first so
+  the minute / hour / day numbers outlive the raw events. A RollupStore fed by
+  its Handler() already counts every event, use DROP_EXPIRED with it.
+- Compact runs one pass, StartCompactor runs it every interval in the
+  background. The storage has to implement CompactableStorage.
+*/
+
+// RetentionAction is what happens to events older than the retention
+type RetentionAction int
+
+const (
+	DROP_EXPIRED RetentionAction = iota
+	ROLLUP_EXPIRED
+)
+
+// CompactableStorage is an EventStorage whose old events can be removed
+type CompactableStorage interface {
+	EventStorage
+	// AdIDs returns the registered ad IDs
+	AdIDs() []int64
+	// DeleteBefore removes the events of adID older than cutoff and returns them
+	DeleteBefore(adID int64, cutoff time.Time) ([]*Event, error)
+}
+
+// RetentionPolicy configures how long raw events are kept. The zero value keeps everything.
+type RetentionPolicy struct {
+	Default time.Duration
+	PerAd   map[int64]time.Duration
+	Action  RetentionAction
+	Rollups *RollupStore // where ROLLUP_EXPIRED counts the expired events
+}
+
+// For returns the retention of adID, 0 means forever
+func (p RetentionPolicy) For(adID int64) time.Duration {
+	if retention, found := p.PerAd[adID]; found {
+		return retention
+	}
+	return p.Default
+}
+
+// CompactionStats reports one compaction pass
+type CompactionStats struct {
+	Ads      int // ads that lost events
+	Dropped  int
+	RolledUp int
+}
+
+// Compact removes the events older than the retention of their ad
+func (aem *AdEventManager) Compact() (CompactionStats, error) {
+	stats := CompactionStats{}
+	policy := aem.config.Retention
+	storage, ok := aem.config.Storage.(CompactableStorage)
+	if !ok {
+		return stats, errors.New("storage does not support compaction")
+	}
+	if policy.Action == ROLLUP_EXPIRED && policy.Rollups == nil {
+		return stats, errors.New("ROLLUP_EXPIRED needs a RollupStore")
+	}
+
+	// compaction is serialized, a slow pass is not overtaken by the next one
+	aem.compactMu.Lock()
+	defer aem.compactMu.Unlock()
+
+	now := aem.config.TimeSource.Now()
+	for _, adID := range storage.AdIDs() {
+		retention := policy.For(adID)
+		if retention <= 0 {
+			continue
+		}
+		dropped, err := storage.DeleteBefore(adID, now.Add(-retention))
+		if err != nil {
+			return stats, fmt.Errorf("adID %d: %w", adID, err)
+		}
+		if len(dropped) == 0 {
+			continue
+		}
+
+		stats.Ads++
+		stats.Dropped += len(dropped)
+		if policy.Action == ROLLUP_EXPIRED {
+			for _, event := range dropped {
+				policy.Rollups.Record(adID, event)
+			}
+			stats.RolledUp += len(dropped)
+		}
+	}
+	return stats, nil
+}
+
+// StartCompactor runs Compact every interval until the returned stop func is called
+func (aem *AdEventManager) StartCompactor(interval time.Duration) (stop func()) {
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if _, err := aem.Compact(); err != nil {
+					// Log error, the next pass tries again
+					fmt.Printf("Warning: compaction error: %v\n", err)
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			close(done)
+			wg.Wait()
+		})
+	}
+}
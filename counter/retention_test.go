@@ -0,0 +1,161 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func newRetentionManager(policy RetentionPolicy) (*AdEventManager, *MockTimeSource) {
+	clock := NewMockTimeSource(baseTime)
+	config := DefaultConfig()
+	config.TimeSource = clock
+	config.Retention = policy
+	return NewAdEventManagerWithConfig(config), clock
+}
+
+// addHourly adds one impression per hour for the given hours, starting at baseTime
+func addHourly(manager *AdEventManager, adID int64, hours int) {
+	for i := 0; i < hours; i++ {
+		manager.AddEventAt(adID, IMPRESSION, baseTime.Add(time.Duration(i)*time.Hour))
+	}
+}
+
+func TestCompactPerAdRetention(t *testing.T) {
+	manager, clock := newRetentionManager(RetentionPolicy{
+		Default: 24 * time.Hour,
+		PerAd:   map[int64]time.Duration{2: 6 * time.Hour, 3: 0},
+	})
+	for adID := int64(1); adID <= 3; adID++ {
+		addHourly(manager, adID, 48)
+	}
+
+	clock.SetTime(baseTime.Add(48 * time.Hour))
+	stats, err := manager.Compact()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Ads != 2 || stats.Dropped != 24+42 || stats.RolledUp != 0 {
+		t.Errorf("stats %+v", stats)
+	}
+	for adID, want := range map[int64]int{1: 24, 2: 6, 3: 48} {
+		if events, _ := manager.GetAllEvents(adID); len(events) != want {
+			t.Errorf("ad %d kept %d events, want %d", adID, len(events), want)
+		}
+	}
+
+	if stats, _ := manager.Compact(); stats.Dropped != 0 {
+		t.Errorf("second pass dropped %d events", stats.Dropped)
+	}
+}
+
+func TestCompactRollsUpExpiredEvents(t *testing.T) {
+	rollups := NewRollupStore()
+	manager, clock := newRetentionManager(RetentionPolicy{
+		Default: 24 * time.Hour,
+		Action:  ROLLUP_EXPIRED,
+		Rollups: rollups,
+	})
+	addHourly(manager, 1, 48)
+	manager.AddEventAt(1, CLICK, baseTime.Add(time.Minute))
+
+	clock.SetTime(baseTime.Add(48 * time.Hour))
+	stats, err := manager.Compact()
+	if err != nil || stats.RolledUp != 25 {
+		t.Fatalf("stats %+v, %v", stats, err)
+	}
+	buckets, _ := rollups.Buckets(1, HOUR, baseTime, baseTime.Add(48*time.Hour))
+	if len(buckets) != 24 || buckets[0].Impressions != 1 || buckets[0].Clicks != 1 {
+		t.Errorf("hour buckets %+v", buckets)
+	}
+}
+
+func TestCompactNeedsRollupStore(t *testing.T) {
+	manager, _ := newRetentionManager(RetentionPolicy{Default: time.Hour, Action: ROLLUP_EXPIRED})
+	if _, err := manager.Compact(); err == nil {
+		t.Error("ROLLUP_EXPIRED without a RollupStore compacted")
+	}
+}
+
+func TestBackgroundCompactor(t *testing.T) {
+	manager, clock := newRetentionManager(RetentionPolicy{Default: time.Hour})
+	addHourly(manager, 1, 10)
+	clock.SetTime(baseTime.Add(10 * time.Hour))
+
+	stop := manager.StartCompactor(time.Millisecond)
+	defer stop()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		events, _ := manager.GetAllEvents(1)
+		if len(events) == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d events left after compacting for 5s, want 1", len(events))
+		}
+		time.Sleep(time.Millisecond)
+	}
+	stop()
+	stop()
+}
+
+// queries race the compactor rewriting the logs under them, run with -race
+func TestQueriesDuringCompaction(t *testing.T) {
+	const hours = 40 * indexInterval
+	for name, newStorage := range storageFactories() {
+		t.Run(name, func(t *testing.T) {
+			clock := NewMockTimeSource(baseTime)
+			config := DefaultConfig()
+			config.TimeSource = clock
+			config.Storage = newStorage(t)
+			config.Retention = RetentionPolicy{Default: time.Hour}
+			manager := NewAdEventManagerWithConfig(config)
+			addHourly(manager, 1, hours)
+
+			stop := manager.StartCompactor(time.Millisecond)
+			defer stop()
+
+			// the last blocks of the log, their index shrinks with every pass
+			from, to := baseTime.Add((hours-indexInterval)*time.Hour), baseTime.Add(hours*time.Hour)
+			done := make(chan struct{})
+			var wg sync.WaitGroup
+			for i := 0; i < 4; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for {
+						select {
+						case <-done:
+							return
+						default:
+						}
+						if _, err := manager.GetEventsInRange(1, from, to); err != nil {
+							t.Errorf("range query: %v", err)
+							return
+						}
+						if _, err := manager.GetEventsPage(1, from, to, nil, 10); err != nil {
+							t.Errorf("page query: %v", err)
+							return
+						}
+					}
+				}()
+			}
+
+			// each step expires about a block of events
+			for hour := indexInterval; hour <= hours; hour += indexInterval {
+				clock.SetTime(baseTime.Add(time.Duration(hour) * time.Hour))
+				time.Sleep(2 * time.Millisecond)
+			}
+			close(done)
+			wg.Wait()
+			stop()
+
+			if _, err := manager.Compact(); err != nil {
+				t.Fatal(err)
+			}
+			if events, _ := manager.GetAllEvents(1); len(events) != 1 {
+				t.Errorf("%d events left, want 1", len(events))
+			}
+		})
+	}
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+/*
+Rollups - impressions / clicks per ad counted into minute, hour and day buckets
+
+- RollupStore.Handler() is an EventHandler, every added event bumps one bucket
+  per granularity, so the rollups are maintained incrementally
+- buckets are aligned to UTC, a day bucket starts at 00:00 UTC
+- RollupQuery and RollupSummaryQuery read the buckets only, they never scan
+  the raw events in EventStorage
+- buckets can not skip an event at query time, so a store created with an
+  IGNORE_LATE watermark does not count late events at all
+- a bucket is counted whole or not at all: from is rounded down to the start
+  of its bucket and to up to the end of its bucket, events after to that share
+  its bucket are counted too. Exact edges need the raw events.
+*/
+
+// Granularity is the width of a rollup bucket
+type Granularity int
+
+const (
+	MINUTE Granularity = iota
+	HOUR
+	DAY
+)
+
+var granularities = []Granularity{MINUTE, HOUR, DAY}
+
+// String returns the string representation of Granularity
+func (g Granularity) String() string {
+	switch g {
+	case MINUTE:
+		return "MINUTE"
+	case HOUR:
+		return "HOUR"
+	case DAY:
+		return "DAY"
+	default:
+		return "UNKNOWN"
+	}
+}
+
+// Duration returns the width of one bucket
+func (g Granularity) Duration() time.Duration {
+	switch g {
+	case MINUTE:
+		return time.Minute
+	case HOUR:
+		return time.Hour
+	default:
+		return 24 * time.Hour
+	}
+}
+
+func (g Granularity) valid() bool {
+	return g >= MINUTE && g <= DAY
+}
+
+// bucketStart returns the start of the bucket t falls in, as unix seconds
+func (g Granularity) bucketStart(t time.Time) int64 {
+	return t.UTC().Truncate(g.Duration()).Unix()
+}
+
+// Bucket holds the counts of one ad in one time bucket
+type Bucket struct {
+	Start       time.Time
+	Impressions int64
+	Clicks      int64
+}
+
+// CTR returns clicks per impression, 0 when there were no impressions
+func (b Bucket) CTR() float64 {
+	return ctr(b.Impressions, b.Clicks)
+}
+
+func ctr(impressions, clicks int64) float64 {
+	if impressions == 0 {
+		return 0
+	}
+	return float64(clicks) / float64(impressions)
+}
+
+// rollupSeries is the buckets of one ad at one granularity
+type rollupSeries struct {
+	starts  []int64 // sorted bucket starts
+	buckets map[int64]*Bucket
+}
+
+func newRollupSeries() *rollupSeries {
+	return &rollupSeries{buckets: make(map[int64]*Bucket)}
+}
+
+// bucket returns the bucket starting at start, creating it if needed
+func (s *rollupSeries) bucket(start int64) *Bucket {
+	if b, exists := s.buckets[start]; exists {
+		return b
+	}
+
+	b := &Bucket{Start: time.Unix(start, 0).UTC()}
+	s.buckets[start] = b
+
+	// events arrive mostly in order, so this is almost always an append
+	pos := sort.Search(len(s.starts), func(i int) bool { return s.starts[i] > start })
+	s.starts = append(s.starts, 0)
+	copy(s.starts[pos+1:], s.starts[pos:])
+	s.starts[pos] = start
+	return b
+}
+
+// between returns copies of the buckets with a start in [from, to]
+func (s *rollupSeries) between(from, to int64) []Bucket {
+	first := sort.Search(len(s.starts), func(i int) bool { return s.starts[i] >= from })
+	result := make([]Bucket, 0)
+	for i := first; i < len(s.starts) && s.starts[i] <= to; i++ {
+		result = append(result, *s.buckets[s.starts[i]])
+	}
+	return result
+}
+
+// RollupStore keeps the rollups of every ad
+type RollupStore struct {
+	ads       map[int64][]*rollupSeries // indexed by Granularity
+	watermark WatermarkPolicy
+	mu        sync.RWMutex
+}
+
+// NewRollupStore creates an empty rollup store that counts every event
+func NewRollupStore() *RollupStore {
+	return NewRollupStoreWithWatermark(WatermarkPolicy{})
+}
+
+// NewRollupStoreWithWatermark creates an empty rollup store, pass the
+// manager's WatermarkPolicy so IGNORE_LATE keeps late events out of the buckets
+func NewRollupStoreWithWatermark(watermark WatermarkPolicy) *RollupStore {
+	return &RollupStore{
+		ads:       make(map[int64][]*rollupSeries),
+		watermark: watermark,
+	}
+}
+
+// Record counts event in its bucket of every granularity
+func (r *RollupStore) Record(adID int64, event *Event) {
+	if event.Type != IMPRESSION && event.Type != CLICK {
+		return
+	}
+	if !r.watermark.counts(event) {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	series, exists := r.ads[adID]
+	if !exists {
+		series = make([]*rollupSeries, len(granularities))
+		for i := range series {
+			series[i] = newRollupSeries()
+		}
+		r.ads[adID] = series
+	}
+
+	for _, g := range granularities {
+		b := series[g].bucket(g.bucketStart(event.Timestamp))
+		if event.Type == IMPRESSION {
+			b.Impressions++
+		} else {
+			b.Clicks++
+		}
+	}
+}
+
+// Handler returns an EventHandler that keeps the rollups up to date
+func (r *RollupStore) Handler() EventHandler {
+	return func(adID int64, event *Event) error {
+		r.Record(adID, event)
+		return nil
+	}
+}
+
+// Backfill counts the events already in storage, for example after opening a
+// FileStorage. It must run before the handler sees new events of adID.
+func (r *RollupStore) Backfill(storage EventStorage, adID int64) error {
+	events, err := storage.GetEvents(adID)
+	if err != nil {
+		return err
+	}
+	for _, event := range events {
+		r.Record(adID, event)
+	}
+	return nil
+}
+
+// Buckets returns the non empty buckets of adID at granularity g from the
+// bucket of from through the bucket of to, oldest first. The first and last
+// bucket are whole, they may hold events before from and after to.
+func (r *RollupStore) Buckets(adID int64, g Granularity, from, to time.Time) ([]Bucket, error) {
+	if !g.valid() {
+		return nil, fmt.Errorf("unknown granularity %d", g)
+	}
+	if from.After(to) {
+		return nil, errors.New("from time must be before to time")
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	series, exists := r.ads[adID]
+	if !exists {
+		return []Bucket{}, nil
+	}
+	return series[g].between(g.bucketStart(from), g.bucketStart(to)), nil
+}
+
+// ==================== Rollup Query Strategies ====================
+
+// RollupQueryParams holds parameters for RollupQuery
+type RollupQueryParams struct {
+	Granularity Granularity
+	From        time.Time
+	To          time.Time
+}
+
+// RollupQuery returns the []Bucket of an ad between From and To. It answers
+// from the rollups, the storage passed to Execute is not read.
+type RollupQuery struct {
+	Rollups *RollupStore
+}
+
+// Execute executes the rollup query
+func (q *RollupQuery) Execute(storage EventStorage, adID int64, params interface{}) (interface{}, error) {
+	p, ok := params.(RollupQueryParams)
+	if !ok {
+		return nil, errors.New("invalid query parameters")
+	}
+	return q.Rollups.Buckets(adID, p.Granularity, p.From, p.To)
+}
+
+// RollupSummary is the total of the buckets a RollupSummaryQuery covered,
+// the events in [From, To)
+type RollupSummary struct {
+	From        time.Time
+	To          time.Time // end of the bucket the query's To falls in
+	Impressions int64
+	Clicks      int64
+	CTR         float64
+}
+
+// RollupSummaryQuery returns a RollupSummary of an ad between From and To,
+// summed from the buckets at the given granularity. From is rounded down to
+// the start of its bucket and To up to the end of its bucket, so a coarser
+// granularity is cheaper but less exact.
+type RollupSummaryQuery struct {
+	Rollups *RollupStore
+}
+
+// Execute executes the rollup summary query
+func (q *RollupSummaryQuery) Execute(storage EventStorage, adID int64, params interface{}) (interface{}, error) {
+	p, ok := params.(RollupQueryParams)
+	if !ok {
+		return RollupSummary{}, errors.New("invalid query parameters")
+	}
+
+	buckets, err := q.Rollups.Buckets(adID, p.Granularity, p.From, p.To)
+	if err != nil {
+		return RollupSummary{}, err
+	}
+
+	summary := RollupSummary{
+		From: time.Unix(p.Granularity.bucketStart(p.From), 0).UTC(),
+		To:   time.Unix(p.Granularity.bucketStart(p.To), 0).UTC().Add(p.Granularity.Duration()),
+	}
+	for _, b := range buckets {
+		summary.Impressions += b.Impressions
+		summary.Clicks += b.Clicks
+	}
+	summary.CTR = ctr(summary.Impressions, summary.Clicks)
+	return summary, nil
+}
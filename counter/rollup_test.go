@@ -0,0 +1,122 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRollupsThroughEventHandler(t *testing.T) {
+	clock := NewMockTimeSource(baseTime)
+	config := DefaultConfig()
+	config.TimeSource = clock
+	manager := NewAdEventManagerWithConfig(config)
+
+	rollups := NewRollupStore()
+	manager.AddEventHandler(rollups.Handler())
+
+	add := func(offset time.Duration, eventType EventType) {
+		clock.SetTime(baseTime.Add(offset))
+		if err := manager.AddEvent(1, eventType); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 12:00 - 3 impressions 1 click, 12:01 - 1 impression,
+	// 13:30 - 4 impressions 2 clicks, next day - 2 impressions
+	add(0, IMPRESSION)
+	add(10*time.Second, IMPRESSION)
+	add(20*time.Second, CLICK)
+	add(59*time.Second, IMPRESSION)
+	add(time.Minute, IMPRESSION)
+	for i := 0; i < 4; i++ {
+		add(90*time.Minute, IMPRESSION)
+	}
+	add(90*time.Minute, CLICK)
+	add(91*time.Minute, CLICK)
+	add(24*time.Hour, IMPRESSION)
+	add(24*time.Hour+time.Second, IMPRESSION)
+
+	tests := []struct {
+		g     Granularity
+		wantI []int64
+		wantC []int64
+	}{
+		{MINUTE, []int64{3, 1, 4, 0, 2}, []int64{1, 0, 1, 1, 0}},
+		{HOUR, []int64{4, 4, 2}, []int64{1, 2, 0}},
+		{DAY, []int64{8, 2}, []int64{3, 0}},
+	}
+	for _, tt := range tests {
+		// the storage is not needed, the rollups answer on their own
+		result, err := (&RollupQuery{Rollups: rollups}).Execute(nil, 1, RollupQueryParams{
+			Granularity: tt.g,
+			From:        baseTime,
+			To:          baseTime.Add(48 * time.Hour),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		buckets := result.([]Bucket)
+		if len(buckets) != len(tt.wantI) {
+			t.Fatalf("%s: %d buckets, want %d", tt.g, len(buckets), len(tt.wantI))
+		}
+		for i, b := range buckets {
+			if b.Impressions != tt.wantI[i] || b.Clicks != tt.wantC[i] {
+				t.Errorf("%s bucket %s: %d/%d, want %d/%d", tt.g, b.Start, b.Impressions, b.Clicks, tt.wantI[i], tt.wantC[i])
+			}
+			if b.Start.Unix()%int64(tt.g.Duration()/time.Second) != 0 {
+				t.Errorf("%s bucket starts at %s", tt.g, b.Start)
+			}
+		}
+	}
+
+	result, err := manager.ExecuteQuery(1, &RollupSummaryQuery{Rollups: rollups}, RollupQueryParams{
+		Granularity: HOUR,
+		From:        baseTime.Add(30 * time.Minute),
+		To:          baseTime.Add(2 * time.Hour),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	summary := result.(RollupSummary)
+	if summary.Impressions != 8 || summary.Clicks != 3 || summary.CTR != 3.0/8 {
+		t.Errorf("summary %+v, want 8 impressions 3 clicks", summary)
+	}
+	if !summary.From.Equal(baseTime) {
+		t.Errorf("summary From %s, want rounded down to %s", summary.From, baseTime)
+	}
+	if want := baseTime.Add(3 * time.Hour); !summary.To.Equal(want) {
+		t.Errorf("summary To %s, want the end of its bucket %s", summary.To, want)
+	}
+
+	// To inside the 13:00 bucket counts the whole bucket, the 13:31 click too
+	result, _ = manager.ExecuteQuery(1, &RollupSummaryQuery{Rollups: rollups}, RollupQueryParams{
+		Granularity: HOUR,
+		From:        baseTime,
+		To:          baseTime.Add(90 * time.Minute),
+	})
+	summary = result.(RollupSummary)
+	if summary.Impressions != 8 || summary.Clicks != 3 {
+		t.Errorf("summary to 13:30 %+v, want the 13:00 bucket whole", summary)
+	}
+	if want := baseTime.Add(2 * time.Hour); !summary.To.Equal(want) {
+		t.Errorf("summary To %s, want rounded up to %s", summary.To, want)
+	}
+}
+
+func TestRollupBackfill(t *testing.T) {
+	storage := NewInMemoryStorage()
+	storage.RegisterAd(1)
+	storage.AddEvent(1, testEvent(1, 1, IMPRESSION, 0))
+	storage.AddEvent(1, testEvent(2, 1, CLICK, time.Second))
+
+	rollups := NewRollupStore()
+	if err := rollups.Backfill(storage, 1); err != nil {
+		t.Fatal(err)
+	}
+	buckets, _ := rollups.Buckets(1, DAY, baseTime, baseTime)
+	if len(buckets) != 1 || buckets[0].CTR() != 1 {
+		t.Errorf("backfilled buckets %+v", buckets)
+	}
+	if _, err := rollups.Buckets(1, Granularity(9), baseTime, baseTime); err == nil {
+		t.Error("unknown granularity accepted")
+	}
+}
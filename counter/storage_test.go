@@ -0,0 +1,426 @@
+package main
+
+import (
+	"encoding/binary"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+)
+
+// storageFactories lists every EventStorage implementation, each one has to
+// pass the conformance suite below
+func storageFactories() map[string]func(t *testing.T) EventStorage {
+	return map[string]func(t *testing.T) EventStorage{
+		"InMemoryStorage": func(t *testing.T) EventStorage {
+			return NewInMemoryStorage()
+		},
+		"FileStorage": func(t *testing.T) EventStorage {
+			s, err := NewFileStorage(t.TempDir())
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { s.Close() })
+			return s
+		},
+	}
+}
+
+func TestEventStorageConformance(t *testing.T) {
+	for name, newStorage := range storageFactories() {
+		t.Run(name, func(t *testing.T) {
+			testEventStorage(t, newStorage)
+		})
+	}
+}
+
+var baseTime = time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+func testEvent(id int64, adID int64, eventType EventType, offset time.Duration) *Event {
+	return &Event{ID: id, AdID: adID, Type: eventType, Timestamp: baseTime.Add(offset)}
+}
+
+func eventIDs(events []*Event) []int64 {
+	ids := make([]int64, len(events))
+	for i, event := range events {
+		ids[i] = event.ID
+	}
+	return ids
+}
+
+func equalIDs(a, b []int64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func testEventStorage(t *testing.T, newStorage func(t *testing.T) EventStorage) {
+	t.Run("RegisterAd", func(t *testing.T) {
+		s := newStorage(t)
+		if err := s.RegisterAd(0); err == nil {
+			t.Error("registered ad 0")
+		}
+		if s.Exists(1) {
+			t.Error("ad 1 exists before RegisterAd")
+		}
+		if err := s.RegisterAd(1); err != nil {
+			t.Fatal(err)
+		}
+		if !s.Exists(1) {
+			t.Error("ad 1 missing after RegisterAd")
+		}
+		if err := s.RegisterAd(1); err == nil {
+			t.Error("registered ad 1 twice")
+		}
+	})
+
+	t.Run("UnknownAd", func(t *testing.T) {
+		s := newStorage(t)
+		if err := s.AddEvent(7, testEvent(1, 7, IMPRESSION, 0)); err == nil {
+			t.Error("AddEvent accepted an unregistered ad")
+		}
+		if _, err := s.GetEvents(7); err == nil {
+			t.Error("GetEvents accepted an unregistered ad")
+		}
+		if _, err := s.GetEventsInRange(7, baseTime, baseTime); err == nil {
+			t.Error("GetEventsInRange accepted an unregistered ad")
+		}
+	})
+
+	t.Run("SortedAndInclusiveRange", func(t *testing.T) {
+		s := newStorage(t)
+		s.RegisterAd(1)
+		s.RegisterAd(2)
+		for _, e := range []*Event{
+			testEvent(1, 1, IMPRESSION, 3*time.Minute),
+			testEvent(2, 1, CLICK, 1*time.Minute),
+			testEvent(3, 1, IMPRESSION, 2*time.Minute),
+			testEvent(4, 2, IMPRESSION, 2*time.Minute),
+		} {
+			if err := s.AddEvent(e.AdID, e); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		events, _ := s.GetEvents(1)
+		if got := eventIDs(events); !equalIDs(got, []int64{2, 3, 1}) {
+			t.Errorf("GetEvents order %v, want [2 3 1]", got)
+		}
+		if events[0].Type != CLICK || !events[0].Timestamp.Equal(baseTime.Add(time.Minute)) {
+			t.Errorf("event came back as %+v", events[0])
+		}
+
+		events, _ = s.GetEventsInRange(1, baseTime.Add(time.Minute), baseTime.Add(2*time.Minute))
+		if got := eventIDs(events); !equalIDs(got, []int64{2, 3}) {
+			t.Errorf("inclusive range %v, want [2 3]", got)
+		}
+		events, err := s.GetEventsInRange(1, baseTime.Add(time.Hour), baseTime.Add(2*time.Hour))
+		if err != nil || len(events) != 0 {
+			t.Errorf("empty range returned %v, %v", eventIDs(events), err)
+		}
+	})
+
+	t.Run("Payload", func(t *testing.T) {
+		s := newStorage(t)
+		s.RegisterAd(1)
+		e := testEvent(1, 1, EventType(100), 0)
+		e.IngestTime = baseTime.Add(time.Minute)
+		e.Payload = map[string]interface{}{"value": 9.5, "currency": "EUR", "first": true}
+		s.AddEvent(1, e)
+
+		events, _ := s.GetEvents(1)
+		got := events[0]
+		if !got.IngestTime.Equal(e.IngestTime) || len(got.Payload) != 3 {
+			t.Fatalf("event came back as %+v", got)
+		}
+		for field, value := range e.Payload {
+			if got.Payload[field] != value {
+				t.Errorf("payload %s came back as %v, want %v", field, got.Payload[field], value)
+			}
+		}
+	})
+
+	t.Run("DeleteBefore", func(t *testing.T) {
+		s, ok := newStorage(t).(CompactableStorage)
+		if !ok {
+			t.Skip("storage does not support compaction")
+		}
+		s.RegisterAd(1)
+		s.RegisterAd(2)
+		for i := 0; i < 300; i++ {
+			s.AddEvent(1, testEvent(int64(i+1), 1, IMPRESSION, time.Duration(299-i)*time.Second))
+		}
+		if ids := s.AdIDs(); !equalIDs(ids, []int64{1, 2}) {
+			t.Errorf("AdIDs %v, want [1 2]", ids)
+		}
+
+		dropped, err := s.DeleteBefore(1, baseTime.Add(100*time.Second))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(dropped) != 100 || !dropped[0].Timestamp.Equal(baseTime) {
+			t.Fatalf("dropped %d events starting at %v, want 100 from the oldest", len(dropped), dropped[0].Timestamp)
+		}
+		events, _ := s.GetEvents(1)
+		if len(events) != 200 || !events[0].Timestamp.Equal(baseTime.Add(100*time.Second)) {
+			t.Errorf("%d events left, first at %v", len(events), events[0].Timestamp)
+		}
+		events, _ = s.GetEventsInRange(1, baseTime, baseTime.Add(150*time.Second))
+		if len(events) != 51 {
+			t.Errorf("range after compaction returned %d events, want 51", len(events))
+		}
+		if err := s.AddEvent(1, testEvent(301, 1, CLICK, time.Second)); err != nil {
+			t.Fatal(err)
+		}
+		if events, _ := s.GetEvents(1); events[0].ID != 301 {
+			t.Errorf("event added after compaction not first: %v", events[0])
+		}
+		if dropped, _ := s.DeleteBefore(2, baseTime.Add(time.Hour)); len(dropped) != 0 {
+			t.Errorf("empty ad dropped %d events", len(dropped))
+		}
+	})
+
+	t.Run("ManyOutOfOrderEvents", func(t *testing.T) {
+		s := newStorage(t)
+		s.RegisterAd(1)
+
+		// mostly ordered with some late arrivals, the way real traffic looks
+		r := rand.New(rand.NewSource(1))
+		var all []*Event
+		for i := 0; i < 1000; i++ {
+			offset := time.Duration(i) * time.Second
+			if r.Intn(10) == 0 {
+				offset -= time.Duration(r.Intn(300)) * time.Second
+			}
+			e := testEvent(int64(i+1), 1, EventType(r.Intn(2)), offset)
+			all = append(all, e)
+			if err := s.AddEvent(1, e); err != nil {
+				t.Fatal(err)
+			}
+		}
+		sort.SliceStable(all, func(i, j int) bool { return all[i].Timestamp.Before(all[j].Timestamp) })
+
+		events, _ := s.GetEvents(1)
+		if len(events) != len(all) {
+			t.Fatalf("GetEvents returned %d events, want %d", len(events), len(all))
+		}
+		for i := 1; i < len(events); i++ {
+			if events[i].Timestamp.Before(events[i-1].Timestamp) {
+				t.Fatalf("GetEvents not sorted at %d", i)
+			}
+		}
+
+		for q := 0; q < 50; q++ {
+			from := baseTime.Add(time.Duration(r.Intn(1100)-100) * time.Second)
+			to := from.Add(time.Duration(r.Intn(200)) * time.Second)
+
+			want := 0
+			for _, e := range all {
+				if !e.Timestamp.Before(from) && !e.Timestamp.After(to) {
+					want++
+				}
+			}
+			events, _ := s.GetEventsInRange(1, from, to)
+			if len(events) != want {
+				t.Fatalf("range %v - %v: %d events, want %d", from, to, len(events), want)
+			}
+		}
+	})
+
+	t.Run("Pages", func(t *testing.T) {
+		s, ok := newStorage(t).(PagedStorage)
+		if !ok {
+			t.Skip("storage does not read pages")
+		}
+		s.RegisterAd(1)
+
+		// late arrivals and runs of equal timestamps that straddle pages
+		r := rand.New(rand.NewSource(2))
+		ids := r.Perm(500)
+		var want []*Event
+		for i := 0; i < 500; i++ {
+			offset := time.Duration(i/3) * time.Second
+			if r.Intn(10) == 0 {
+				offset -= time.Duration(r.Intn(100)) * time.Second
+			}
+			e := testEvent(int64(ids[i]+1), 1, IMPRESSION, offset)
+			s.AddEvent(1, e)
+			if !e.Timestamp.Before(baseTime.Add(10*time.Second)) && !e.Timestamp.After(baseTime.Add(150*time.Second)) {
+				want = append(want, e)
+			}
+		}
+		want = firstInOrder(want, len(want))
+
+		var got []*Event
+		var after *Event
+		for {
+			page, err := s.GetEventsPage(1, baseTime.Add(10*time.Second), baseTime.Add(150*time.Second), after, 7)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, page...)
+			if len(page) < 7 {
+				break
+			}
+			after = page[len(page)-1]
+		}
+		if !equalIDs(eventIDs(got), eventIDs(want)) {
+			t.Errorf("paged %d events, want %d in timestamp, ID order", len(got), len(want))
+		}
+	})
+}
+
+func TestFileStorageReopen(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewFileStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.RegisterAd(1)
+	s.RegisterAd(2)
+	for i := 0; i < 200; i++ {
+		s.AddEvent(1, testEvent(int64(i+1), 1, IMPRESSION, time.Duration(i)*time.Second))
+	}
+	s.Close()
+
+	s, err = NewFileStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if !s.Exists(1) || !s.Exists(2) {
+		t.Fatal("registered ads lost on reopen")
+	}
+	events, _ := s.GetEventsInRange(1, baseTime.Add(100*time.Second), baseTime.Add(109*time.Second))
+	if got := eventIDs(events); len(got) != 10 || got[0] != 101 {
+		t.Errorf("range after reopen returned %v", got)
+	}
+}
+
+func TestFileStorageTruncatesTornWrite(t *testing.T) {
+	record, _ := encodeRecord(testEvent(3, 1, IMPRESSION, 2*time.Second))
+	huge := make([]byte, recordHeaderSize)
+	binary.LittleEndian.PutUint32(huge, 0xFFFFFFF0)
+
+	// a crash half way through the third record, and a garbage length that
+	// must not be allocated
+	for name, tail := range map[string][]byte{"half": record[:len(record)/2], "huge length": huge} {
+		t.Run(name, func(t *testing.T) {
+			testTornWrite(t, tail)
+		})
+	}
+}
+
+func testTornWrite(t *testing.T, tail []byte) {
+	dir := t.TempDir()
+	s, _ := NewFileStorage(dir)
+	s.RegisterAd(1)
+	s.AddEvent(1, testEvent(1, 1, IMPRESSION, 0))
+	s.AddEvent(1, testEvent(2, 1, CLICK, time.Second))
+	s.Close()
+
+	path := filepath.Join(dir, "ad-1.log")
+	f, _ := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0o644)
+	f.Write(tail)
+	f.Close()
+
+	s, err := NewFileStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	events, _ := s.GetEvents(1)
+	if got := eventIDs(events); !equalIDs(got, []int64{1, 2}) {
+		t.Fatalf("events after recovery %v, want [1 2]", got)
+	}
+	if err := s.AddEvent(1, testEvent(4, 1, IMPRESSION, 3*time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+
+	s, _ = NewFileStorage(dir)
+	defer s.Close()
+	events, _ = s.GetEvents(1)
+	if got := eventIDs(events); !equalIDs(got, []int64{1, 2, 4}) {
+		t.Errorf("events after append and reopen %v, want [1 2 4]", got)
+	}
+}
+
+func TestFileStorageCompactionSurvivesReopen(t *testing.T) {
+	dir := t.TempDir()
+	s, _ := NewFileStorage(dir)
+	s.RegisterAd(1)
+	for i := 0; i < 100; i++ {
+		s.AddEvent(1, testEvent(int64(i+1), 1, IMPRESSION, time.Duration(i)*time.Second))
+	}
+	s.DeleteBefore(1, baseTime.Add(90*time.Second))
+	s.Close()
+
+	s, err := NewFileStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	events, _ := s.GetEvents(1)
+	if got := eventIDs(events); len(got) != 10 || got[0] != 91 {
+		t.Errorf("events after compaction and reopen %v, want 91 - 100", got)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "ad-1.log.compact")); !os.IsNotExist(err) {
+		t.Errorf("compaction file left behind: %v", err)
+	}
+}
+
+func TestAdEventListChunks(t *testing.T) {
+	list := NewAdEventList(1)
+	// newest first, every insert goes to the front and splits chunks
+	for i := 0; i < 5*maxChunkSize; i++ {
+		list.insertEvent(testEvent(int64(i+1), 1, IMPRESSION, time.Duration(5*maxChunkSize-i)*time.Second))
+	}
+	// equal timestamps go before the events already there
+	list.insertEvent(testEvent(0, 1, CLICK, time.Second))
+
+	if len(list.chunks) < 5 {
+		t.Errorf("%d chunks for %d events", len(list.chunks), list.size)
+	}
+	for _, chunk := range list.chunks {
+		if len(chunk) == 0 || len(chunk) > maxChunkSize {
+			t.Fatalf("chunk of %d events", len(chunk))
+		}
+	}
+	events := list.getEvents()
+	if len(events) != list.size || events[0].ID != 0 || events[1].ID != int64(5*maxChunkSize) {
+		t.Fatalf("first events %v of %d", eventIDs(events[:2]), len(events))
+	}
+	for i := 1; i < len(events); i++ {
+		if events[i].Timestamp.Before(events[i-1].Timestamp) {
+			t.Fatalf("not sorted at %d", i)
+		}
+	}
+
+	dropped := list.dropBefore(baseTime.Add(1000 * time.Second))
+	if len(dropped) != 1000 || list.size != len(events)-1000 || len(list.getEvents()) != list.size {
+		t.Errorf("dropped %d, %d left", len(dropped), list.size)
+	}
+	if list.lastClick != nil {
+		t.Error("dropped click still tracked as the last click")
+	}
+}
+
+func BenchmarkAdEventListOutOfOrder(b *testing.B) {
+	r := rand.New(rand.NewSource(1))
+	list := NewAdEventList(1)
+	for i := 0; i < b.N; i++ {
+		offset := time.Duration(i) * time.Millisecond
+		if r.Intn(10) == 0 {
+			offset -= time.Duration(r.Intn(i+1)) * time.Millisecond
+		}
+		list.insertEvent(testEvent(int64(i), 1, IMPRESSION, offset))
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+/*
+Subscriptions - events delivered asynchronously after they are stored
+
+- every subscriber has its own buffered channel, a slow subscriber never
+  delays another one
+- when the buffer is full the BackpressurePolicy of the subscriber decides:
+    DROP_NEWEST  the new event is dropped and counted
+    DROP_OLDEST  the oldest buffered event is dropped and counted, for
+                 subscribers that only care about the latest state
+    BLOCK        AddEvent waits until the subscriber catches up or unsubscribes
+- EventHandlers still run synchronously before the subscribers are fed
+*/
+
+// BackpressurePolicy decides what happens when a subscriber's buffer is full
+type BackpressurePolicy int
+
+const (
+	DROP_NEWEST BackpressurePolicy = iota
+	DROP_OLDEST
+	BLOCK
+)
+
+// String returns the string representation of BackpressurePolicy
+func (p BackpressurePolicy) String() string {
+	switch p {
+	case DROP_NEWEST:
+		return "DROP_NEWEST"
+	case DROP_OLDEST:
+		return "DROP_OLDEST"
+	case BLOCK:
+		return "BLOCK"
+	default:
+		return "UNKNOWN"
+	}
+}
+
+// Subscription receives the stored events on C until it is unsubscribed
+type Subscription struct {
+	C       <-chan *Event
+	events  chan *Event
+	policy  BackpressurePolicy
+	done    chan struct{} // closed on Unsubscribe, releases blocked senders
+	stop    sync.Once
+	dropped atomic.Int64
+}
+
+// Dropped returns how many events were lost because the buffer was full
+func (s *Subscription) Dropped() int64 {
+	return s.dropped.Load()
+}
+
+// send delivers event according to the policy, called under subscribers.mu
+func (s *Subscription) send(event *Event) {
+	switch s.policy {
+	case BLOCK:
+		select {
+		case s.events <- event:
+		case <-s.done:
+		}
+	case DROP_OLDEST:
+		for {
+			select {
+			case s.events <- event:
+				return
+			default:
+			}
+			// make room, the consumer may have taken the oldest meanwhile
+			select {
+			case <-s.events:
+				s.dropped.Add(1)
+			default:
+			}
+		}
+	default:
+		select {
+		case s.events <- event:
+		default:
+			s.dropped.Add(1)
+		}
+	}
+}
+
+// subscribers is the set of subscriptions of a manager
+type subscribers struct {
+	subs map[*Subscription]struct{}
+	mu   sync.RWMutex
+}
+
+func newSubscribers() *subscribers {
+	return &subscribers{subs: make(map[*Subscription]struct{})}
+}
+
+func (s *subscribers) publish(event *Event) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for sub := range s.subs {
+		sub.send(event)
+	}
+}
+
+// Subscribe returns a subscription buffering up to buffer events, at least one
+func (aem *AdEventManager) Subscribe(buffer int, policy BackpressurePolicy) *Subscription {
+	buffer = max(buffer, 1)
+	events := make(chan *Event, buffer)
+	sub := &Subscription{
+		C:      events,
+		events: events,
+		policy: policy,
+		done:   make(chan struct{}),
+	}
+
+	aem.subscribers.mu.Lock()
+	defer aem.subscribers.mu.Unlock()
+	aem.subscribers.subs[sub] = struct{}{}
+	return sub
+}
+
+// Unsubscribe stops delivery and closes sub.C
+func (aem *AdEventManager) Unsubscribe(sub *Subscription) {
+	// release a BLOCK send first, it holds the read lock we are about to wait for
+	sub.stop.Do(func() { close(sub.done) })
+
+	aem.subscribers.mu.Lock()
+	defer aem.subscribers.mu.Unlock()
+	if _, exists := aem.subscribers.subs[sub]; exists {
+		delete(aem.subscribers.subs, sub)
+		close(sub.events)
+	}
+}
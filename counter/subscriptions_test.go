@@ -0,0 +1,93 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSubscriptionDelivers(t *testing.T) {
+	manager, _ := newClockedManager(WatermarkPolicy{})
+	sub := manager.Subscribe(10, DROP_NEWEST)
+	other := manager.Subscribe(10, DROP_NEWEST)
+
+	manager.AddEvent(1, IMPRESSION)
+	manager.AddEvent(2, CLICK)
+	for _, s := range []*Subscription{sub, other} {
+		first, second := <-s.C, <-s.C
+		if first.AdID != 1 || first.Type != IMPRESSION || second.AdID != 2 || second.Type != CLICK {
+			t.Errorf("received %+v and %+v", first, second)
+		}
+	}
+
+	manager.Unsubscribe(sub)
+	manager.Unsubscribe(sub)
+	if _, open := <-sub.C; open {
+		t.Error("C still open after Unsubscribe")
+	}
+	manager.AddEvent(1, IMPRESSION)
+	if e := <-other.C; e.AdID != 1 {
+		t.Errorf("remaining subscriber received %+v", e)
+	}
+}
+
+func TestBackpressureDrop(t *testing.T) {
+	manager, _ := newClockedManager(WatermarkPolicy{})
+	newest := manager.Subscribe(2, DROP_NEWEST)
+	oldest := manager.Subscribe(2, DROP_OLDEST)
+
+	for i := 0; i < 5; i++ {
+		manager.AddEvent(int64(i+1), IMPRESSION)
+	}
+	tests := []struct {
+		sub  *Subscription
+		want []int64
+	}{
+		{newest, []int64{1, 2}},
+		{oldest, []int64{4, 5}},
+	}
+	for _, tt := range tests {
+		got := []int64{(<-tt.sub.C).AdID, (<-tt.sub.C).AdID}
+		if !equalIDs(got, tt.want) || tt.sub.Dropped() != 3 {
+			t.Errorf("%s: received ads %v with %d dropped, want %v and 3", tt.sub.policy, got, tt.sub.Dropped(), tt.want)
+		}
+	}
+}
+
+func TestBackpressureBlock(t *testing.T) {
+	manager, _ := newClockedManager(WatermarkPolicy{})
+	sub := manager.Subscribe(1, BLOCK)
+
+	added := make(chan struct{})
+	go func() {
+		defer close(added)
+		for i := 0; i < 3; i++ {
+			manager.AddEvent(1, IMPRESSION)
+		}
+	}()
+
+	// the producer waits for the subscriber, nothing is dropped
+	for i := 0; i < 3; i++ {
+		select {
+		case <-sub.C:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("event %d not delivered", i)
+		}
+	}
+	<-added
+	if sub.Dropped() != 0 {
+		t.Errorf("%d events dropped under BLOCK", sub.Dropped())
+	}
+
+	// a producer blocked on a subscriber that goes away is released
+	manager.AddEvent(1, IMPRESSION)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		manager.AddEvent(1, CLICK)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	manager.Unsubscribe(sub)
+	wg.Wait()
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"errors"
+	"time"
+)
+
+/*
+Event time vs ingest time
+
+- Event.Timestamp is the event time, when the impression / click happened on
+  the client. Storage keeps events sorted by it and queries window on it.
+- Event.IngestTime is when AdEventManager received the event.
+
+Watermark = now - AllowedLateness. An event is late when it reaches the
+manager after the watermark has passed its event time, i.e.
+IngestTime - Timestamp > AllowedLateness. LateEventPolicy decides what a late
+event may change:
+- ACCEPT_LATE : stored and counted, answers for earlier windows can change
+- IGNORE_LATE : stored (GetAllEvents shows it) but skipped by queries, so an
+                answer never changes once the watermark has passed its window
+- DROP_LATE   : rejected with ErrLateEvent
+
+Queries take their clock from ManagerConfig.TimeSource through QueryContext.
+A query's own Execute, called without a manager, runs on the query's Clock.
+*/
+
+// LateEventPolicy decides what happens to events behind the watermark
+type LateEventPolicy int
+
+const (
+	ACCEPT_LATE LateEventPolicy = iota
+	IGNORE_LATE
+	DROP_LATE
+)
+
+// ErrLateEvent is returned by AddEventAt for a late event under DROP_LATE
+var ErrLateEvent = errors.New("event is behind the watermark")
+
+// WatermarkPolicy configures how late an event may arrive. The zero value
+// accepts every late event, which is the behaviour without a watermark.
+type WatermarkPolicy struct {
+	AllowedLateness time.Duration
+	Late            LateEventPolicy
+}
+
+// Watermark returns the event time before which events are late at now
+func (p WatermarkPolicy) Watermark(now time.Time) time.Time {
+	return now.Add(-p.AllowedLateness)
+}
+
+// IsLate checks if event arrived after the watermark passed its event time
+func (p WatermarkPolicy) IsLate(event *Event) bool {
+	return event.IngestTime.Sub(event.Timestamp) > p.AllowedLateness
+}
+
+// counts checks if a query should look at event
+func (p WatermarkPolicy) counts(event *Event) bool {
+	return p.Late != IGNORE_LATE || !p.IsLate(event)
+}
+
+// QueryContext is what a query needs from the manager besides storage
+type QueryContext struct {
+	Now       time.Time
+	Watermark WatermarkPolicy
+}
+
+// clockContext is the QueryContext of a query run outside a manager
+func clockContext(clock TimeSource) QueryContext {
+	if clock == nil {
+		clock = NewSystemTimeSource()
+	}
+	return QueryContext{Now: clock.Now()}
+}
+
+// ContextQueryStrategy is a QueryStrategy that uses the manager clock and
+// watermark. AdEventManager.ExecuteQuery prefers ExecuteWithContext.
+type ContextQueryStrategy interface {
+	QueryStrategy
+	ExecuteWithContext(ctx QueryContext, storage EventStorage, adID int64, params interface{}) (interface{}, error)
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newClockedManager(policy WatermarkPolicy) (*AdEventManager, *MockTimeSource) {
+	clock := NewMockTimeSource(baseTime)
+	config := DefaultConfig()
+	config.TimeSource = clock
+	config.Watermark = policy
+	return NewAdEventManagerWithConfig(config), clock
+}
+
+func TestQueryUsesTimeSource(t *testing.T) {
+	manager, clock := newClockedManager(WatermarkPolicy{})
+	manager.AddEvent(1, IMPRESSION)
+	manager.AddEvent(1, IMPRESSION)
+
+	clock.SetTime(baseTime.Add(time.Hour))
+	if found, err := manager.HasXImpressionsWithoutClick(1, 2, 1); err != nil || !found {
+		t.Errorf("an hour later: %v %v, want true", found, err)
+	}
+
+	// the impressions are out of the window two days later
+	clock.SetTime(baseTime.Add(48*time.Hour + time.Second))
+	if found, _ := manager.HasXImpressionsWithoutClick(1, 2, 2); found {
+		t.Error("impressions older than the window counted")
+	}
+	result, _ := manager.ExecuteQuery(1, &ImpressionsWithoutClickQuery{}, ImpressionsWithoutClickQueryParams{X: 2, WithinDays: 3})
+	if result != true {
+		t.Error("ExecuteQuery did not run on the manager clock")
+	}
+
+	// called without the manager a query runs on its own clock
+	query := &ImpressionsWithoutClickQuery{Clock: clock}
+	if result, _ := query.Execute(manager.config.Storage, 1, ImpressionsWithoutClickQueryParams{X: 2, WithinDays: 3}); result != true {
+		t.Error("Execute did not run on the query clock")
+	}
+}
+
+// addLateClick adds two impressions at 12:00 and 12:02 and a click that
+// happened at 12:01 but only arrives at 13:00
+func addLateClick(t *testing.T, manager *AdEventManager, clock *MockTimeSource) error {
+	t.Helper()
+
+	manager.AddEvent(1, IMPRESSION)
+	clock.SetTime(baseTime.Add(2 * time.Minute))
+	manager.AddEvent(1, IMPRESSION)
+
+	clock.SetTime(baseTime.Add(time.Hour))
+	if found, _ := manager.HasXImpressionsWithoutClick(1, 2, 1); !found {
+		t.Fatal("two impressions without a click not found before the late click")
+	}
+	return manager.AddEventAt(1, CLICK, baseTime.Add(time.Minute))
+}
+
+func TestLateEventPolicies(t *testing.T) {
+	tests := []struct {
+		late       LateEventPolicy
+		wantErr    error
+		wantEvents int
+		wantFound  bool
+	}{
+		// the late click splits the impressions, the earlier answer changes
+		{ACCEPT_LATE, nil, 3, false},
+		// the click is kept for the record but the answer stays final
+		{IGNORE_LATE, nil, 3, true},
+		{DROP_LATE, ErrLateEvent, 2, true},
+	}
+	for _, tt := range tests {
+		manager, clock := newClockedManager(WatermarkPolicy{AllowedLateness: 10 * time.Minute, Late: tt.late})
+
+		if err := addLateClick(t, manager, clock); !errors.Is(err, tt.wantErr) {
+			t.Errorf("policy %d: AddEventAt returned %v, want %v", tt.late, err, tt.wantErr)
+		}
+		events, _ := manager.GetAllEvents(1)
+		if len(events) != tt.wantEvents {
+			t.Errorf("policy %d: %d events stored, want %d", tt.late, len(events), tt.wantEvents)
+		}
+		if found, _ := manager.HasXImpressionsWithoutClick(1, 2, 1); found != tt.wantFound {
+			t.Errorf("policy %d: query answered %v, want %v", tt.late, found, tt.wantFound)
+		}
+	}
+}
+
+func TestOutOfOrderEventWithinLateness(t *testing.T) {
+	manager, clock := newClockedManager(WatermarkPolicy{AllowedLateness: 10 * time.Minute, Late: IGNORE_LATE})
+
+	manager.AddEvent(1, IMPRESSION)
+	clock.SetTime(baseTime.Add(2 * time.Minute))
+	manager.AddEvent(1, IMPRESSION)
+	// arrives out of order but inside the allowed lateness, so it counts
+	clock.SetTime(baseTime.Add(5 * time.Minute))
+	if err := manager.AddEventAt(1, CLICK, baseTime.Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+
+	events, _ := manager.GetAllEvents(1)
+	if events[1].Type != CLICK || !events[1].IngestTime.Equal(baseTime.Add(5*time.Minute)) {
+		t.Errorf("click stored as %+v, want second by event time", events[1])
+	}
+	if found, _ := manager.HasXImpressionsWithoutClick(1, 2, 1); found {
+		t.Error("click within the allowed lateness was ignored")
+	}
+	if want := baseTime.Add(-5 * time.Minute); !manager.Watermark().Equal(want) {
+		t.Errorf("watermark %s, want %s", manager.Watermark(), want)
+	}
+}
+
+func TestRollupsSkipIgnoredLateEvents(t *testing.T) {
+	for _, late := range []LateEventPolicy{ACCEPT_LATE, IGNORE_LATE} {
+		policy := WatermarkPolicy{AllowedLateness: 10 * time.Minute, Late: late}
+		manager, clock := newClockedManager(policy)
+		rollups := NewRollupStoreWithWatermark(policy)
+		manager.AddEventHandler(rollups.Handler())
+		addLateClick(t, manager, clock)
+
+		buckets, _ := rollups.Buckets(1, HOUR, baseTime, baseTime)
+		want := int64(1)
+		if late == IGNORE_LATE {
+			want = 0
+		}
+		if len(buckets) != 1 || buckets[0].Impressions != 2 || buckets[0].Clicks != want {
+			t.Errorf("policy %d: buckets %+v, want 2 impressions and %d clicks", late, buckets, want)
+		}
+	}
+}
+
+// tickingClock moves forward on every read, like a real clock between two calls
+type tickingClock struct {
+	now time.Time
+	mu  sync.Mutex
+}
+
+func (c *tickingClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(time.Nanosecond)
+	return c.now
+}
+
+func TestLiveEventsAreNeverLate(t *testing.T) {
+	for _, late := range []LateEventPolicy{IGNORE_LATE, DROP_LATE} {
+		config := DefaultConfig()
+		config.TimeSource = &tickingClock{now: baseTime}
+		config.Watermark = WatermarkPolicy{Late: late} // no lateness allowed
+		manager := NewAdEventManagerWithConfig(config)
+
+		for i := 0; i < 2; i++ {
+			if err := manager.AddEvent(1, IMPRESSION); err != nil {
+				t.Fatalf("policy %d: AddEvent returned %v", late, err)
+			}
+		}
+		if found, _ := manager.HasXImpressionsWithoutClick(1, 2, 1); !found {
+			t.Errorf("policy %d: live impressions were not counted", late)
+		}
+
+		server := httptest.NewServer(NewAPIServer(manager))
+		status := call(t, "POST", server.URL+"/ads/1/events", `{"type":"CLICK"}`, nil)
+		server.Close()
+		if status != http.StatusCreated {
+			t.Errorf("policy %d: API event without a timestamp: status %d", late, status)
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+/*
+
+Binary delta between two versions of a file
+
+- the base is indexed in deltaBlock sized blocks
+- the target is scanned byte by byte, a block found in the base is extended
+  forwards and backwards and becomes a copy, everything else is inserted
+
+format: uvarint target length, then ops
+- deltaCopy   uvarint offset, uvarint length   (bytes from the base)
+- deltaInsert uvarint length, bytes
+
+*/
+
+const deltaBlock = 16
+
+const (
+	deltaCopy byte = iota
+	deltaInsert
+)
+
+var errBadDelta = errors.New("corrupt delta")
+
+func makeDelta(base []byte, target []byte) []byte {
+	index := make(map[string]int, len(base)/deltaBlock)
+	for i := 0; i+deltaBlock <= len(base); i += deltaBlock {
+		if _, exists := index[string(base[i:i+deltaBlock])]; !exists {
+			index[string(base[i:i+deltaBlock])] = i
+		}
+	}
+
+	delta := binary.AppendUvarint(nil, uint64(len(target)))
+	insert := func(data []byte) {
+		if len(data) == 0 {
+			return
+		}
+		delta = append(delta, deltaInsert)
+		delta = binary.AppendUvarint(delta, uint64(len(data)))
+		delta = append(delta, data...)
+	}
+
+	pending := 0
+	for i := 0; i+deltaBlock <= len(target); {
+		offset, found := index[string(target[i:i+deltaBlock])]
+		if !found {
+			i++
+			continue
+		}
+
+		n := deltaBlock
+		for offset+n < len(base) && i+n < len(target) && base[offset+n] == target[i+n] {
+			n++
+		}
+		for i > pending && offset > 0 && base[offset-1] == target[i-1] {
+			i--
+			offset--
+			n++
+		}
+
+		insert(target[pending:i])
+		delta = append(delta, deltaCopy)
+		delta = binary.AppendUvarint(delta, uint64(offset))
+		delta = binary.AppendUvarint(delta, uint64(n))
+		i += n
+		pending = i
+	}
+	insert(target[pending:])
+	return delta
+}
+
+func applyDelta(base []byte, delta []byte) ([]byte, error) {
+	size, n := binary.Uvarint(delta)
+	if n <= 0 {
+		return nil, errBadDelta
+	}
+	delta = delta[n:]
+	// size is only a hint, a corrupt delta must not make us allocate it
+	target := make([]byte, 0, min(size, uint64(len(base)+len(delta))))
+
+	for len(delta) > 0 {
+		op := delta[0]
+		delta = delta[1:]
+		switch op {
+		case deltaCopy:
+			offset, n := binary.Uvarint(delta)
+			if n <= 0 {
+				return nil, errBadDelta
+			}
+			delta = delta[n:]
+			length, n := binary.Uvarint(delta)
+			if n <= 0 || offset > uint64(len(base)) || length > uint64(len(base))-offset {
+				return nil, errBadDelta
+			}
+			delta = delta[n:]
+			target = append(target, base[offset:offset+length]...)
+		case deltaInsert:
+			length, n := binary.Uvarint(delta)
+			if n <= 0 || length > uint64(len(delta)-n) {
+				return nil, errBadDelta
+			}
+			target = append(target, delta[n:n+int(length)]...)
+			delta = delta[n+int(length):]
+		default:
+			return nil, errBadDelta
+		}
+	}
+
+	if uint64(len(target)) != size {
+		return nil, errBadDelta
+	}
+	return target, nil
+}
@@ -0,0 +1,535 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+
+FileStore - the versioned file storage sketched at the bottom of main.go
+
+BlobStore layout
+- users/<user id>.json      User
+- files/<file id>.json      File record: metadata, owners (file_user) and the version chain
+- objects/<sha256>          version data, content addressed (see objects.go)
+
+- names map[name]file id, rebuilt from the records on start
+- Cache[string, File] is the read cache for file records, keyed by file id.
+  Writes go to the BlobStore first and then replace the cached record.
+
+Access
+- ADMIN can do everything on every file
+- the owner can do everything on their own file
+- other clients can view a PUBLIC file, its metadata and its version history
+
+Versions
+- every UpdateFile appends a version whose Parent is the current version
+- SwitchToPrevVersion appends a new version pointing at the old data, history
+  is never rewritten
+- the data of a version is stored as a delta from its parent, identical data
+  is stored once. DeleteFile only drops the record, GC removes the objects no
+  version points at anymore.
+
+*/
+
+// Role is what a user may do. The zero value is the least privileged role,
+// a user record without one is a client.
+type Role int
+
+const (
+	CLIENT Role = iota
+	ADMIN
+)
+
+type AccessType int
+
+const (
+	PRIVATE AccessType = iota
+	PUBLIC
+)
+
+type User struct {
+	ID        string
+	Name      string
+	CreatedAt time.Time
+	Role      Role
+}
+
+type FileMetadata struct {
+	ID         string
+	Name       string
+	Size       int64
+	CreatedAt  time.Time
+	CreatedBy  string
+	VersionNo  int
+	UpdatedAt  time.Time
+	AccessType AccessType
+}
+
+type Version struct {
+	ID        string
+	FileID    string
+	VersionNo int
+	// Parent is the version this one was made from, 0 for the first version
+	Parent int
+	// RestoredFrom is set when SwitchToPrevVersion made this version
+	RestoredFrom int
+	// Hash addresses the data in the ObjectStore
+	Hash string
+	// BlobKey is where versions written before content addressing keep their data
+	BlobKey   string `json:",omitempty"`
+	Size      int64
+	CreatedAt time.Time
+	CreatedBy string
+}
+
+type File struct {
+	ID       string
+	Metadata FileMetadata
+	Owners   []string
+	Versions []Version
+}
+
+// MetadataEdit lists the metadata to change, empty fields are left alone
+type MetadataEdit struct {
+	Name       string
+	AccessType *AccessType
+}
+
+var (
+	ErrFileNotFound     = errors.New("file not found")
+	ErrFileExists       = errors.New("a file with this name already exists")
+	ErrUserNotFound     = errors.New("user not found")
+	ErrVersionNotFound  = errors.New("version not found")
+	ErrPermissionDenied = errors.New("permission denied")
+	errEmptyName        = errors.New("name can not be empty")
+	errUnknownRole      = errors.New("unknown role")
+)
+
+type FileStore struct {
+	blobs   BlobStore
+	objects *ObjectStore
+	cache   *Cache[string, File]
+	users   map[string]User
+	names   map[string]string
+	mu      *sync.RWMutex
+}
+
+// NewFileStore opens the files and users already kept in blobs
+func NewFileStore(blobs BlobStore) (*FileStore, error) {
+	fs := &FileStore{
+		blobs:   blobs,
+		objects: NewObjectStore(blobs),
+		cache:   NewCache[string, File](),
+		users:   make(map[string]User),
+		names:   make(map[string]string),
+		mu:      &sync.RWMutex{},
+	}
+
+	userKeys, err := blobs.List("users/")
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range userKeys {
+		var user User
+		if err := fs.readJSON(key, &user); err != nil {
+			return nil, err
+		}
+		fs.users[user.ID] = user
+	}
+
+	fileKeys, err := blobs.List("files/")
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range fileKeys {
+		var file File
+		if err := fs.readJSON(key, &file); err != nil {
+			return nil, err
+		}
+		fs.names[file.Metadata.Name] = file.ID
+		fs.cache.Set(file.ID, file)
+	}
+	return fs, nil
+}
+
+func (fs *FileStore) readJSON(key string, v interface{}) error {
+	data, err := fs.blobs.Get(key)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("%s: %w", key, err)
+	}
+	return nil
+}
+
+func (fs *FileStore) writeJSON(key string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return fs.blobs.Put(key, data)
+}
+
+func newID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func fileKey(id string) string {
+	return "files/" + id + ".json"
+}
+
+// readVersion returns the data of version
+func (fs *FileStore) readVersion(version Version) ([]byte, error) {
+	if version.Hash == "" {
+		return fs.blobs.Get(version.BlobKey)
+	}
+	return fs.objects.Get(version.Hash)
+}
+
+func (fs *FileStore) AddUser(name string, role Role) (User, error) {
+	if strings.TrimSpace(name) == "" {
+		return User{}, errEmptyName
+	}
+	if role != CLIENT && role != ADMIN {
+		return User{}, errUnknownRole
+	}
+	user := User{ID: newID(), Name: name, CreatedAt: time.Now(), Role: role}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if err := fs.writeJSON("users/"+user.ID+".json", user); err != nil {
+		return User{}, err
+	}
+	fs.users[user.ID] = user
+	return user, nil
+}
+
+// file returns the record for name, fs.mu must be held
+func (fs *FileStore) file(name string) (File, error) {
+	id, exists := fs.names[name]
+	if !exists {
+		return File{}, ErrFileNotFound
+	}
+	return fs.fileByID(id)
+}
+
+func (fs *FileStore) fileByID(id string) (File, error) {
+	return fs.cache.GetOrLoad(id, func(id string) (File, error) {
+		var file File
+		err := fs.readJSON(fileKey(id), &file)
+		return file, err
+	})
+}
+
+func (fs *FileStore) saveFile(file File) error {
+	if err := fs.writeJSON(fileKey(file.ID), file); err != nil {
+		return err
+	}
+	fs.cache.Set(file.ID, file)
+	return nil
+}
+
+func (fs *FileStore) user(userID string) (User, error) {
+	user, exists := fs.users[userID]
+	if !exists {
+		return User{}, ErrUserNotFound
+	}
+	return user, nil
+}
+
+func canEdit(user User, file File) bool {
+	return user.Role == ADMIN || slices.Contains(file.Owners, user.ID)
+}
+
+func canView(user User, file File) bool {
+	return file.Metadata.AccessType == PUBLIC || canEdit(user, file)
+}
+
+// access looks up the user and the file and checks the user may use it
+func (fs *FileStore) access(name string, userID string, edit bool) (User, File, error) {
+	user, err := fs.user(userID)
+	if err != nil {
+		return User{}, File{}, err
+	}
+	file, err := fs.file(name)
+	if err != nil {
+		return User{}, File{}, err
+	}
+	if edit && !canEdit(user, file) || !edit && !canView(user, file) {
+		return User{}, File{}, ErrPermissionDenied
+	}
+	return user, file, nil
+}
+
+func (file File) version(versionNo int) (Version, bool) {
+	for _, version := range file.Versions {
+		if version.VersionNo == versionNo {
+			return version, true
+		}
+	}
+	return Version{}, false
+}
+
+// appendVersion makes v the current version. The slices of file are shared
+// with the cached record, so they are clipped before appending.
+func (file *File) appendVersion(v Version) {
+	file.Versions = append(slices.Clip(file.Versions), v)
+	file.Metadata.VersionNo = v.VersionNo
+	file.Metadata.Size = v.Size
+	file.Metadata.UpdatedAt = v.CreatedAt
+}
+
+func (fs *FileStore) CreateFile(name string, data []byte, userID string) (FileMetadata, error) {
+	if strings.TrimSpace(name) == "" {
+		return FileMetadata{}, errEmptyName
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if _, err := fs.user(userID); err != nil {
+		return FileMetadata{}, err
+	}
+	if _, exists := fs.names[name]; exists {
+		return FileMetadata{}, ErrFileExists
+	}
+
+	now := time.Now()
+	id := newID()
+	file := File{
+		ID: id,
+		Metadata: FileMetadata{
+			ID:         id,
+			Name:       name,
+			CreatedAt:  now,
+			CreatedBy:  userID,
+			AccessType: PRIVATE,
+		},
+		Owners: []string{userID},
+	}
+	hash, err := fs.objects.Put(data, "")
+	if err != nil {
+		return FileMetadata{}, err
+	}
+	file.appendVersion(Version{
+		ID:        fmt.Sprintf("%s-v1", id),
+		FileID:    id,
+		VersionNo: 1,
+		Hash:      hash,
+		Size:      int64(len(data)),
+		CreatedAt: now,
+		CreatedBy: userID,
+	})
+
+	if err := fs.saveFile(file); err != nil {
+		return FileMetadata{}, err
+	}
+	fs.names[name] = id
+	return file.Metadata, nil
+}
+
+func (fs *FileStore) UpdateFile(name string, data []byte, userID string) (FileMetadata, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	_, file, err := fs.access(name, userID, true)
+	if err != nil {
+		return FileMetadata{}, err
+	}
+
+	parent, found := file.version(file.Metadata.VersionNo)
+	if !found {
+		return FileMetadata{}, ErrVersionNotFound
+	}
+	hash, err := fs.objects.Put(data, parent.Hash)
+	if err != nil {
+		return FileMetadata{}, err
+	}
+
+	versionNo := file.Versions[len(file.Versions)-1].VersionNo + 1
+	file.appendVersion(Version{
+		ID:        fmt.Sprintf("%s-v%d", file.ID, versionNo),
+		FileID:    file.ID,
+		VersionNo: versionNo,
+		Parent:    parent.VersionNo,
+		Hash:      hash,
+		Size:      int64(len(data)),
+		CreatedAt: time.Now(),
+		CreatedBy: userID,
+	})
+	if err := fs.saveFile(file); err != nil {
+		return FileMetadata{}, err
+	}
+	return file.Metadata, nil
+}
+
+// ViewFile returns the data of the current version
+func (fs *FileStore) ViewFile(name string, userID string) ([]byte, error) {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+
+	_, file, err := fs.access(name, userID, false)
+	if err != nil {
+		return nil, err
+	}
+	version, found := file.version(file.Metadata.VersionNo)
+	if !found {
+		return nil, ErrVersionNotFound
+	}
+	return fs.readVersion(version)
+}
+
+// DeleteFile removes the record, the data can be shared with other versions
+// and is left for GC
+func (fs *FileStore) DeleteFile(name string, userID string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	_, file, err := fs.access(name, userID, true)
+	if err != nil {
+		return err
+	}
+	if err := fs.blobs.Delete(fileKey(file.ID)); err != nil {
+		return err
+	}
+	fs.cache.Delete(file.ID)
+	delete(fs.names, name)
+
+	for _, version := range file.Versions {
+		if version.BlobKey == "" {
+			continue
+		}
+		if err := fs.blobs.Delete(version.BlobKey); err != nil {
+			fmt.Println("unable to delete data of ", version.ID, " : ", err)
+		}
+	}
+	return nil
+}
+
+// GC deletes the objects no version of any file points at and returns how
+// many were removed
+func (fs *FileStore) GC() (int, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	var live []string
+	for _, id := range fs.names {
+		file, err := fs.fileByID(id)
+		if err != nil {
+			return 0, err
+		}
+		for _, version := range file.Versions {
+			if version.Hash != "" {
+				live = append(live, version.Hash)
+			}
+		}
+	}
+	return fs.objects.GC(live)
+}
+
+// ViewVersionHistory returns every version, oldest first
+func (fs *FileStore) ViewVersionHistory(name string, userID string) ([]Version, error) {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+
+	_, file, err := fs.access(name, userID, false)
+	if err != nil {
+		return nil, err
+	}
+	return slices.Clone(file.Versions), nil
+}
+
+// SwitchToPrevVersion makes the data of versionNo current again by appending
+// a version that points at it
+func (fs *FileStore) SwitchToPrevVersion(name string, versionNo int, userID string) (FileMetadata, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	_, file, err := fs.access(name, userID, true)
+	if err != nil {
+		return FileMetadata{}, err
+	}
+	prev, found := file.version(versionNo)
+	if !found {
+		return FileMetadata{}, ErrVersionNotFound
+	}
+	if versionNo == file.Metadata.VersionNo {
+		return file.Metadata, nil
+	}
+
+	next := file.Versions[len(file.Versions)-1].VersionNo + 1
+	file.appendVersion(Version{
+		ID:           fmt.Sprintf("%s-v%d", file.ID, next),
+		FileID:       file.ID,
+		VersionNo:    next,
+		Parent:       file.Metadata.VersionNo,
+		RestoredFrom: versionNo,
+		Hash:         prev.Hash,
+		BlobKey:      prev.BlobKey,
+		Size:         prev.Size,
+		CreatedAt:    time.Now(),
+		CreatedBy:    userID,
+	})
+	if err := fs.saveFile(file); err != nil {
+		return FileMetadata{}, err
+	}
+	return file.Metadata, nil
+}
+
+func (fs *FileStore) ViewMetadata(name string, userID string) (FileMetadata, error) {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+
+	_, file, err := fs.access(name, userID, false)
+	if err != nil {
+		return FileMetadata{}, err
+	}
+	return file.Metadata, nil
+}
+
+// EditMetadata renames the file and / or changes its access type
+func (fs *FileStore) EditMetadata(name string, userID string, edit MetadataEdit) (FileMetadata, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	_, file, err := fs.access(name, userID, true)
+	if err != nil {
+		return FileMetadata{}, err
+	}
+
+	rename := edit.Name != "" && edit.Name != name
+	if rename {
+		if strings.TrimSpace(edit.Name) == "" {
+			return FileMetadata{}, errEmptyName
+		}
+		if _, exists := fs.names[edit.Name]; exists {
+			return FileMetadata{}, ErrFileExists
+		}
+		file.Metadata.Name = edit.Name
+	}
+	if edit.AccessType != nil {
+		file.Metadata.AccessType = *edit.AccessType
+	}
+	file.Metadata.UpdatedAt = time.Now()
+
+	if err := fs.saveFile(file); err != nil {
+		return FileMetadata{}, err
+	}
+	if rename {
+		delete(fs.names, name)
+		fs.names[edit.Name] = file.ID
+	}
+	return file.Metadata, nil
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func newFileStore(t *testing.T, dir string) *FileStore {
+	t.Helper()
+
+	blobs, err := NewLocalBlobStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := NewFileStore(blobs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+func TestFileStoreVersions(t *testing.T) {
+	dir := t.TempDir()
+	store := newFileStore(t, dir)
+	owner, _ := store.AddUser("owner", CLIENT)
+
+	created, err := store.CreateFile("a.txt", []byte("v1"), owner.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if created.ID != store.names["a.txt"] {
+		t.Errorf("metadata id %q does not name the file", created.ID)
+	}
+	if _, err := store.CreateFile("a.txt", []byte("again"), owner.ID); !errors.Is(err, ErrFileExists) {
+		t.Errorf("duplicate CreateFile returned %v", err)
+	}
+	store.UpdateFile("a.txt", []byte("v2"), owner.ID)
+	meta, err := store.SwitchToPrevVersion("a.txt", 1, owner.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.VersionNo != 3 || meta.Size != 2 {
+		t.Errorf("switch gave version %d size %d, want 3 and 2", meta.VersionNo, meta.Size)
+	}
+	if _, err := store.SwitchToPrevVersion("a.txt", 9, owner.ID); !errors.Is(err, ErrVersionNotFound) {
+		t.Errorf("switch to a missing version returned %v", err)
+	}
+
+	// everything has to survive a restart
+	store = newFileStore(t, dir)
+	data, err := store.ViewFile("a.txt", owner.ID)
+	if err != nil || string(data) != "v1" {
+		t.Fatalf("ViewFile after restart returned %q %v, want v1", data, err)
+	}
+	history, _ := store.ViewVersionHistory("a.txt", owner.ID)
+	want := []struct{ no, parent, restored int }{{1, 0, 0}, {2, 1, 0}, {3, 2, 1}}
+	if len(history) != len(want) {
+		t.Fatalf("%d versions, want %d", len(history), len(want))
+	}
+	for i, w := range want {
+		v := history[i]
+		if v.VersionNo != w.no || v.Parent != w.parent || v.RestoredFrom != w.restored {
+			t.Errorf("version %d: got %d parent %d restored %d", i, v.VersionNo, v.Parent, v.RestoredFrom)
+		}
+	}
+
+	if err := store.DeleteFile("a.txt", owner.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.ViewFile("a.txt", owner.ID); !errors.Is(err, ErrFileNotFound) {
+		t.Errorf("ViewFile after delete returned %v", err)
+	}
+	// v1 and v3 share one object, v2 is the other
+	if removed, err := store.GC(); err != nil || removed != 2 {
+		t.Errorf("GC removed %d objects, %v, want 2", removed, err)
+	}
+	if keys, _ := store.blobs.List(""); len(keys) != 1 {
+		t.Errorf("blobs left after GC: %v, want only the user", keys)
+	}
+}
+
+func TestFileStoreAccess(t *testing.T) {
+	store := newFileStore(t, t.TempDir())
+	admin, _ := store.AddUser("admin", ADMIN)
+	owner, _ := store.AddUser("owner", CLIENT)
+	other, _ := store.AddUser("other", CLIENT)
+
+	store.CreateFile("doc", []byte("secret"), owner.ID)
+
+	if _, err := store.ViewFile("doc", other.ID); !errors.Is(err, ErrPermissionDenied) {
+		t.Errorf("other client viewed a private file: %v", err)
+	}
+	if _, err := store.ViewFile("doc", admin.ID); err != nil {
+		t.Errorf("admin could not view a private file: %v", err)
+	}
+	if _, err := store.ViewFile("doc", "nobody"); !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("unknown user returned %v", err)
+	}
+
+	public := PUBLIC
+	if _, err := store.EditMetadata("doc", other.ID, MetadataEdit{AccessType: &public}); !errors.Is(err, ErrPermissionDenied) {
+		t.Errorf("other client edited metadata: %v", err)
+	}
+	meta, err := store.EditMetadata("doc", owner.ID, MetadataEdit{Name: "readme", AccessType: &public})
+	if err != nil || meta.Name != "readme" || meta.AccessType != PUBLIC {
+		t.Fatalf("EditMetadata returned %+v %v", meta, err)
+	}
+
+	if _, err := store.ViewMetadata("doc", owner.ID); !errors.Is(err, ErrFileNotFound) {
+		t.Errorf("old name still found: %v", err)
+	}
+	if _, err := store.ViewFile("readme", other.ID); err != nil {
+		t.Errorf("other client could not view a public file: %v", err)
+	}
+	if _, err := store.UpdateFile("readme", []byte("mine"), other.ID); !errors.Is(err, ErrPermissionDenied) {
+		t.Errorf("other client updated a public file: %v", err)
+	}
+	if err := store.DeleteFile("readme", admin.ID); err != nil {
+		t.Errorf("admin could not delete: %v", err)
+	}
+}
+
+func TestRoleZeroValueIsClient(t *testing.T) {
+	var user User
+	if user.Role != CLIENT {
+		t.Errorf("zero role is %d, want CLIENT", user.Role)
+	}
+	if canEdit(User{ID: "someone"}, File{Owners: []string{"owner"}}) {
+		t.Error("a user without a role can edit other users' files")
+	}
+
+	store := newFileStore(t, t.TempDir())
+	if _, err := store.AddUser("root", Role(7)); !errors.Is(err, errUnknownRole) {
+		t.Errorf("unknown role returned %v", err)
+	}
+}
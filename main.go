@@ -4,29 +4,40 @@ import (
 	"errors"
 	"fmt"
 	_ "net/http/pprof"
+	"os"
+	"path/filepath"
+	"sync"
 )
 
 
-type Cache struct {
-	data map[string]interface{}
-	msg chan string
+type Cache[K comparable, V any] struct {
+	data  map[K]V
+	msg   chan string
+	mu    *sync.RWMutex
+	loads *loadGroup[K, V]
 }
 
-func (c *Cache) Get(key string) (interface{}, error) {
+func (c *Cache[K, V]) Get(key K) (V, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
 	val, ok := c.data[key]
 	if !ok {
-		return nil, errors.New("key is not present: GET")
+		return val, errors.New("key is not present: GET")
 	}
 
 	return val, nil
 }
 
-func (c *Cache) Set(key string , value interface{}) error {
+func (c *Cache[K, V]) Set(key K , value V) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	c.data[key] = value
 	return nil
 }
 
-func (c *Cache) Delete(key string) error {
+func (c *Cache[K, V]) Delete(key K) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	if _, exists := c.data[key]; exists {
 		delete(c.data, key)
 		return nil
@@ -35,10 +46,34 @@ func (c *Cache) Delete(key string) error {
 	return errors.New("key is not present : DELETE")
 }
 
-func NewCache() *Cache {
-	return &Cache{
-		data: make(map[string]interface{}),
+// GetOrLoad returns the cached value or fills it with loader. Concurrent
+// misses on one key share a single loader call (see singleflight.go), failed
+// loads are not cached.
+func (c *Cache[K, V]) GetOrLoad(key K, loader func(K) (V, error)) (V, error) {
+	if val, err := c.Get(key); err == nil {
+		return val, nil
+	}
+
+	val, err, _ := c.loads.Do(key, func() (V, error) {
+		// a load that finished after our Get already filled it
+		if val, err := c.Get(key); err == nil {
+			return val, nil
+		}
+		val, err := loader(key)
+		if err != nil {
+			return val, err
+		}
+		return val, c.Set(key, val)
+	})
+	return val, err
+}
+
+func NewCache[K comparable, V any]() *Cache[K, V] {
+	return &Cache[K, V]{
+		data: make(map[K]V),
 		msg: make(chan string, 500),
+		mu: &sync.RWMutex{},
+		loads: &loadGroup[K, V]{},
 	}
 }
 
@@ -47,20 +82,20 @@ func modify(nums *[]int) {
 	*nums = append(*nums, 35)
 }
 
-type Handler func(c *Cache, args ...interface{})
+type Handler func(c *Cache[string, string], args ...string)
 
-func handlerGet(c *Cache, args ...interface{})  {
-	key := args[0].(string)
+func handlerGet(c *Cache[string, string], args ...string)  {
+	key := args[0]
 	val, err := c.Get(key)
 	if err !=nil {
 		c.msg <-  err.Error()
 		return
 	}
-	c.msg <-  val.(string)
+	c.msg <-  val
 }
 
-func handlerSet(c *Cache, args ...interface{})  {
-	key := args[0].(string)
+func handlerSet(c *Cache[string, string], args ...string)  {
+	key := args[0]
 	value := args[1]
 	err := c.Set(key, value)
 	if err !=nil {
@@ -69,8 +104,8 @@ func handlerSet(c *Cache, args ...interface{})  {
 
 }
 
-func handlerDelete(c *Cache, args ...interface{})  {
-	key := args[0].(string)
+func handlerDelete(c *Cache[string, string], args ...string)  {
+	key := args[0]
 	err := c.Delete(key)
 	if err !=nil {
 	c.msg <-  err.Error()
@@ -97,11 +132,49 @@ func main() {
 	if y == REJECTED{
 		fmt.Println("you are not some")
 	}
+
+	fileStoreDemo()
+}
+
+func fileStoreDemo() {
+	blobs, err := NewLocalBlobStore(filepath.Join(os.TempDir(), "filestore"))
+	if err != nil {
+		fmt.Println("unable to open blob store : ", err)
+		return
+	}
+	store, err := NewFileStore(blobs)
+	if err != nil {
+		fmt.Println("unable to open file store : ", err)
+		return
+	}
+
+	admin, _ := store.AddUser("admin", ADMIN)
+	client, _ := store.AddUser("client", CLIENT)
+	name := "notes-" + newID() + ".txt"
+
+	store.CreateFile(name, []byte("first draft"), client.ID)
+	store.UpdateFile(name, []byte("second draft"), client.ID)
+	store.SwitchToPrevVersion(name, 1, client.ID)
+
+	data, err := store.ViewFile(name, client.ID)
+	fmt.Println(string(data), err)
+
+	history, _ := store.ViewVersionHistory(name, admin.ID)
+	for _, version := range history {
+		fmt.Println("version", version.VersionNo, "parent", version.Parent, "restored from", version.RestoredFrom, "size", version.Size)
+	}
+
+	if err := store.DeleteFile(name, admin.ID); err != nil {
+		fmt.Println("unable to delete file : ", err)
+	}
+	removed, err := store.GC()
+	fmt.Println("gc removed", removed, "objects", err)
 }
 
 
 /*
 File Storage sytem with version control and file metadata
+(implemented by FileStore in filestore.go, blobs on disk through blobstore.go)
 
 functional requirements
 1. User can create/edit/delete/view files
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+)
+
+/*
+
+ObjectStore - content addressed version data on top of a BlobStore
+
+- objects/<sha256 of the data>, identical data is stored once
+- an object is either a full snapshot or a delta from a base object
+    'F' data
+    'D' uvarint depth, base hash (64 hex chars), delta (see delta.go)
+- depth is the number of deltas to apply from the nearest snapshot, once it
+  would reach snapshotInterval the data is stored full again, so a read never
+  applies more than snapshotInterval - 1 deltas
+- a delta that is not smaller than the data is not worth it, stored full
+
+*/
+
+const (
+	snapshotInterval = 8
+	objectPrefix     = "objects/"
+	hashSize         = sha256.Size * 2
+)
+
+const (
+	objectFull  byte = 'F'
+	objectDelta byte = 'D'
+)
+
+var errBadObject = errors.New("corrupt object")
+
+type ObjectStore struct {
+	blobs BlobStore
+}
+
+func NewObjectStore(blobs BlobStore) *ObjectStore {
+	return &ObjectStore{blobs: blobs}
+}
+
+func contentHash(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// object is one decoded objects/<hash> blob
+type object struct {
+	depth int
+	base  string
+	data  []byte // the full data or the delta
+}
+
+func (s *ObjectStore) read(hash string) (object, error) {
+	payload, err := s.blobs.Get(objectPrefix + hash)
+	if err != nil {
+		return object{}, err
+	}
+	if len(payload) == 0 {
+		return object{}, errBadObject
+	}
+
+	switch payload[0] {
+	case objectFull:
+		return object{data: payload[1:]}, nil
+	case objectDelta:
+		depth, n := binary.Uvarint(payload[1:])
+		if n <= 0 || len(payload) < 1+n+hashSize {
+			return object{}, errBadObject
+		}
+		rest := payload[1+n:]
+		return object{depth: int(depth), base: string(rest[:hashSize]), data: rest[hashSize:]}, nil
+	default:
+		return object{}, errBadObject
+	}
+}
+
+// load rebuilds the data of hash and returns it with the object depth
+func (s *ObjectStore) load(hash string) ([]byte, int, error) {
+	var chain []object
+	for next := hash; ; {
+		obj, err := s.read(next)
+		if err != nil {
+			return nil, 0, fmt.Errorf("object %s: %w", next, err)
+		}
+		chain = append(chain, obj)
+		if obj.base == "" {
+			break
+		}
+		if len(chain) > snapshotInterval {
+			return nil, 0, fmt.Errorf("object %s: delta chain too long", hash)
+		}
+		next = obj.base
+	}
+
+	data := chain[len(chain)-1].data
+	for i := len(chain) - 2; i >= 0; i-- {
+		var err error
+		if data, err = applyDelta(data, chain[i].data); err != nil {
+			return nil, 0, fmt.Errorf("object %s: %w", hash, err)
+		}
+	}
+	if contentHash(data) != hash {
+		return nil, 0, fmt.Errorf("object %s: %w", hash, errBadObject)
+	}
+	return data, chain[0].depth, nil
+}
+
+func (s *ObjectStore) Get(hash string) ([]byte, error) {
+	data, _, err := s.load(hash)
+	return data, err
+}
+
+func (s *ObjectStore) exists(hash string) (bool, error) {
+	return s.blobs.Has(objectPrefix + hash)
+}
+
+// Put stores data and returns its hash. base is the hash of the data it was
+// derived from, "" stores a snapshot.
+func (s *ObjectStore) Put(data []byte, base string) (string, error) {
+	hash := contentHash(data)
+	if exists, err := s.exists(hash); err != nil || exists {
+		return hash, err
+	}
+
+	payload := append([]byte{objectFull}, data...)
+	if base != "" && base != hash {
+		baseData, depth, err := s.load(base)
+		if err != nil {
+			return "", err
+		}
+		if depth+1 < snapshotInterval {
+			delta := makeDelta(baseData, data)
+			if len(delta) < len(data) {
+				payload = binary.AppendUvarint([]byte{objectDelta}, uint64(depth+1))
+				payload = append(payload, base...)
+				payload = append(payload, delta...)
+			}
+		}
+	}
+
+	if err := s.blobs.Put(objectPrefix+hash, payload); err != nil {
+		return "", err
+	}
+	return hash, nil
+}
+
+// GC deletes every object that live does not reach. live holds the hashes
+// versions point at, the delta bases they need are kept as well.
+func (s *ObjectStore) GC(live []string) (int, error) {
+	marked := make(map[string]bool)
+	for _, hash := range live {
+		for next := hash; next != "" && !marked[next]; {
+			marked[next] = true
+			obj, err := s.read(next)
+			if err != nil {
+				return 0, fmt.Errorf("object %s: %w", next, err)
+			}
+			next = obj.base
+		}
+	}
+
+	keys, err := s.blobs.List(objectPrefix)
+	if err != nil {
+		return 0, err
+	}
+	removed := 0
+	for _, key := range keys {
+		if marked[key[len(objectPrefix):]] {
+			continue
+		}
+		if err := s.blobs.Delete(key); err != nil {
+			return removed, err
+		}
+		removed++
+	}
+	return removed, nil
+}
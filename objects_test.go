@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+func TestDeltaRoundTrip(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	random := func(n int) []byte {
+		b := make([]byte, n)
+		r.Read(b)
+		return b
+	}
+	base := random(4096)
+
+	edited := append([]byte("header "), base[:1000]...)
+	edited = append(edited, random(50)...)
+	edited = append(edited, base[2000:]...)
+
+	cases := map[string][]byte{
+		"empty":     {},
+		"same":      base,
+		"edited":    edited,
+		"unrelated": random(300),
+		"repeated":  bytes.Repeat(base[:64], 10),
+		"short":     []byte("tiny"),
+	}
+	for name, target := range cases {
+		delta := makeDelta(base, target)
+		got, err := applyDelta(base, delta)
+		if err != nil || !bytes.Equal(got, target) {
+			t.Errorf("%s: round trip failed, %v", name, err)
+		}
+	}
+
+	if delta := makeDelta(base, edited); len(delta) > 200 {
+		t.Errorf("delta of a small edit is %d bytes", len(delta))
+	}
+	if _, err := applyDelta(base, []byte{5, deltaCopy, 0, 100}); err == nil {
+		t.Error("applied a delta with the wrong length")
+	}
+}
+
+func countObjects(t *testing.T, blobs BlobStore) (snapshots int, deltas int) {
+	t.Helper()
+
+	keys, err := blobs.List(objectPrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range keys {
+		payload, _ := blobs.Get(key)
+		if payload[0] == objectDelta {
+			deltas++
+		} else {
+			snapshots++
+		}
+	}
+	return snapshots, deltas
+}
+
+func TestObjectStoreDeltaChain(t *testing.T) {
+	blobs, err := NewLocalBlobStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	objects := NewObjectStore(blobs)
+
+	doc := strings.Repeat("a line of a long document\n", 200)
+	var hashes []string
+	base := ""
+	for i := 0; i < 2*snapshotInterval; i++ {
+		doc += "one more line\n"
+		hash, err := objects.Put([]byte(doc), base)
+		if err != nil {
+			t.Fatal(err)
+		}
+		hashes = append(hashes, hash)
+		base = hash
+	}
+
+	if snapshots, deltas := countObjects(t, blobs); snapshots != 2 || deltas != 2*snapshotInterval-2 {
+		t.Errorf("%d snapshots and %d deltas, want 2 and %d", snapshots, deltas, 2*snapshotInterval-2)
+	}
+	if data, err := objects.Get(hashes[len(hashes)-1]); err != nil || string(data) != doc {
+		t.Fatalf("last version did not come back, %v", err)
+	}
+
+	// storing the same data again is free
+	if hash, _ := objects.Put([]byte(doc), ""); hash != hashes[len(hashes)-1] {
+		t.Error("identical data got another hash")
+	}
+	if keys, _ := blobs.List(objectPrefix); len(keys) != 2*snapshotInterval {
+		t.Errorf("%d objects after storing a duplicate", len(keys))
+	}
+
+	// keeping the last version keeps the deltas it is built from
+	removed, err := objects.GC(hashes[len(hashes)-1:])
+	if err != nil || removed != snapshotInterval {
+		t.Errorf("GC removed %d, %v, want %d", removed, err, snapshotInterval)
+	}
+	if data, err := objects.Get(hashes[len(hashes)-1]); err != nil || string(data) != doc {
+		t.Errorf("last version lost by GC, %v", err)
+	}
+}
+
+// countingBlobs counts the blobs read through Get
+type countingBlobs struct {
+	*LocalBlobStore
+	gets int
+}
+
+func (b *countingBlobs) Get(key string) ([]byte, error) {
+	b.gets++
+	return b.LocalBlobStore.Get(key)
+}
+
+func TestObjectStorePutExistingDoesNotRead(t *testing.T) {
+	local, err := NewLocalBlobStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	blobs := &countingBlobs{LocalBlobStore: local}
+	objects := NewObjectStore(blobs)
+
+	data := bytes.Repeat([]byte("large version "), 1000)
+	hash, err := objects.Put(data, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, err := objects.Put(data, ""); err != nil || again != hash {
+		t.Fatalf("second Put = %s %v, want %s", again, err, hash)
+	}
+	if blobs.gets != 0 {
+		t.Errorf("storing existing data read %d blobs", blobs.gets)
+	}
+
+	for key, want := range map[string]bool{
+		objectPrefix + hash:                   true,
+		objectPrefix + "none":                 false,
+		strings.TrimSuffix(objectPrefix, "/"): false, // a directory, not a blob
+	} {
+		if has, err := blobs.Has(key); err != nil || has != want {
+			t.Errorf("Has(%q) = %v %v, want %v", key, has, err, want)
+		}
+	}
+	if _, err := blobs.Has("../escape"); err == nil {
+		t.Error("Has accepted a key outside the store")
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newTestUser(id int) *User {
+	return &User{id: id, limits: map[int]int{}, mu: &sync.Mutex{}}
+}
+
+// allowedOf counts how many of n requests of user on routeId algo allows
+func allowedOf(algo Algo, user *User, routeId int, n int) int {
+	allowed := 0
+	for i := 0; i < n; i++ {
+		if algo.Evaluate(user, routeId) {
+			allowed++
+		}
+	}
+	return allowed
+}
+
+func TestBucketBurstAndContinuousRefill(t *testing.T) {
+	clock := newFakeClock()
+	algo := NewBucketAlgo(2, 4, clock.Now)
+	user := newTestUser(1)
+
+	if got := allowedOf(algo, user, 1, 10); got != 4 {
+		t.Fatalf("burst allowed %d, want 4", got)
+	}
+	// 2 tokens per second, half a second earns one
+	clock.Advance(500 * time.Millisecond)
+	if got := allowedOf(algo, user, 1, 3); got != 1 {
+		t.Errorf("after 500ms allowed %d, want 1", got)
+	}
+	clock.Advance(250 * time.Millisecond)
+	if got := allowedOf(algo, user, 1, 3); got != 0 {
+		t.Errorf("after 250ms allowed %d, want 0", got)
+	}
+	clock.Advance(250 * time.Millisecond)
+	if got := allowedOf(algo, user, 1, 3); got != 1 {
+		t.Errorf("fractions did not add up to a token, allowed %d", got)
+	}
+
+	// a long pause refills to the burst, not beyond
+	clock.Advance(time.Hour)
+	if got := allowedOf(algo, user, 1, 10); got != 4 {
+		t.Errorf("after an hour allowed %d, want the burst of 4", got)
+	}
+}
+
+func TestBucketLimitsPerRouteAndUser(t *testing.T) {
+	clock := newFakeClock()
+	algo := NewBucketAlgo(1, 2, clock.Now)
+	algo.SetRouteLimit(2, 1, 5)
+	algo.SetUserLimit(9, 2, 1, 1)
+	user, vip := newTestUser(1), newTestUser(9)
+
+	tests := []struct {
+		user    *User
+		routeId int
+		want    int
+	}{
+		{user, 1, 2}, // default
+		{user, 2, 5}, // route limit
+		{vip, 2, 1},  // user limit wins over the route limit
+		{vip, 1, 2},  // user limit is for route 2 only
+	}
+	for _, tt := range tests {
+		if got := allowedOf(algo, tt.user, tt.routeId, 10); got != tt.want {
+			t.Errorf("user %d route %d: allowed %d, want %d", tt.user.id, tt.routeId, got, tt.want)
+		}
+	}
+
+	// lowering the burst caps the tokens already in the bucket
+	clock.Advance(time.Hour)
+	algo.SetRouteLimit(2, 1, 3)
+	if got := allowedOf(algo, user, 2, 10); got != 3 {
+		t.Errorf("after lowering the burst allowed %d, want 3", got)
+	}
+
+	// a limit that never refills or admits nothing is rejected, the old one stays
+	for _, bad := range []struct {
+		rate  float64
+		burst int
+	}{{0, 3}, {-1, 3}, {1, 0}, {1, -2}} {
+		if err := algo.SetRouteLimit(2, bad.rate, bad.burst); err == nil {
+			t.Errorf("route limit rate %v burst %d accepted", bad.rate, bad.burst)
+		}
+		if err := algo.SetUserLimit(9, 2, bad.rate, bad.burst); err == nil {
+			t.Errorf("user limit rate %v burst %d accepted", bad.rate, bad.burst)
+		}
+	}
+	clock.Advance(time.Hour)
+	if got := allowedOf(algo, user, 2, 10); got != 3 {
+		t.Errorf("after rejected limits allowed %d, want 3", got)
+	}
+}
+
+func TestBucketSweepKeepsBehaviour(t *testing.T) {
+	clock := newFakeClock()
+	algo := NewBucketAlgo(1, 2, clock.Now)
+	for id := 1; id <= sweepEvery; id++ {
+		algo.Evaluate(newTestUser(id), 1)
+	}
+	clock.Advance(time.Hour)
+	// the next sweep runs within these, the user on route 2 stays drained
+	user := newTestUser(sweepEvery + 1)
+	if got := allowedOf(algo, user, 2, sweepEvery); got != 2 {
+		t.Errorf("allowed %d, want the burst of 2", got)
+	}
+	if n := len(algo.buckets); n != 1 {
+		t.Errorf("%d buckets left after the sweep, want only the drained one", n)
+	}
+}
+
+// run with -race: requests, new users and limit changes all at once
+func TestBucketConcurrentRateLimiter(t *testing.T) {
+	clock := newFakeClock()
+	algo := NewBucketAlgo(1, 50, clock.Now)
+	rl := NewRateLimiter(algo)
+	route := rl.AddARoute(Route{id: 1, name: "search", endpoint: "/search", method: "GET"})
+	user := rl.AddAUser(User{id: 1})
+
+	var allowed atomic.Int64
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 25; j++ {
+				if rl.UserRequest(user.id, route.id) == nil {
+					allowed.Add(1)
+				}
+			}
+			rl.AddAUser(User{id: 100 + i})
+			rl.ChangeTheLimit(user.id, route.id, 10)
+			algo.SetUserLimit(100+i, route.id, 2, 4)
+		}(i)
+	}
+	wg.Wait()
+
+	if got := allowed.Load(); got != 50 {
+		t.Errorf("%d of 200 requests allowed, want the burst of 50", got)
+	}
+}
@@ -16,17 +16,20 @@ initalize
 evaluate
 initalizeGoRoutine
 
-type BucketAlgo struct
-	- bucketSize
-	- tokenRate
-	- numberOfToken
-	-
+type BucketAlgo struct - lazy token bucket per (user, route)
+	- rate, burst: default, per route, per user and route
+	- tokens and last refill per bucket, refilled on Evaluate
 
 
 
 
-type SlidingAlgo struct
-	- duration
+type SlidingLogAlgo struct - timestamps of the last `limit` requests per (user, route)
+	- window, limit, clock
+type SlidingCounterAlgo struct - this and the previous fixed window per (user, route)
+	- window, limit, clock
+	- estimate = previous * (part of the previous window still covered) + current
+
+type StoreAlgo struct - counters in a Store shared by replicas, see store.go
 
 Route - struct
 id
@@ -44,8 +47,7 @@ type Request struct
 
 User - struct
 	- id
-	- map[route]limit
-	- map[route]requestLeft
+	- map[route]limit, set by ChangeTheLimit, else the algo's limit
 	- mutex
 RateLimiter - struct
 - Algo
@@ -57,35 +59,55 @@ RateLimiter - struct
 
 AddARoute()
 
+Middleware - net/http handler in front of the routes, see middleware.go
+
+type PolicyAlgo struct - routes, tiers and limits from a policy file, see policy.go
+
 */
 
 const STATIC_LIMIT = 3
 
+// AddARoute adds route, a route without an id gets a random one
 func (rl *RateLimiter) AddARoute(route Route) Route {
-	route.id = generateRandomNumber()
+	if route.id == 0 {
+		route.id = generateRandomNumber()
+	}
 
 	fmt.Println("new route is added ", route.id)
+	rl.mu.Lock()
 	rl.routes[route.id] = route
+	rl.routesVersion++
+	rl.mu.Unlock()
 
 	return route
 }
 
 func (rl *RateLimiter) ChangeTheLimit(userId int, routeId int, limit int) {
-	rl.users[userId].limits[routeId] = limit
+	rl.mu.Lock()
+	user, exists := rl.users[userId]
+	rl.mu.Unlock()
+	if !exists {
+		fmt.Println("userId is invalid ", userId)
+		return
+	}
+
+	user.mu.Lock()
+	user.limits[routeId] = limit
+	user.mu.Unlock()
 	fmt.Println("Limit for userId ", userId, " is changed to ", limit, " for routeId", routeId)
 }
 
+// AddAUser adds user, a user without an id gets a random one. Replicas
+// sharing a Store have to agree on the ids.
 func (rl *RateLimiter) AddAUser(user User) *User {
-	user.id = generateRandomNumber()
+	if user.id == 0 {
+		user.id = generateRandomNumber()
+	}
 	user.limits = make(map[int]int)
-	user.requestLeft = make(map[int]int)
 	user.mu = &sync.Mutex{}
-	for k := range rl.routes {
-		if _, exists := user.limits[k]; !exists {
-			user.limits[k] = STATIC_LIMIT
-		}
-		user.requestLeft[k] = user.limits[k]
-	}
+
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
 	fmt.Println("new User is added ", user.id)
 	rl.users[user.id] = &user
 
@@ -93,30 +115,52 @@ func (rl *RateLimiter) AddAUser(user User) *User {
 }
 
 func (rl *RateLimiter) UserRequest(userId int, routeId int) error {
-	user, exists := rl.users[userId]
-	if !exists {
-		return errors.New("userId is invalid")
-	}
-
-	_, exists = rl.routes[routeId]
-	if !exists {
-		return errors.New("routeId is invalid")
+	decision, err := rl.Decide(userId, routeId)
+	if err != nil {
+		return err
 	}
 
-	if rl.algo.Evaluate(user, routeId) == false {
+	if decision.Allowed == false {
 		fmt.Println("request is throttled")
-		return errors.New("Request is throttled, please try again after some time")
+		return ErrThrottled
 	}
 
 	//forward the request
+	fmt.Println("Forward the Request ", routeId, " for User ", userId)
 	return nil
 }
 
+var ErrThrottled = errors.New("Request is throttled, please try again after some time")
+
+// Decide evaluates one request of userId on routeId with the algo, algos
+// that are not a Decider only say whether it is allowed
+func (rl *RateLimiter) Decide(userId int, routeId int) (Decision, error) {
+	rl.mu.Lock()
+	user, userExists := rl.users[userId]
+	_, routeExists := rl.routes[routeId]
+	rl.mu.Unlock()
+
+	if !userExists {
+		if user, userExists = rl.addDefaultTierUser(userId); !userExists {
+			return Decision{}, errors.New("userId is invalid")
+		}
+	}
+	if !routeExists {
+		return Decision{}, errors.New("routeId is invalid")
+	}
+
+	if decider, ok := rl.algo.(Decider); ok {
+		return decider.Decide(user, routeId), nil
+	}
+	return Decision{Allowed: rl.algo.Evaluate(user, routeId)}, nil
+}
+
 type RateLimiter struct {
-	algo   Algo
-	users  map[int]*User
-	routes map[int]Route
-	mu     *sync.Mutex
+	algo          Algo
+	users         map[int]*User
+	routes        map[int]Route
+	routesVersion int // bumped on every route change, see Middleware
+	mu            *sync.Mutex
 }
 
 func NewRateLimiter(algo Algo) *RateLimiter {
@@ -126,7 +170,10 @@ func NewRateLimiter(algo Algo) *RateLimiter {
 	rl.routes = make(map[int]Route)
 	rl.mu = &sync.Mutex{}
 
-	go rl.intializeTheLimitUpdate()
+	// algos that refill lazily have no duration and need no update loop
+	if algo.getDuration() > 0 {
+		go rl.intializeTheLimitUpdate()
+	}
 
 	return &rl
 }
@@ -134,7 +181,15 @@ func NewRateLimiter(algo Algo) *RateLimiter {
 func (rl *RateLimiter) intializeTheLimitUpdate() {
 
 	for {
-		rl.algo.updateTheLimits(rl.users)
+		// the algo gets a copy, users can be added meanwhile
+		rl.mu.Lock()
+		users := make(map[int]*User, len(rl.users))
+		for id, user := range rl.users {
+			users[id] = user
+		}
+		rl.mu.Unlock()
+
+		rl.algo.updateTheLimits(users)
 		time.Sleep(rl.algo.getDuration())
 	}
 
@@ -153,6 +208,18 @@ func (q *Queue) Enqueue(value Request) {
 	q.items.PushBack(value)
 }
 
+// Front returns the oldest item without removing it
+func (q *Queue) Front() (Request, bool) {
+	if q.items.Len() == 0 {
+		return Request{}, false
+	}
+	return q.items.Front().Value.(Request), true
+}
+
+func (q *Queue) Len() int {
+	return q.items.Len()
+}
+
 // Dequeue (Pop from the front)
 func (q *Queue) Dequeue() (Request, bool) {
 	if q.items.Len() == 0 {
@@ -185,166 +252,449 @@ type Algo interface {
 	updateTheLimits(users map[int]*User)
 }
 
+// Decision is the outcome of one request with what a client needs to back off
+type Decision struct {
+	Allowed    bool
+	Limit      int
+	Remaining  int
+	Reset      time.Time     // when the limit is fully available again
+	RetryAfter time.Duration // when a throttled request can succeed, 0 if allowed
+}
+
+// Decider is an Algo that explains its decisions, Evaluate is Decide(...).Allowed
+type Decider interface {
+	Decide(user *User, routeId int) Decision
+}
+
+func seconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
+
+// BucketAlgo is a token bucket per (user, route). Tokens are not refilled by
+// a loop, each Evaluate adds rate * elapsed time to the bucket, capped at burst.
 type BucketAlgo struct {
-	duration      time.Duration
-	numberOfToken int
+	defaultLimit bucketLimit
+	routeLimits  map[int]bucketLimit
+	userLimits   map[bucketKey]bucketLimit
+	buckets      map[bucketKey]*tokenBucket
+	evaluations  int
+	clock        Clock
+	mu           *sync.Mutex
+}
+
+type bucketLimit struct {
+	rate  float64 // tokens per second
+	burst int
+}
+
+type bucketKey struct {
+	userId  int
+	routeId int
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func NewBucketAlgo(rate float64, burst int, clock Clock) *BucketAlgo {
+	ba := &BucketAlgo{
+		defaultLimit: bucketLimit{rate: rate, burst: burst},
+		clock:        clock,
+	}
+	ba.Initalize()
+	return ba
+}
+
+// Initalize fills in what is not set, 1 token per second with a burst of STATIC_LIMIT
+func (ba *BucketAlgo) Initalize() {
+	if ba.defaultLimit.rate <= 0 {
+		ba.defaultLimit.rate = 1
+	}
+	if ba.defaultLimit.burst <= 0 {
+		ba.defaultLimit.burst = STATIC_LIMIT
+	}
+	if ba.clock == nil {
+		ba.clock = time.Now
+	}
+	ba.routeLimits = make(map[int]bucketLimit)
+	ba.userLimits = make(map[bucketKey]bucketLimit)
+	ba.buckets = make(map[bucketKey]*tokenBucket)
+	ba.mu = &sync.Mutex{}
+}
+
+// SetRouteLimit sets rate and burst for every user of routeId
+func (ba *BucketAlgo) SetRouteLimit(routeId int, rate float64, burst int) error {
+	limit, err := newBucketLimit(rate, burst)
+	if err != nil {
+		return err
+	}
+	ba.mu.Lock()
+	defer ba.mu.Unlock()
+	ba.routeLimits[routeId] = limit
+	return nil
+}
+
+// SetUserLimit sets rate and burst of userId on routeId, it wins over the route limit
+func (ba *BucketAlgo) SetUserLimit(userId int, routeId int, rate float64, burst int) error {
+	limit, err := newBucketLimit(rate, burst)
+	if err != nil {
+		return err
+	}
+	ba.mu.Lock()
+	defer ba.mu.Unlock()
+	ba.userLimits[bucketKey{userId: userId, routeId: routeId}] = limit
+	return nil
+}
+
+var errBadBucketLimit = errors.New("token bucket needs a positive rate and burst")
+
+// newBucketLimit rejects what would never refill or never admit a request
+func newBucketLimit(rate float64, burst int) (bucketLimit, error) {
+	if rate <= 0 || burst <= 0 {
+		return bucketLimit{}, errBadBucketLimit
+	}
+	return bucketLimit{rate: rate, burst: burst}, nil
+}
+
+// limit returns the limit of key, ba.mu must be held
+func (ba *BucketAlgo) limit(key bucketKey) bucketLimit {
+	if limit, exists := ba.userLimits[key]; exists {
+		return limit
+	}
+	if limit, exists := ba.routeLimits[key.routeId]; exists {
+		return limit
+	}
+	return ba.defaultLimit
 }
 
-func (ba *BucketAlgo) Initalize(tokenDuration time.Duration, numberOfToken int) {
-	ba.numberOfToken = numberOfToken
-	ba.duration = tokenDuration
+// refill adds the tokens earned since the last refill
+func (b *tokenBucket) refill(limit bucketLimit, now time.Time) {
+	if elapsed := now.Sub(b.last).Seconds(); elapsed > 0 {
+		b.tokens += elapsed * limit.rate
+	}
+	// a lowered burst applies right away
+	b.tokens = min(b.tokens, float64(limit.burst))
+	b.last = now
 }
 
 func (ba *BucketAlgo) Evaluate(user *User, routeId int) bool {
-	user.mu.Lock()
-	defer user.mu.Unlock()
+	return ba.Decide(user, routeId).Allowed
+}
+
+func (ba *BucketAlgo) Decide(user *User, routeId int) Decision {
+	ba.mu.Lock()
+	defer ba.mu.Unlock()
+
+	now := ba.clock()
+	ba.sweep(now)
 
-	_, exists := user.limits[routeId]
+	key := bucketKey{userId: user.id, routeId: routeId}
+	limit := ba.limit(key)
+	bucket, exists := ba.buckets[key]
 	if !exists {
-		user.requestLeft[routeId] = STATIC_LIMIT
-		user.limits[routeId] = STATIC_LIMIT
+		bucket = &tokenBucket{tokens: float64(limit.burst), last: now}
+		ba.buckets[key] = bucket
 	}
+	bucket.refill(limit, now)
+
+	decision := Decision{Limit: limit.burst}
+	if bucket.tokens >= 1 {
+		bucket.tokens--
+		decision.Allowed = true
+	} else {
+		decision.RetryAfter = seconds((1 - bucket.tokens) / limit.rate)
+	}
+	decision.Remaining = int(bucket.tokens)
+	decision.Reset = now.Add(seconds((float64(limit.burst) - bucket.tokens) / limit.rate))
+	return decision
+}
 
-	if user.requestLeft[routeId] > 0 {
-		user.requestLeft[routeId]--
-		fmt.Println("Forward the Request ", routeId, " for User ", user.id)
-		return true
+// sweepEvery evaluations the buckets that are full again are dropped, a new
+// bucket starts full so nothing changes for their users. ba.mu must be held.
+func (ba *BucketAlgo) sweep(now time.Time) {
+	ba.evaluations++
+	if ba.evaluations%sweepEvery != 0 {
+		return
+	}
+	for key, bucket := range ba.buckets {
+		limit := ba.limit(key)
+		if bucket.tokens+now.Sub(bucket.last).Seconds()*limit.rate >= float64(limit.burst) {
+			delete(ba.buckets, key)
+		}
 	}
-	return false
 }
 
+// refill is lazy, there is no update loop
 func (ba *BucketAlgo) getDuration() time.Duration {
-	return ba.duration
+	return 0
 }
 
-func (ba *BucketAlgo) updateTheLimits(users map[int]*User) {
-	fmt.Println("updating the token for users")
-	for k := range users {
-		for kk := range users[k].requestLeft {
-			users[k].requestLeft[kk] = min(users[k].limits[kk], users[k].requestLeft[kk]+ba.numberOfToken)
-		}
+func (ba *BucketAlgo) updateTheLimits(users map[int]*User) {}
+
+// limitOf returns the user's limit for routeId, fallback if ChangeTheLimit never set one
+func limitOf(user *User, routeId int, fallback int) int {
+	user.mu.Lock()
+	defer user.mu.Unlock()
+	if limit, exists := user.limits[routeId]; exists {
+		return limit
 	}
-	fmt.Println("updated the token for users")
+	return fallback
 }
 
-type SlidingAlgo struct {
-	duration    time.Duration
+// SlidingLogAlgo allows limit requests per (user, route) in any window long
+// period. It keeps the time of every allowed request still in the window.
+type SlidingLogAlgo struct {
 	window      time.Duration
-	requestTime *Queue
+	limit       int
+	logs        map[bucketKey]*Queue
+	evaluations int
+	clock       Clock
+	mu          *sync.Mutex
 }
 
-func (sa *SlidingAlgo) Initalize() {
-	sa.duration = 1*time.Second
-	sa.window = 1* time.Second
-	sa.requestTime = NewQueue()
+func NewSlidingLogAlgo(window time.Duration, limit int, clock Clock) *SlidingLogAlgo {
+	sa := &SlidingLogAlgo{window: window, limit: limit, clock: clock}
+	sa.Initalize()
+	return sa
 }
 
-func (sa *SlidingAlgo) getDuration() time.Duration {
-	return sa.duration
+// Initalize fills in what is not set, STATIC_LIMIT requests per second
+func (sa *SlidingLogAlgo) Initalize() {
+	if sa.window <= 0 {
+		sa.window = 1 * time.Second
+	}
+	if sa.limit <= 0 {
+		sa.limit = STATIC_LIMIT
+	}
+	if sa.clock == nil {
+		sa.clock = time.Now
+	}
+	sa.logs = make(map[bucketKey]*Queue)
+	sa.mu = &sync.Mutex{}
 }
 
-func (sa *SlidingAlgo) Evaluate(user *User, routeId int) bool {
-	user.mu.Lock()
-	defer user.mu.Unlock()
+// expire drops the requests that left the window, the window is (now-window, now]
+func (sa *SlidingLogAlgo) expire(log *Queue, now time.Time) {
+	for {
+		request, ok := log.Front()
+		if !ok || request.requestTime.After(now.Add(-sa.window)) {
+			return
+		}
+		log.Dequeue()
+	}
+}
 
-	request := Request{
-		id:          generateRandomNumber(),
-		userId:      user.id,
-		routeId:     routeId,
-		requestTime: time.Now(),
-		isThrottled: true,
+func (sa *SlidingLogAlgo) Evaluate(user *User, routeId int) bool {
+	return sa.Decide(user, routeId).Allowed
+}
+
+func (sa *SlidingLogAlgo) Decide(user *User, routeId int) Decision {
+	limit := limitOf(user, routeId, sa.limit)
+
+	sa.mu.Lock()
+	defer sa.mu.Unlock()
+
+	now := sa.clock()
+	sa.evaluations++
+	if sa.evaluations%sweepEvery == 0 {
+		for key, log := range sa.logs {
+			if sa.expire(log, now); log.Len() == 0 {
+				delete(sa.logs, key)
+			}
+		}
 	}
 
-	_, exists := user.limits[routeId]
+	key := bucketKey{userId: user.id, routeId: routeId}
+	log, exists := sa.logs[key]
 	if !exists {
-		user.requestLeft[routeId] = STATIC_LIMIT
-		user.limits[routeId] = STATIC_LIMIT
+		log = NewQueue()
+		sa.logs[key] = log
 	}
+	sa.expire(log, now)
+
+	// throttled requests are not logged, they do not push the window out
+	decision := Decision{Limit: limit}
+	if log.Len() < limit {
+		log.Enqueue(Request{
+			id:          generateRandomNumber(),
+			userId:      user.id,
+			routeId:     routeId,
+			requestTime: now,
+		})
+		decision.Allowed = true
+	}
+	decision.Remaining = max(limit-log.Len(), 0)
 
-	if user.requestLeft[routeId] > 0 {
-		request.isThrottled = false
-		sa.requestTime.Enqueue(request)
-		user.requestLeft[routeId]--
+	// the oldest request leaving the window frees the next slot
+	decision.Reset = now
+	if oldest, ok := log.Front(); ok {
+		decision.Reset = oldest.requestTime.Add(sa.window)
+	}
+	if !decision.Allowed {
+		decision.RetryAfter = decision.Reset.Sub(now)
+		if limit <= 0 {
+			decision.RetryAfter = sa.window
+		}
+	}
+	return decision
+}
+
+func (sa *SlidingLogAlgo) getDuration() time.Duration {
+	return 0
+}
+
+func (sa *SlidingLogAlgo) updateTheLimits(users map[int]*User) {}
+
+// SlidingCounterAlgo approximates the sliding window with two counters per
+// (user, route), the current fixed window and the one before. The previous
+// count is weighted by how much of the sliding window still overlaps it.
+type SlidingCounterAlgo struct {
+	window      time.Duration
+	limit       int
+	counters    map[bucketKey]*windowCounter
+	evaluations int
+	clock       Clock
+	mu          *sync.Mutex
+}
+
+type windowCounter struct {
+	start    time.Time // start of the current fixed window
+	current  int
+	previous int
+}
+
+func NewSlidingCounterAlgo(window time.Duration, limit int, clock Clock) *SlidingCounterAlgo {
+	sc := &SlidingCounterAlgo{window: window, limit: limit, clock: clock}
+	sc.Initalize()
+	return sc
+}
 
-		fmt.Println("Forward the Request ", routeId, " for User ", user.id)
-		return true
+// Initalize fills in what is not set, STATIC_LIMIT requests per second
+func (sc *SlidingCounterAlgo) Initalize() {
+	if sc.window <= 0 {
+		sc.window = 1 * time.Second
+	}
+	if sc.limit <= 0 {
+		sc.limit = STATIC_LIMIT
+	}
+	if sc.clock == nil {
+		sc.clock = time.Now
 	}
+	sc.counters = make(map[bucketKey]*windowCounter)
+	sc.mu = &sync.Mutex{}
+}
 
-	sa.requestTime.Enqueue(request)
-	return false
+// roll moves the counter to the fixed window starting at start
+func (c *windowCounter) roll(start time.Time, window time.Duration) {
+	switch {
+	case c.start.Equal(start):
+		return
+	case c.start.Add(window).Equal(start):
+		c.previous = c.current
+	default:
+		c.previous = 0
+	}
+	c.current = 0
+	c.start = start
 }
 
-func (sa *SlidingAlgo) updateTheLimits(users map[int]*User) {
-	windowTime := time.Now().Add(-sa.window)
+// estimate is the weighted number of requests in the window ending at now
+func (c *windowCounter) estimate(now time.Time, window time.Duration) float64 {
+	overlap := 1 - float64(now.Sub(c.start))/float64(window)
+	return float64(c.previous)*overlap + float64(c.current)
+}
 
-	for {
-		if sa.requestTime.items.Len() == 0 {
-			break
-		}
-		request, ok := sa.requestTime.items.Front().Value.(Request)
-		if !ok {
-			fmt.Println("unable to fetch the value from queue")
-			break
-		}
-		if request.requestTime.After(windowTime) {
-			break
-		}
-		request, _ = sa.requestTime.Dequeue()
+func (sc *SlidingCounterAlgo) Evaluate(user *User, routeId int) bool {
+	return sc.Decide(user, routeId).Allowed
+}
 
-		limit, exists := users[request.userId].limits[request.routeId]
-		if !exists {
-			users[request.userId].limits[request.routeId] = STATIC_LIMIT
-			users[request.userId].requestLeft[request.routeId] = STATIC_LIMIT
-			continue
+func (sc *SlidingCounterAlgo) Decide(user *User, routeId int) Decision {
+	limit := limitOf(user, routeId, sc.limit)
+
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	now := sc.clock()
+	start := now.Truncate(sc.window)
+	sc.evaluations++
+	if sc.evaluations%sweepEvery == 0 {
+		// two windows later a counter has nothing left to say
+		for key, counter := range sc.counters {
+			if !counter.start.Add(2 * sc.window).After(start) {
+				delete(sc.counters, key)
+			}
 		}
-		users[request.userId].requestLeft[request.routeId] = min(limit, users[request.userId].requestLeft[request.routeId]+1)
 	}
-	fmt.Println("updated the limits")
+
+	key := bucketKey{userId: user.id, routeId: routeId}
+	counter, exists := sc.counters[key]
+	if !exists {
+		counter = &windowCounter{start: start}
+		sc.counters[key] = counter
+	}
+	counter.roll(start, sc.window)
+
+	decision := Decision{Limit: limit, Reset: start.Add(sc.window)}
+	estimate := counter.estimate(now, sc.window)
+	if estimate+1 <= float64(limit) {
+		counter.current++
+		estimate++
+		decision.Allowed = true
+	} else if counter.current+1 > limit || counter.previous == 0 {
+		decision.RetryAfter = decision.Reset.Sub(now)
+	} else {
+		// wait until enough of the previous window has slid out
+		overlap := float64(limit-counter.current-1) / float64(counter.previous)
+		decision.RetryAfter = start.Add(seconds((1 - overlap) * sc.window.Seconds())).Sub(now)
+	}
+	decision.Remaining = max(int(float64(limit)-estimate), 0)
+	return decision
 }
 
+func (sc *SlidingCounterAlgo) getDuration() time.Duration {
+	return 0
+}
+
+func (sc *SlidingCounterAlgo) updateTheLimits(users map[int]*User) {}
+
 func generateRandomNumber() int {
 	return rand.Intn(1000 * 1000 * 1000)
 }
 
 type User struct {
-	id          int
-	limits      map[int]int
-	requestLeft map[int]int
-	mu          *sync.Mutex
+	id     int
+	limits map[int]int
+	mu     *sync.Mutex
 }
 
 func main() {
 	rand.Seed(time.Now().UnixNano())
 
-	algo := &SlidingAlgo{}
-	algo.Initalize()
-	rl := NewRateLimiter(algo)
-
-	user := &User{
-		
+	// routes, users and limits come from the policy, edits are picked up
+	rl := NewRateLimiter(NewPolicyAlgo(nil))
+	if err := rl.LoadPolicy("policy.json"); err != nil {
+		fmt.Println(err)
+		return
 	}
-	user = rl.AddAUser(*user)
-	route := Route{
-		name : "payment_create",
-		endpoint: "payment/create",
-		method: "POST",
-	}
-	
-	route = rl.AddARoute(route)
+	rl.WatchPolicy("policy.json", 1*time.Second)
+
+	user := &User{id: 1}  // free tier, 3 per second
+	route := Route{id: 1} // POST /payment/create
 
-	rl.UserRequest(user.id, route.id )
-	rl.UserRequest(user.id, route.id )
-	rl.UserRequest(user.id, route.id )
-	rl.UserRequest(user.id, route.id )
-	rl.UserRequest(user.id, route.id )
-	rl.UserRequest(user.id, route.id )
-	rl.UserRequest(user.id, route.id )
-	rl.UserRequest(user.id, route.id )
+	rl.UserRequest(user.id, route.id)
+	rl.UserRequest(user.id, route.id)
+	rl.UserRequest(user.id, route.id)
+	rl.UserRequest(user.id, route.id)
+	rl.UserRequest(user.id, route.id)
+	rl.UserRequest(user.id, route.id)
+	rl.UserRequest(user.id, route.id)
+	rl.UserRequest(user.id, route.id)
 
-	time.Sleep(2*time.Second)
+	time.Sleep(2 * time.Second)
 
-	rl.UserRequest(user.id, route.id )
-	rl.UserRequest(user.id, route.id )
-	rl.UserRequest(user.id, route.id )
+	rl.UserRequest(user.id, route.id)
+	rl.UserRequest(user.id, route.id)
+	rl.UserRequest(user.id, route.id)
 	select {}
 }
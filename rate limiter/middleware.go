@@ -0,0 +1,263 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+HTTP middleware - the RateLimiter in front of real services
+
+route
+	method + path matched against "METHOD endpoint" of every Route by an
+	http.ServeMux, so endpoints can use its wildcards: /payment/{id}
+	a request matching no route is passed through, it is not limited
+user
+	X-API-Key: <key>                 key registered with AddAPIKey
+	Authorization: Bearer <jwt>      HS256 token signed with the secret,
+	                                 sub registered with AddSubject
+	no or unknown credentials -> 401
+limit
+	the algo's Decision becomes headers of every limited response
+	X-RateLimit-Limit, X-RateLimit-Remaining, X-RateLimit-Reset (unix seconds)
+	a throttled request gets 429 with Retry-After (seconds)
+*/
+
+type Middleware struct {
+	rl         *RateLimiter
+	jwtSecret  []byte
+	apiKeys    map[string]int
+	subjects   map[string]int
+	mux        *http.ServeMux
+	patterns   map[string]int // mux pattern -> route id
+	muxVersion int
+	clock      Clock
+	mu         *sync.RWMutex
+}
+
+// NewMiddleware limits requests with rl, an empty jwtSecret turns JWTs off
+func NewMiddleware(rl *RateLimiter, jwtSecret []byte) *Middleware {
+	return &Middleware{
+		rl:         rl,
+		jwtSecret:  jwtSecret,
+		apiKeys:    make(map[string]int),
+		subjects:   make(map[string]int),
+		muxVersion: -1,
+		clock:      time.Now,
+		mu:         &sync.RWMutex{},
+	}
+}
+
+func (m *Middleware) AddAPIKey(key string, userId int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.apiKeys[key] = userId
+}
+
+// AddSubject maps the sub claim of a JWT to userId
+func (m *Middleware) AddSubject(subject string, userId int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.subjects[subject] = userId
+}
+
+func (m *Middleware) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		routeId, found := m.route(r)
+		if !found {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		userId, err := m.user(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+
+		decision, err := m.rl.Decide(userId, routeId)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+
+		header := w.Header()
+		if decision.Limit > 0 {
+			header.Set("X-RateLimit-Limit", strconv.Itoa(decision.Limit))
+			header.Set("X-RateLimit-Remaining", strconv.Itoa(decision.Remaining))
+		}
+		if !decision.Reset.IsZero() {
+			header.Set("X-RateLimit-Reset", strconv.FormatInt(int64(math.Ceil(float64(decision.Reset.UnixNano())/1e9)), 10))
+		}
+		if !decision.Allowed {
+			retryAfter := max(int(math.Ceil(decision.RetryAfter.Seconds())), 1)
+			header.Set("Retry-After", strconv.Itoa(retryAfter))
+			http.Error(w, ErrThrottled.Error(), http.StatusTooManyRequests)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// route returns the id of the route r is for
+func (m *Middleware) route(r *http.Request) (int, bool) {
+	m.rl.mu.Lock()
+	version := m.rl.routesVersion
+	m.rl.mu.Unlock()
+
+	m.mu.RLock()
+	if m.muxVersion != version {
+		m.mu.RUnlock()
+		m.rebuild()
+		m.mu.RLock()
+	}
+	defer m.mu.RUnlock()
+
+	_, pattern := m.mux.Handler(r)
+	routeId, found := m.patterns[pattern]
+	return routeId, found
+}
+
+// rebuild registers the current routes in a new mux
+func (m *Middleware) rebuild() {
+	m.rl.mu.Lock()
+	version := m.rl.routesVersion
+	routes := make([]Route, 0, len(m.rl.routes))
+	for _, route := range m.rl.routes {
+		routes = append(routes, route)
+	}
+	m.rl.mu.Unlock()
+
+	mux := http.NewServeMux()
+	patterns := make(map[string]int)
+	for _, route := range routes {
+		pattern := routePattern(route)
+		if err := register(mux, pattern); err != nil {
+			fmt.Println("route ", route.id, " is not limited: ", err)
+			continue
+		}
+		patterns[pattern] = route.id
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.mux = mux
+	m.patterns = patterns
+	m.muxVersion = version
+}
+
+func routePattern(route Route) string {
+	endpoint := route.endpoint
+	if !strings.HasPrefix(endpoint, "/") {
+		endpoint = "/" + endpoint
+	}
+	if route.method == "" {
+		return endpoint
+	}
+	return strings.ToUpper(route.method) + " " + endpoint
+}
+
+// register adds pattern to mux, ServeMux panics on invalid or conflicting patterns
+func register(mux *http.ServeMux, pattern string) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+	mux.Handle(pattern, http.NotFoundHandler())
+	return nil
+}
+
+// user resolves the user from the API key or the JWT of r
+func (m *Middleware) user(r *http.Request) (int, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if key := r.Header.Get("X-API-Key"); key != "" {
+		userId, exists := m.apiKeys[key]
+		if !exists {
+			return 0, errors.New("unknown API key")
+		}
+		return userId, nil
+	}
+
+	token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !found {
+		return 0, errors.New("an API key or a bearer token is required")
+	}
+	subject, err := parseJWT(token, m.jwtSecret, m.clock())
+	if err != nil {
+		return 0, err
+	}
+	userId, exists := m.subjects[subject]
+	if !exists {
+		return 0, errors.New("unknown token subject")
+	}
+	return userId, nil
+}
+
+type jwtClaims struct {
+	Sub string   `json:"sub"`
+	Exp *float64 `json:"exp"`
+	Nbf *float64 `json:"nbf"`
+}
+
+// parseJWT verifies an HS256 token and returns its subject
+func parseJWT(token string, secret []byte, now time.Time) (string, error) {
+	invalid := errors.New("invalid token")
+	if len(secret) == 0 {
+		return "", errors.New("tokens are not accepted")
+	}
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", invalid
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil || header.Alg != "HS256" {
+		return "", invalid
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", invalid
+	}
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(parts[0] + "." + parts[1]))
+	if !hmac.Equal(signature, mac.Sum(nil)) {
+		return "", invalid
+	}
+
+	var claims jwtClaims
+	if err := decodeSegment(parts[1], &claims); err != nil || claims.Sub == "" {
+		return "", invalid
+	}
+	unix := float64(now.UnixNano()) / 1e9
+	if claims.Exp != nil && unix >= *claims.Exp {
+		return "", errors.New("token expired")
+	}
+	if claims.Nbf != nil && unix < *claims.Nbf {
+		return "", errors.New("token not valid yet")
+	}
+	return claims.Sub, nil
+}
+
+func decodeSegment(segment string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
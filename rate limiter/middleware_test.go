@@ -0,0 +1,162 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+var testSecret = []byte("test-secret")
+
+// signJWT makes an HS256 token with claims
+func signJWT(secret []byte, alg string, claims map[string]interface{}) string {
+	header, _ := json.Marshal(map[string]string{"alg": alg, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	unsigned := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(unsigned))
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// newTestMiddleware limits user 1 to 2 requests a second on POST /payment/{id}
+func newTestMiddleware(clock *fakeClock) (*Middleware, http.Handler) {
+	rl := NewRateLimiter(NewSlidingLogAlgo(time.Second, 2, clock.Now))
+	rl.AddARoute(Route{id: 1, name: "payment", endpoint: "payment/{id}", method: "POST"})
+	rl.AddAUser(User{id: 1})
+
+	m := NewMiddleware(rl, testSecret)
+	m.clock = clock.Now
+	m.AddAPIKey("key-1", 1)
+	m.AddSubject("alice", 1)
+	return m, m.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+}
+
+func serve(handler http.Handler, method string, path string, header http.Header) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, path, nil)
+	for name, values := range header {
+		r.Header[name] = values
+	}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	return w
+}
+
+func TestMiddlewareHeadersAndThrottle(t *testing.T) {
+	clock := newFakeClock()
+	_, handler := newTestMiddleware(clock)
+	apiKey := http.Header{"X-Api-Key": {"key-1"}}
+	reset := strconv.FormatInt(baseTime.Add(time.Second).Unix(), 10)
+
+	for _, remaining := range []string{"1", "0"} {
+		w := serve(handler, "POST", "/payment/9", apiKey)
+		if w.Code != http.StatusOK {
+			t.Fatalf("status %d, want 200", w.Code)
+		}
+		if got := w.Header().Get("X-RateLimit-Limit"); got != "2" {
+			t.Errorf("X-RateLimit-Limit %q, want 2", got)
+		}
+		if got := w.Header().Get("X-RateLimit-Remaining"); got != remaining {
+			t.Errorf("X-RateLimit-Remaining %q, want %s", got, remaining)
+		}
+		if got := w.Header().Get("X-RateLimit-Reset"); got != reset {
+			t.Errorf("X-RateLimit-Reset %q, want %s", got, reset)
+		}
+	}
+
+	clock.Advance(400 * time.Millisecond)
+	w := serve(handler, "POST", "/payment/10", apiKey)
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("status %d, want 429", w.Code)
+	}
+	// 600ms are left, rounded up
+	if got := w.Header().Get("Retry-After"); got != "1" {
+		t.Errorf("Retry-After %q, want 1", got)
+	}
+	if got := w.Header().Get("X-RateLimit-Remaining"); got != "0" {
+		t.Errorf("X-RateLimit-Remaining %q, want 0", got)
+	}
+
+	// the token is the same user, it shares the limit
+	clock.Advance(600 * time.Millisecond)
+	bearer := http.Header{"Authorization": {"Bearer " + signJWT(testSecret, "HS256", map[string]interface{}{"sub": "alice"})}}
+	if w := serve(handler, "POST", "/payment/9", bearer); w.Code != http.StatusOK {
+		t.Errorf("token after the window: status %d, want 200", w.Code)
+	}
+	serve(handler, "POST", "/payment/9", apiKey)
+	if w := serve(handler, "POST", "/payment/9", bearer); w.Code != http.StatusTooManyRequests {
+		t.Errorf("token over the limit: status %d, want 429", w.Code)
+	}
+}
+
+func TestMiddlewareUnlimitedRoutes(t *testing.T) {
+	_, handler := newTestMiddleware(newFakeClock())
+
+	// no route, no credentials needed and no headers
+	for _, request := range []struct{ method, path string }{
+		{"GET", "/health"},
+		{"GET", "/payment/9"}, // the route is POST only
+		{"POST", "/payment/9/refund"},
+	} {
+		w := serve(handler, request.method, request.path, nil)
+		if w.Code != http.StatusOK || w.Header().Get("X-RateLimit-Limit") != "" {
+			t.Errorf("%s %s: status %d with limit %q, want 200 unlimited",
+				request.method, request.path, w.Code, w.Header().Get("X-RateLimit-Limit"))
+		}
+	}
+}
+
+func TestMiddlewareUnauthorized(t *testing.T) {
+	_, handler := newTestMiddleware(newFakeClock())
+	expires := float64(baseTime.Unix())
+
+	tests := []struct {
+		name   string
+		header http.Header
+	}{
+		{"no credentials", nil},
+		{"unknown API key", http.Header{"X-Api-Key": {"key-2"}}},
+		{"not a bearer token", http.Header{"Authorization": {"Basic a2V5"}}},
+		{"malformed token", http.Header{"Authorization": {"Bearer abc"}}},
+		{"wrong secret", http.Header{"Authorization": {"Bearer " + signJWT([]byte("other"), "HS256", map[string]interface{}{"sub": "alice"})}}},
+		{"other algorithm", http.Header{"Authorization": {"Bearer " + signJWT(testSecret, "none", map[string]interface{}{"sub": "alice"})}}},
+		{"expired", http.Header{"Authorization": {"Bearer " + signJWT(testSecret, "HS256", map[string]interface{}{"sub": "alice", "exp": expires})}}},
+		{"unknown subject", http.Header{"Authorization": {"Bearer " + signJWT(testSecret, "HS256", map[string]interface{}{"sub": "bob"})}}},
+	}
+	for _, tt := range tests {
+		if w := serve(handler, "POST", "/payment/9", tt.header); w.Code != http.StatusUnauthorized {
+			t.Errorf("%s: status %d, want 401", tt.name, w.Code)
+		}
+	}
+
+	valid := signJWT(testSecret, "HS256", map[string]interface{}{"sub": "alice", "exp": expires + 60})
+	if w := serve(handler, "POST", "/payment/9", http.Header{"Authorization": {"Bearer " + valid}}); w.Code != http.StatusOK {
+		t.Errorf("token valid for another minute: status %d, want 200", w.Code)
+	}
+}
+
+func TestMiddlewareSeesNewRoutes(t *testing.T) {
+	m, handler := newTestMiddleware(newFakeClock())
+	apiKey := http.Header{"X-Api-Key": {"key-1"}}
+
+	if w := serve(handler, "GET", "/search", apiKey); w.Header().Get("X-RateLimit-Limit") != "" {
+		t.Fatal("/search limited before it was added")
+	}
+	m.rl.AddARoute(Route{id: 2, name: "search", endpoint: "/search", method: "GET"})
+	if w := serve(handler, "GET", "/search", apiKey); w.Header().Get("X-RateLimit-Limit") != "2" {
+		t.Errorf("/search not limited after it was added, status %d", w.Code)
+	}
+
+	// a route conflicting with another one is skipped, the others still work
+	m.rl.AddARoute(Route{id: 3, name: "search again", endpoint: "/search", method: "GET"})
+	if w := serve(handler, "POST", "/payment/9", apiKey); w.Code != http.StatusOK {
+		t.Errorf("status %d after a conflicting route, want 200", w.Code)
+	}
+}
@@ -0,0 +1,433 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+Policy file - routes, user tiers and their limits in JSON
+
+{
+  "default_tier": "free",
+  "tiers": {"free": [], "pro": [42]},          tier -> user ids
+  "routes": [{
+    "name": "payment_create", "method": "POST", "path": "/payment/create",
+    "limits": {                                tier, or "*" for every other tier
+      "free": {"algorithm": "sliding_log", "limit": 3, "window": "1s"},
+      "pro":  {"algorithm": "token_bucket", "rate": 10, "burst": 20}
+    }
+  }]
+}
+
+algorithms
+	token_bucket      rate (per second), burst
+	sliding_log       limit, window
+	sliding_counter   limit, window
+a route without an id gets one from its method and path, the same on every
+replica and every reload. A tier without a limit on a route is not limited.
+
+reload
+	PolicyAlgo runs one algo per (route, tier) rule. A reload builds the new
+	rules and swaps them in at once, a rule that did not change keeps its algo
+	and so the counters of its users. The file replaces the routes of the
+	RateLimiter, ChangeTheLimit still overrides limit of the sliding algos.
+	WatchPolicy reloads when the content of the file changed, by its sha256.
+
+users
+	the users of the tiers are added on load. With a default_tier a user the
+	RateLimiter does not know yet is added on its first request, in that tier.
+*/
+
+type Policy struct {
+	DefaultTier string           `json:"default_tier"`
+	Tiers       map[string][]int `json:"tiers"`
+	Routes      []PolicyRoute    `json:"routes"`
+}
+
+type PolicyRoute struct {
+	Id     int                    `json:"id"`
+	Name   string                 `json:"name"`
+	Method string                 `json:"method"`
+	Path   string                 `json:"path"`
+	Limits map[string]PolicyLimit `json:"limits"`
+}
+
+type PolicyLimit struct {
+	Algorithm string  `json:"algorithm"`
+	Limit     int     `json:"limit"`
+	Window    string  `json:"window"`
+	Rate      float64 `json:"rate"`
+	Burst     int     `json:"burst"`
+}
+
+const anyTier = "*"
+
+// ruleKey is one limit of the policy, tier is anyTier for the route's fallback
+type ruleKey struct {
+	routeId int
+	tier    string
+}
+
+// ruleSpec is a PolicyLimit after validation, equal specs mean an unchanged rule
+type ruleSpec struct {
+	algorithm string
+	limit     int
+	window    time.Duration
+	rate      float64
+	burst     int
+}
+
+type rule struct {
+	spec ruleSpec
+	algo Algo
+}
+
+type policyState struct {
+	defaultTier string
+	userTiers   map[int]string
+	rules       map[ruleKey]*rule
+}
+
+// PolicyAlgo evaluates each request with the algo of its (route, tier) rule
+type PolicyAlgo struct {
+	state  atomic.Pointer[policyState]
+	clock  Clock
+	loaded []byte      // sha256 of the last file seen by LoadPolicy or WatchPolicy
+	mu     *sync.Mutex // serializes reloads
+}
+
+func NewPolicyAlgo(clock Clock) *PolicyAlgo {
+	pa := &PolicyAlgo{clock: clock}
+	pa.Initalize()
+	return pa
+}
+
+// Initalize starts with an empty policy, nothing is limited
+func (pa *PolicyAlgo) Initalize() {
+	if pa.clock == nil {
+		pa.clock = time.Now
+	}
+	pa.state.Store(&policyState{userTiers: map[int]string{}, rules: map[ruleKey]*rule{}})
+	pa.mu = &sync.Mutex{}
+}
+
+// rule returns the algo limiting user on routeId, nil if there is none
+func (pa *PolicyAlgo) rule(user *User, routeId int) Algo {
+	state := pa.state.Load()
+	tier, exists := state.userTiers[user.id]
+	if !exists {
+		tier = state.defaultTier
+	}
+	if r, exists := state.rules[ruleKey{routeId: routeId, tier: tier}]; exists {
+		return r.algo
+	}
+	if r, exists := state.rules[ruleKey{routeId: routeId, tier: anyTier}]; exists {
+		return r.algo
+	}
+	return nil
+}
+
+func (pa *PolicyAlgo) Evaluate(user *User, routeId int) bool {
+	return pa.Decide(user, routeId).Allowed
+}
+
+func (pa *PolicyAlgo) Decide(user *User, routeId int) Decision {
+	algo := pa.rule(user, routeId)
+	if algo == nil {
+		return Decision{Allowed: true}
+	}
+	if decider, ok := algo.(Decider); ok {
+		return decider.Decide(user, routeId)
+	}
+	return Decision{Allowed: algo.Evaluate(user, routeId)}
+}
+
+// the rules refill lazily
+func (pa *PolicyAlgo) getDuration() time.Duration {
+	return 0
+}
+
+func (pa *PolicyAlgo) updateTheLimits(users map[int]*User) {}
+
+// ParsePolicy decodes and validates a policy file
+func ParsePolicy(data []byte) (*Policy, error) {
+	var policy Policy
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&policy); err != nil {
+		return nil, fmt.Errorf("policy: %w", err)
+	}
+	if _, _, err := policy.compile(); err != nil {
+		return nil, err
+	}
+	return &policy, nil
+}
+
+// compile validates the policy and returns its routes and rules
+func (p *Policy) compile() (map[int]Route, map[ruleKey]ruleSpec, error) {
+	userTiers := make(map[int]string)
+	for tier, userIds := range p.Tiers {
+		if tier == "" || tier == anyTier {
+			return nil, nil, fmt.Errorf("policy: invalid tier name %q", tier)
+		}
+		for _, userId := range userIds {
+			if other, exists := userTiers[userId]; exists {
+				return nil, nil, fmt.Errorf("policy: user %d is in tiers %s and %s", userId, other, tier)
+			}
+			userTiers[userId] = tier
+		}
+	}
+	if _, exists := p.Tiers[p.DefaultTier]; p.DefaultTier != "" && !exists {
+		return nil, nil, fmt.Errorf("policy: default tier %s is not defined", p.DefaultTier)
+	}
+
+	routes := make(map[int]Route)
+	patterns := make(map[string]bool)
+	specs := make(map[ruleKey]ruleSpec)
+	for _, pr := range p.Routes {
+		if pr.Method == "" || pr.Path == "" {
+			return nil, nil, fmt.Errorf("policy: route %q needs a method and a path", pr.Name)
+		}
+		route := Route{id: pr.Id, name: pr.Name, endpoint: pr.Path, method: strings.ToUpper(pr.Method)}
+		pattern := routePattern(route)
+		if patterns[pattern] {
+			return nil, nil, fmt.Errorf("policy: route %s is defined twice", pattern)
+		}
+		patterns[pattern] = true
+		if route.id == 0 {
+			route.id = routeIdOf(pattern)
+		}
+		if _, exists := routes[route.id]; exists {
+			return nil, nil, fmt.Errorf("policy: route id %d of %s is taken", route.id, pattern)
+		}
+		routes[route.id] = route
+
+		for tier, limit := range pr.Limits {
+			if _, exists := p.Tiers[tier]; !exists && tier != anyTier {
+				return nil, nil, fmt.Errorf("policy: route %s limits unknown tier %s", pattern, tier)
+			}
+			spec, err := limit.spec()
+			if err != nil {
+				return nil, nil, fmt.Errorf("policy: route %s tier %s: %w", pattern, tier, err)
+			}
+			specs[ruleKey{routeId: route.id, tier: tier}] = spec
+		}
+	}
+	return routes, specs, nil
+}
+
+func (l PolicyLimit) spec() (ruleSpec, error) {
+	// only the fields of the algorithm, others do not make the rule change
+	switch l.Algorithm {
+	case "token_bucket":
+		if l.Rate <= 0 || l.Burst <= 0 {
+			return ruleSpec{}, errors.New("token_bucket needs a positive rate and burst")
+		}
+		return ruleSpec{algorithm: l.Algorithm, rate: l.Rate, burst: l.Burst}, nil
+	case "sliding_log", "sliding_counter":
+		window, err := time.ParseDuration(l.Window)
+		if err != nil || window <= 0 || l.Limit <= 0 {
+			return ruleSpec{}, fmt.Errorf("%s needs a positive limit and window", l.Algorithm)
+		}
+		return ruleSpec{algorithm: l.Algorithm, limit: l.Limit, window: window}, nil
+	default:
+		return ruleSpec{}, fmt.Errorf("unknown algorithm %q", l.Algorithm)
+	}
+}
+
+func (s ruleSpec) newAlgo(clock Clock) Algo {
+	switch s.algorithm {
+	case "token_bucket":
+		return NewBucketAlgo(s.rate, s.burst, clock)
+	case "sliding_counter":
+		return NewSlidingCounterAlgo(s.window, s.limit, clock)
+	default:
+		return NewSlidingLogAlgo(s.window, s.limit, clock)
+	}
+}
+
+// routeIdOf derives a route id from "METHOD path", stable across replicas and reloads
+func routeIdOf(pattern string) int {
+	h := fnv.New32a()
+	h.Write([]byte(pattern))
+	return int(h.Sum32()&0x7fffffff) + 1
+}
+
+// apply swaps in the rules of policy, unchanged rules keep their algo. pa.mu
+// must be held.
+func (pa *PolicyAlgo) apply(policy *Policy) (map[int]Route, error) {
+	routes, specs, err := policy.compile()
+	if err != nil {
+		return nil, err
+	}
+
+	old := pa.state.Load()
+	state := &policyState{
+		defaultTier: policy.DefaultTier,
+		userTiers:   make(map[int]string),
+		rules:       make(map[ruleKey]*rule, len(specs)),
+	}
+	for tier, userIds := range policy.Tiers {
+		for _, userId := range userIds {
+			state.userTiers[userId] = tier
+		}
+	}
+	kept := 0
+	for key, spec := range specs {
+		if r, exists := old.rules[key]; exists && r.spec == spec {
+			state.rules[key] = r
+			kept++
+			continue
+		}
+		state.rules[key] = &rule{spec: spec, algo: spec.newAlgo(pa.clock)}
+	}
+	pa.state.Store(state)
+
+	fmt.Println("policy loaded, ", len(specs), " rules of which ", kept, " unchanged")
+	return routes, nil
+}
+
+// LoadPolicy reads the policy file at path and applies it, the algo has to be
+// a PolicyAlgo. On an error the current policy stays.
+func (rl *RateLimiter) LoadPolicy(path string) error {
+	pa, ok := rl.algo.(*PolicyAlgo)
+	if !ok {
+		return errors.New("policy: the algo is not a PolicyAlgo")
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("policy: %w", err)
+	}
+
+	pa.mu.Lock()
+	defer pa.mu.Unlock()
+	if err := rl.loadPolicy(pa, data); err != nil {
+		return err
+	}
+	sum := sha256.Sum256(data)
+	pa.loaded = sum[:]
+	return nil
+}
+
+// loadPolicy parses data and applies it, pa.mu must be held
+func (rl *RateLimiter) loadPolicy(pa *PolicyAlgo, data []byte) error {
+	policy, err := ParsePolicy(data)
+	if err != nil {
+		return err
+	}
+	routes, err := pa.apply(policy)
+	if err != nil {
+		return err
+	}
+	rl.applyPolicy(routes, policy.Tiers)
+	return nil
+}
+
+func newPolicyUser(userId int) *User {
+	return &User{id: userId, limits: make(map[int]int), mu: &sync.Mutex{}}
+}
+
+// applyPolicy replaces the routes and adds the users of the tiers that are missing
+func (rl *RateLimiter) applyPolicy(routes map[int]Route, tiers map[string][]int) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	rl.routes = routes
+	rl.routesVersion++
+	for _, userIds := range tiers {
+		for _, userId := range userIds {
+			if _, exists := rl.users[userId]; !exists {
+				rl.users[userId] = newPolicyUser(userId)
+			}
+		}
+	}
+}
+
+// addDefaultTierUser adds userId on its first request when the policy has a
+// default tier for the users it does not list
+func (rl *RateLimiter) addDefaultTierUser(userId int) (*User, bool) {
+	pa, ok := rl.algo.(*PolicyAlgo)
+	if !ok || pa.state.Load().defaultTier == "" {
+		return nil, false
+	}
+
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	user, exists := rl.users[userId]
+	if !exists {
+		user = newPolicyUser(userId)
+		rl.users[userId] = user
+	}
+	return user, true
+}
+
+// WatchPolicy checks the policy file at path every interval and reloads it
+// when its content changed. A file that does not load is
+// reported once and the current policy stays until the next change.
+func (rl *RateLimiter) WatchPolicy(path string, interval time.Duration) (stop func()) {
+	pa, ok := rl.algo.(*PolicyAlgo)
+	if !ok {
+		fmt.Println("policy is not watched, the algo is not a PolicyAlgo")
+		return func() {}
+	}
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				rl.reloadIfChanged(pa, path)
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			close(done)
+			wg.Wait()
+		})
+	}
+}
+
+func (rl *RateLimiter) reloadIfChanged(pa *PolicyAlgo, path string) {
+	// an edit can keep the size and land within the modification time
+	// granularity, only the content tells
+	data, err := os.ReadFile(path)
+
+	pa.mu.Lock()
+	defer pa.mu.Unlock()
+	seen := pa.loaded
+	if err != nil {
+		pa.loaded = nil
+		if seen != nil {
+			fmt.Println("policy is not reloaded: ", err)
+		}
+		return
+	}
+	sum := sha256.Sum256(data)
+	pa.loaded = sum[:]
+	if bytes.Equal(seen, sum[:]) {
+		return
+	}
+	if err := rl.loadPolicy(pa, data); err != nil {
+		fmt.Println("policy is not reloaded: ", err)
+	}
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testPolicy = `{
+  "default_tier": "free",
+  "tiers": {"free": [1], "pro": [42]},
+  "routes": [
+    {"id": 1, "name": "payment_create", "method": "POST", "path": "/payment/create", "limits": {
+      "free": {"algorithm": "sliding_log", "limit": 2, "window": "1s"},
+      "pro": {"algorithm": "token_bucket", "rate": 1, "burst": 5}
+    }},
+    {"name": "search", "method": "get", "path": "/search", "limits": {
+      "*": {"algorithm": "sliding_counter", "limit": 3, "window": "1m"}
+    }}
+  ]
+}`
+
+var searchId = routeIdOf("GET /search")
+
+func writePolicy(t *testing.T, path string, policy string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(policy), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// newPolicyLimiter loads policy from a file in a temp dir
+func newPolicyLimiter(t *testing.T, clock *fakeClock, policy string) (*RateLimiter, string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "policy.json")
+	writePolicy(t, path, policy)
+	rl := NewRateLimiter(NewPolicyAlgo(clock.Now))
+	if err := rl.LoadPolicy(path); err != nil {
+		t.Fatal(err)
+	}
+	return rl, path
+}
+
+// allowedFor counts how many of n requests of userId on routeId rl allows
+func allowedFor(rl *RateLimiter, userId int, routeId int, n int) int {
+	allowed := 0
+	for i := 0; i < n; i++ {
+		if rl.UserRequest(userId, routeId) == nil {
+			allowed++
+		}
+	}
+	return allowed
+}
+
+func TestParsePolicyRejects(t *testing.T) {
+	tests := map[string]string{
+		"unknown field":       `{"tierz": {}}`,
+		"user in two tiers":   `{"tiers": {"free": [1], "pro": [1]}}`,
+		"unknown default":     `{"default_tier": "gold", "tiers": {"free": []}}`,
+		"route without path":  `{"routes": [{"method": "GET"}]}`,
+		"route twice":         `{"routes": [{"method": "GET", "path": "/a"}, {"method": "get", "path": "a"}]}`,
+		"id taken":            `{"routes": [{"id": 1, "method": "GET", "path": "/a"}, {"id": 1, "method": "GET", "path": "/b"}]}`,
+		"unknown tier":        `{"routes": [{"method": "GET", "path": "/a", "limits": {"gold": {"algorithm": "token_bucket", "rate": 1, "burst": 1}}}]}`,
+		"unknown algorithm":   `{"routes": [{"method": "GET", "path": "/a", "limits": {"*": {"algorithm": "leaky"}}}]}`,
+		"bucket without rate": `{"routes": [{"method": "GET", "path": "/a", "limits": {"*": {"algorithm": "token_bucket", "burst": 1}}}]}`,
+		"bad window":          `{"routes": [{"method": "GET", "path": "/a", "limits": {"*": {"algorithm": "sliding_log", "limit": 1, "window": "soon"}}}]}`,
+	}
+	for name, policy := range tests {
+		if _, err := ParsePolicy([]byte(policy)); err == nil {
+			t.Errorf("%s: accepted", name)
+		}
+	}
+	if _, err := ParsePolicy([]byte(testPolicy)); err != nil {
+		t.Errorf("test policy: %v", err)
+	}
+}
+
+func TestPolicyTiersAndRoutes(t *testing.T) {
+	rl, path := newPolicyLimiter(t, newFakeClock(), testPolicy)
+	rl.AddAUser(User{id: 7}) // in no tier, so free
+
+	tests := []struct {
+		name    string
+		userId  int
+		routeId int
+		want    int
+	}{
+		{"free", 1, 1, 2},
+		{"pro", 42, 1, 5},
+		{"default tier", 7, 1, 2},
+		{"never added", 8, 1, 2},
+		{"every tier", 42, searchId, 3},
+	}
+	for _, tt := range tests {
+		if got := allowedFor(rl, tt.userId, tt.routeId, 10); got != tt.want {
+			t.Errorf("%s: allowed %d, want %d", tt.name, got, tt.want)
+		}
+	}
+
+	if route := rl.routes[searchId]; route.method != "GET" || route.endpoint != "/search" {
+		t.Errorf("search route %+v", route)
+	}
+
+	// without a default tier a user has to be known
+	writePolicy(t, path, strings.Replace(testPolicy, `"default_tier": "free",`, "", 1))
+	if err := rl.LoadPolicy(path); err != nil {
+		t.Fatal(err)
+	}
+	if err := rl.UserRequest(9, 1); err == nil || err == ErrThrottled {
+		t.Errorf("unknown user without a default tier: %v", err)
+	}
+}
+
+func TestPolicyReloadKeepsUnchangedCounters(t *testing.T) {
+	clock := newFakeClock()
+	rl, path := newPolicyLimiter(t, clock, testPolicy)
+	allowedFor(rl, 1, 1, 10)
+	allowedFor(rl, 42, 1, 10)
+	allowedFor(rl, 1, searchId, 10)
+
+	// pro and search change, free does not, refunds is new
+	changed := strings.Replace(testPolicy, `"rate": 1, "burst": 5`, `"rate": 1, "burst": 8`, 1)
+	changed = strings.Replace(changed, `"limit": 3, "window": "1m"`, `"limit": 4, "window": "1m"`, 1)
+	changed = strings.Replace(changed, `"routes": [`, `"routes": [
+    {"name": "refunds", "method": "POST", "path": "/refunds", "limits": {}},`, 1)
+	writePolicy(t, path, changed)
+	if err := rl.LoadPolicy(path); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := allowedFor(rl, 1, 1, 10); got != 0 {
+		t.Errorf("unchanged rule allowed %d, its counters were dropped", got)
+	}
+	if got := allowedFor(rl, 42, 1, 10); got != 8 {
+		t.Errorf("changed bucket allowed %d, want the new burst of 8", got)
+	}
+	if got := allowedFor(rl, 1, searchId, 10); got != 4 {
+		t.Errorf("changed window allowed %d, want the new limit of 4", got)
+	}
+	if got := allowedFor(rl, 1, routeIdOf("POST /refunds"), 10); got != 10 {
+		t.Errorf("route without limits allowed %d, want all", got)
+	}
+
+	// a policy that does not load changes nothing
+	writePolicy(t, path, `{"routes": [{"method": "GET"}]}`)
+	if err := rl.LoadPolicy(path); err == nil {
+		t.Fatal("invalid policy loaded")
+	}
+	if got := allowedFor(rl, 1, 1, 10); got != 0 {
+		t.Errorf("after a failed load allowed %d", got)
+	}
+
+	// a route that is gone is not served
+	writePolicy(t, path, `{"tiers": {"free": [1]}}`)
+	if err := rl.LoadPolicy(path); err != nil {
+		t.Fatal(err)
+	}
+	if err := rl.UserRequest(1, 1); err == nil || err == ErrThrottled {
+		t.Errorf("removed route: %v", err)
+	}
+}
+
+func TestWatchPolicy(t *testing.T) {
+	rl, path := newPolicyLimiter(t, newFakeClock(), testPolicy)
+	stop := rl.WatchPolicy(path, 5*time.Millisecond)
+	defer stop()
+
+	// a broken file is skipped, the next good one is loaded
+	writePolicy(t, path, `{"routes": [`)
+	time.Sleep(50 * time.Millisecond)
+	if got := allowedFor(rl, 1, 1, 10); got != 2 {
+		t.Fatalf("allowed %d after a broken file, want the old limit of 2", got)
+	}
+
+	writePolicy(t, path, strings.Replace(testPolicy, `"limit": 2, "window": "1s"`, `"limit": 5, "window": "2s"`, 1))
+	deadline := time.Now().Add(2 * time.Second)
+	for rl.algo.(*PolicyAlgo).state.Load().rules[ruleKey{routeId: 1, tier: "free"}].spec.limit != 5 {
+		if time.Now().After(deadline) {
+			t.Fatal("policy change not picked up")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if got := allowedFor(rl, 1, 1, 10); got != 5 {
+		t.Errorf("allowed %d after the reload, want 5", got)
+	}
+}
+
+func TestWatchPolicySeesSameSizeEdit(t *testing.T) {
+	rl, path := newPolicyLimiter(t, newFakeClock(), testPolicy)
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stop := rl.WatchPolicy(path, 5*time.Millisecond)
+	defer stop()
+	time.Sleep(20 * time.Millisecond)
+
+	// same size and modification time, only the content differs
+	writePolicy(t, path, strings.Replace(testPolicy, `"limit": 2,`, `"limit": 7,`, 1))
+	if err := os.Chtimes(path, info.ModTime(), info.ModTime()); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for rl.algo.(*PolicyAlgo).state.Load().rules[ruleKey{routeId: 1, tier: "free"}].spec.limit != 7 {
+		if time.Now().After(deadline) {
+			t.Fatal("same size edit not picked up")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func TestSlidingLogWindow(t *testing.T) {
+	clock := newFakeClock()
+	algo := NewSlidingLogAlgo(time.Second, 3, clock.Now)
+	user := newTestUser(1)
+
+	steps := []struct {
+		advance time.Duration
+		want    bool
+	}{
+		{0, true},                       // 0.0
+		{300 * time.Millisecond, true},  // 0.3
+		{300 * time.Millisecond, true},  // 0.6
+		{300 * time.Millisecond, false}, // 0.9, three in (-0.1, 0.9]
+		{100 * time.Millisecond, true},  // 1.0, the request at 0.0 left the window
+		{100 * time.Millisecond, false}, // 1.1, 0.3 is still in it
+		{200 * time.Millisecond, true},  // 1.3
+	}
+	for i, step := range steps {
+		clock.Advance(step.advance)
+		if got := algo.Evaluate(user, 1); got != step.want {
+			t.Errorf("step %d at %v: got %v, want %v", i, clock.Now().Sub(baseTime), got, step.want)
+		}
+	}
+
+	// every (user, route) has its own log
+	if got := allowedOf(algo, user, 2, 5); got != 3 {
+		t.Errorf("other route allowed %d, want 3", got)
+	}
+	if got := allowedOf(algo, newTestUser(2), 1, 5); got != 3 {
+		t.Errorf("other user allowed %d, want 3", got)
+	}
+}
+
+func TestSlidingCounterWeightsPreviousWindow(t *testing.T) {
+	clock := newFakeClock() // baseTime is on a minute boundary
+	algo := NewSlidingCounterAlgo(time.Minute, 10, clock.Now)
+	user := newTestUser(1)
+
+	clock.Advance(30 * time.Second)
+	if got := allowedOf(algo, user, 1, 15); got != 10 {
+		t.Fatalf("first window allowed %d, want 10", got)
+	}
+	// 15s into the next window 3/4 of the previous one still counts: 7.5
+	clock.Advance(45 * time.Second)
+	if got := allowedOf(algo, user, 1, 5); got != 2 {
+		t.Errorf("at 1m15 allowed %d, want 2", got)
+	}
+	// half way through the window after: 2 * 0.5 + 0
+	clock.Advance(75 * time.Second)
+	if got := allowedOf(algo, user, 1, 15); got != 9 {
+		t.Errorf("at 2m30 allowed %d, want 9", got)
+	}
+	// a gap of more than a window forgets everything
+	clock.Advance(3 * time.Minute)
+	if got := allowedOf(algo, user, 1, 15); got != 10 {
+		t.Errorf("after a gap allowed %d, want 10", got)
+	}
+}
+
+func TestSlidingLimitFromUser(t *testing.T) {
+	clock := newFakeClock()
+	for name, algo := range map[string]Algo{
+		"log":     NewSlidingLogAlgo(time.Second, 5, clock.Now),
+		"counter": NewSlidingCounterAlgo(time.Second, 5, clock.Now),
+	} {
+		rl := NewRateLimiter(algo)
+		route := rl.AddARoute(Route{id: 1, name: "search", endpoint: "/search", method: "GET"})
+		user := rl.AddAUser(User{id: 1})
+		other := rl.AddAUser(User{id: 2})
+		rl.ChangeTheLimit(user.id, route.id, 2)
+
+		if got := allowedOf(algo, user, route.id, 10); got != 2 {
+			t.Errorf("%s: user limit allowed %d, want 2", name, got)
+		}
+		if got := allowedOf(algo, other, route.id, 10); got != 5 {
+			t.Errorf("%s: algo limit allowed %d, want 5", name, got)
+		}
+	}
+}
+
+// no window of the log algo ever holds more than limit allowed requests
+func TestSlidingLogNeverExceedsLimit(t *testing.T) {
+	clock := newFakeClock()
+	const limit, window = 4, time.Second
+	algo := NewSlidingLogAlgo(window, limit, clock.Now)
+	user := newTestUser(1)
+
+	r := rand.New(rand.NewSource(1))
+	var allowed []time.Time
+	for i := 0; i < 2000; i++ {
+		clock.Advance(time.Duration(r.Intn(200)) * time.Millisecond)
+		if !algo.Evaluate(user, 1) {
+			continue
+		}
+		now := clock.Now()
+		allowed = append(allowed, now)
+		inWindow := 0
+		for _, at := range allowed {
+			if at.After(now.Add(-window)) {
+				inWindow++
+			}
+		}
+		if inWindow > limit {
+			t.Fatalf("%d requests allowed in the window ending at %v", inWindow, now.Sub(baseTime))
+		}
+	}
+	// and it is not stricter than it has to be, ~200s at 4 per second
+	if capacity := int(clock.Now().Sub(baseTime)/window) * limit; len(allowed) < capacity*9/10 {
+		t.Errorf("only %d requests allowed, the capacity was %d", len(allowed), capacity)
+	}
+}
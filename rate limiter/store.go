@@ -0,0 +1,355 @@
+package main
+
+import (
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+/*
+Distributed limiting - every gateway replica shares the counters
+
+Store - interface
+	Take(key, limit, window) -> allowed, remaining, resetIn
+	atomic check-and-decrement: a key starts a window with `limit` requests,
+	every Take uses one, a new window starts once `resetIn` has passed.
+	resetIn is measured on the store's clock, so replicas whose clocks
+	disagree with it still get the right Retry-After
+
+MemoryStore - the counters, guarded by one mutex
+StoreServer - serves a Store over tcp (gob), the fake shared server for tests
+RemoteStore - Store client of a StoreServer, what each replica uses
+	every Take has to finish within the dial timeout, a store that stops
+	answering is a store error instead of a replica stuck on it
+
+StoreAlgo - Algo on top of a Store, key = user:<id>:route:<id>
+	limit is the user's limit for the route, STATIC_LIMIT if none is set
+
+a Redis backed Store would do the same Take in one Lua script
+*/
+
+// Clock returns the current time, tests replace it
+type Clock func() time.Time
+
+type Store interface {
+	Take(key string, limit int, window time.Duration) (allowed bool, remaining int, resetIn time.Duration, err error)
+}
+
+type storeEntry struct {
+	remaining int
+	reset     time.Time
+}
+
+// MemoryStore keeps the counters in process memory
+type MemoryStore struct {
+	entries map[string]*storeEntry
+	clock   Clock
+	takes   int
+	mu      *sync.Mutex
+}
+
+// sweepEvery is how many Takes pass between removing expired keys
+const sweepEvery = 1024
+
+func NewMemoryStore(clock Clock) *MemoryStore {
+	if clock == nil {
+		clock = time.Now
+	}
+	return &MemoryStore{
+		entries: make(map[string]*storeEntry),
+		clock:   clock,
+		mu:      &sync.Mutex{},
+	}
+}
+
+func (ms *MemoryStore) Take(key string, limit int, window time.Duration) (bool, int, time.Duration, error) {
+	if limit < 0 || window <= 0 {
+		return false, 0, 0, errors.New("limit must not be negative and window must be positive")
+	}
+
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	now := ms.clock()
+	ms.takes++
+	if ms.takes%sweepEvery == 0 {
+		for k, e := range ms.entries {
+			if !now.Before(e.reset) {
+				delete(ms.entries, k)
+			}
+		}
+	}
+
+	entry, exists := ms.entries[key]
+	if !exists || !now.Before(entry.reset) {
+		entry = &storeEntry{remaining: limit, reset: now.Add(window)}
+		ms.entries[key] = entry
+	}
+	// a lowered limit applies right away, not only from the next window
+	entry.remaining = min(entry.remaining, limit)
+
+	if entry.remaining <= 0 {
+		return false, 0, entry.reset.Sub(now), nil
+	}
+	entry.remaining--
+	return true, entry.remaining, entry.reset.Sub(now), nil
+}
+
+type storeRequest struct {
+	Key    string
+	Limit  int
+	Window time.Duration
+}
+
+type storeResponse struct {
+	Allowed   bool
+	Remaining int
+	ResetIn   time.Duration
+	Err       string
+}
+
+// StoreServer serves a Store to RemoteStores
+type StoreServer struct {
+	store    Store
+	listener net.Listener
+	conns    map[net.Conn]struct{}
+	closed   bool
+	wg       sync.WaitGroup
+	mu       *sync.Mutex
+}
+
+func NewStoreServer(store Store) *StoreServer {
+	return &StoreServer{
+		store: store,
+		conns: make(map[net.Conn]struct{}),
+		mu:    &sync.Mutex{},
+	}
+}
+
+// Serve accepts connections on l until Close
+func (ss *StoreServer) Serve(l net.Listener) error {
+	ss.mu.Lock()
+	if ss.closed {
+		ss.mu.Unlock()
+		l.Close()
+		return errors.New("store server is closed")
+	}
+	ss.listener = l
+	ss.mu.Unlock()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			ss.mu.Lock()
+			closed := ss.closed
+			ss.mu.Unlock()
+			if closed {
+				return nil
+			}
+			return err
+		}
+
+		ss.mu.Lock()
+		if ss.closed {
+			ss.mu.Unlock()
+			conn.Close()
+			return nil
+		}
+		ss.conns[conn] = struct{}{}
+		ss.wg.Add(1)
+		ss.mu.Unlock()
+
+		go ss.handle(conn)
+	}
+}
+
+func (ss *StoreServer) handle(conn net.Conn) {
+	defer ss.wg.Done()
+	defer func() {
+		ss.mu.Lock()
+		delete(ss.conns, conn)
+		ss.mu.Unlock()
+		conn.Close()
+	}()
+
+	dec := gob.NewDecoder(conn)
+	enc := gob.NewEncoder(conn)
+	for {
+		var req storeRequest
+		if err := dec.Decode(&req); err != nil {
+			return
+		}
+		var resp storeResponse
+		allowed, remaining, resetIn, err := ss.store.Take(req.Key, req.Limit, req.Window)
+		if err != nil {
+			resp.Err = err.Error()
+		} else {
+			resp = storeResponse{Allowed: allowed, Remaining: remaining, ResetIn: resetIn}
+		}
+		if err := enc.Encode(resp); err != nil {
+			return
+		}
+	}
+}
+
+// Close stops accepting, drops every connection and waits for the handlers
+func (ss *StoreServer) Close() error {
+	ss.mu.Lock()
+	ss.closed = true
+	var err error
+	if ss.listener != nil {
+		err = ss.listener.Close()
+	}
+	for conn := range ss.conns {
+		conn.Close()
+	}
+	ss.mu.Unlock()
+
+	ss.wg.Wait()
+	return err
+}
+
+// DefaultStoreTimeout is the RemoteStore timeout when DialStore gets none
+const DefaultStoreTimeout = time.Second
+
+// RemoteStore is a Store living in a StoreServer, it redials after an error
+type RemoteStore struct {
+	addr    string
+	timeout time.Duration // per dial and per Take round trip
+	conn    net.Conn
+	enc     *gob.Encoder
+	dec     *gob.Decoder
+	mu      *sync.Mutex
+}
+
+// DialStore connects to the StoreServer at addr. A dial or a Take taking
+// longer than timeout fails, 0 means DefaultStoreTimeout.
+func DialStore(addr string, timeout time.Duration) (*RemoteStore, error) {
+	if timeout < 0 {
+		return nil, errors.New("store timeout must not be negative")
+	}
+	if timeout == 0 {
+		timeout = DefaultStoreTimeout
+	}
+	rs := &RemoteStore{addr: addr, timeout: timeout, mu: &sync.Mutex{}}
+	if err := rs.dial(); err != nil {
+		return nil, err
+	}
+	return rs, nil
+}
+
+func (rs *RemoteStore) dial() error {
+	conn, err := net.DialTimeout("tcp", rs.addr, rs.timeout)
+	if err != nil {
+		return err
+	}
+	rs.conn = conn
+	rs.enc = gob.NewEncoder(conn)
+	rs.dec = gob.NewDecoder(conn)
+	return nil
+}
+
+func (rs *RemoteStore) Take(key string, limit int, window time.Duration) (bool, int, time.Duration, error) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	if rs.conn == nil {
+		if err := rs.dial(); err != nil {
+			return false, 0, 0, err
+		}
+	}
+
+	// rs.mu is held for the round trip, a server that stopped answering must
+	// not hold up every other Take
+	var resp storeResponse
+	err := rs.conn.SetDeadline(time.Now().Add(rs.timeout))
+	if err == nil {
+		err = rs.enc.Encode(storeRequest{Key: key, Limit: limit, Window: window})
+	}
+	if err == nil {
+		err = rs.dec.Decode(&resp)
+	}
+	if err != nil {
+		// a timeout leaves half a message on the connection, start over
+		rs.conn.Close()
+		rs.conn = nil
+		return false, 0, 0, err
+	}
+	if resp.Err != "" {
+		return false, 0, 0, errors.New(resp.Err)
+	}
+	return resp.Allowed, resp.Remaining, resp.ResetIn, nil
+}
+
+func (rs *RemoteStore) Close() error {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	if rs.conn == nil {
+		return nil
+	}
+	err := rs.conn.Close()
+	rs.conn = nil
+	return err
+}
+
+// StoreAlgo limits every user to its limit per route per window, counted in
+// a Store shared by all the RateLimiters using it
+type StoreAlgo struct {
+	store    Store
+	window   time.Duration
+	failOpen bool  // let requests through while the store is unreachable
+	clock    Clock // turns the store's resetIn into Decision.Reset
+}
+
+func NewStoreAlgo(store Store, window time.Duration, failOpen bool, clock Clock) *StoreAlgo {
+	sa := &StoreAlgo{store: store, window: window, failOpen: failOpen, clock: clock}
+	sa.Initalize()
+	return sa
+}
+
+func (sa *StoreAlgo) Initalize() {
+	if sa.window <= 0 {
+		sa.window = 1 * time.Second
+	}
+	if sa.clock == nil {
+		sa.clock = time.Now
+	}
+}
+
+func storeKey(userId int, routeId int) string {
+	return fmt.Sprintf("user:%d:route:%d", userId, routeId)
+}
+
+func (sa *StoreAlgo) Evaluate(user *User, routeId int) bool {
+	return sa.Decide(user, routeId).Allowed
+}
+
+func (sa *StoreAlgo) Decide(user *User, routeId int) Decision {
+	limit := limitOf(user, routeId, STATIC_LIMIT)
+	allowed, remaining, resetIn, err := sa.store.Take(storeKey(user.id, routeId), limit, sa.window)
+	if err != nil {
+		fmt.Println("rate limit store error ", err)
+		decision := Decision{Allowed: sa.failOpen, Limit: limit}
+		if !sa.failOpen {
+			decision.RetryAfter = sa.window
+		}
+		return decision
+	}
+
+	decision := Decision{Allowed: allowed, Limit: limit, Remaining: remaining, Reset: sa.clock().Add(resetIn)}
+	if !allowed {
+		decision.RetryAfter = resetIn
+	}
+	return decision
+}
+
+// the store starts new windows itself, there is no update loop
+func (sa *StoreAlgo) getDuration() time.Duration {
+	return 0
+}
+
+func (sa *StoreAlgo) updateTheLimits(users map[int]*User) {}
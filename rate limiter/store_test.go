@@ -0,0 +1,207 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var baseTime = time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+// fakeClock is a Clock tests move by hand
+type fakeClock struct {
+	now time.Time
+	mu  sync.Mutex
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: baseTime}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+func TestMemoryStoreWindow(t *testing.T) {
+	clock := newFakeClock()
+	store := NewMemoryStore(clock.Now)
+
+	for want := 2; want >= 0; want-- {
+		allowed, remaining, resetIn, err := store.Take("k", 3, time.Second)
+		if err != nil || !allowed || remaining != want || resetIn != time.Second {
+			t.Fatalf("take: %v %d %v %v, want allowed with %d left", allowed, remaining, resetIn, err, want)
+		}
+	}
+	if allowed, _, _, _ := store.Take("k", 3, time.Second); allowed {
+		t.Error("fourth request in the window allowed")
+	}
+	if allowed, _, _, _ := store.Take("other", 3, time.Second); !allowed {
+		t.Error("keys share a counter")
+	}
+
+	clock.Advance(300 * time.Millisecond)
+	if _, _, resetIn, _ := store.Take("k", 3, time.Second); resetIn != 700*time.Millisecond {
+		t.Errorf("reset in %v after 300ms, want 700ms", resetIn)
+	}
+	clock.Advance(700 * time.Millisecond)
+	if allowed, remaining, _, _ := store.Take("k", 3, time.Second); !allowed || remaining != 2 {
+		t.Errorf("new window: %v with %d left", allowed, remaining)
+	}
+	if _, _, _, err := store.Take("k", 3, 0); err == nil {
+		t.Error("zero window accepted")
+	}
+}
+
+// serveStore runs a StoreServer for store on a free local port
+func serveStore(t *testing.T, store Store) (*StoreServer, string) {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := NewStoreServer(store)
+	go server.Serve(l)
+	t.Cleanup(func() { server.Close() })
+	return server, l.Addr().String()
+}
+
+// newReplica is one gateway replica limiting user 42 on route 7 through the store at addr
+func newReplica(t *testing.T, addr string, limit int) *RateLimiter {
+	t.Helper()
+
+	store, err := DialStore(addr, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+
+	rl := NewRateLimiter(NewStoreAlgo(store, time.Minute, false, nil))
+	rl.AddARoute(Route{id: 7, name: "payment_create", endpoint: "/payment/create", method: "POST"})
+	rl.AddAUser(User{id: 42})
+	rl.ChangeTheLimit(42, 7, limit)
+	return rl
+}
+
+func TestReplicasShareTheLimit(t *testing.T) {
+	_, addr := serveStore(t, NewMemoryStore(nil))
+
+	const limit, replicas, perReplica = 10, 3, 20
+	var allowed atomic.Int64
+	var wg sync.WaitGroup
+	for i := 0; i < replicas; i++ {
+		rl := newReplica(t, addr, limit)
+		for j := 0; j < perReplica; j++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if rl.UserRequest(42, 7) == nil {
+					allowed.Add(1)
+				}
+			}()
+		}
+	}
+	wg.Wait()
+
+	if got := allowed.Load(); got != limit {
+		t.Errorf("%d requests allowed across %d replicas, want %d", got, replicas, limit)
+	}
+}
+
+func TestStoreAlgoUnreachableStore(t *testing.T) {
+	server, addr := serveStore(t, NewMemoryStore(nil))
+	store, err := DialStore(addr, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	user := &User{id: 1, limits: map[int]int{}, mu: &sync.Mutex{}}
+
+	server.Close()
+	closed := NewStoreAlgo(store, time.Second, false, nil)
+	open := NewStoreAlgo(store, time.Second, true, nil)
+	if closed.Evaluate(user, 1) {
+		t.Error("fail closed algo allowed a request without a store")
+	}
+	if !open.Evaluate(user, 1) {
+		t.Error("fail open algo throttled a request without a store")
+	}
+
+	// the client redials once a store is back
+	_, addr = serveStore(t, NewMemoryStore(nil))
+	store.addr = addr
+	if !closed.Evaluate(user, 1) {
+		t.Error("request throttled after the store came back")
+	}
+}
+
+func TestStoreAlgoDecisionOnAlgoClock(t *testing.T) {
+	clock := newFakeClock()
+	algo := NewStoreAlgo(NewMemoryStore(clock.Now), time.Second, false, clock.Now)
+	user := &User{id: 1, limits: map[int]int{1: 1}, mu: &sync.Mutex{}}
+
+	if decision := algo.Decide(user, 1); !decision.Allowed || !decision.Reset.Equal(baseTime.Add(time.Second)) {
+		t.Fatalf("first request %+v, want allowed until %v", decision, baseTime.Add(time.Second))
+	}
+	clock.Advance(400 * time.Millisecond)
+	decision := algo.Decide(user, 1)
+	if decision.Allowed || decision.RetryAfter != 600*time.Millisecond {
+		t.Errorf("second request %+v, want throttled for 600ms", decision)
+	}
+}
+
+func TestRemoteStoreTimeout(t *testing.T) {
+	// accepts connections and never answers
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	store, err := DialStore(l.Addr().String(), 50*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	start := time.Now()
+	var netErr net.Error
+	if _, _, _, err := store.Take("k", 1, time.Second); !errors.As(err, &netErr) || !netErr.Timeout() {
+		t.Errorf("take on a stalled store returned %v, want a timeout", err)
+	}
+	if took := time.Since(start); took > time.Second {
+		t.Errorf("take on a stalled store took %v", took)
+	}
+
+	user := &User{id: 1, limits: map[int]int{}, mu: &sync.Mutex{}}
+	if !NewStoreAlgo(store, time.Second, true, nil).Evaluate(user, 1) {
+		t.Error("fail open algo throttled a request on a stalled store")
+	}
+	if NewStoreAlgo(store, time.Second, false, nil).Evaluate(user, 1) {
+		t.Error("fail closed algo allowed a request on a stalled store")
+	}
+
+	if _, err := DialStore(l.Addr().String(), -time.Second); err == nil {
+		t.Error("negative timeout accepted")
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import "sync"
+
+/*
+
+loadGroup - singleflight for GetOrLoad
+- the first caller for a key runs the loader
+- callers that arrive while it runs wait and share its result
+
+Same idea as golang.org/x/sync/singleflight used by the race-in-cache
+exercise, typed and without the extra dependency. The root Cache and
+cache/generic.go run the same loadGroup, the two copies of this file are
+kept identical since each directory builds its own program.
+
+*/
+
+type loadCall[V any] struct {
+	wg  sync.WaitGroup
+	val V
+	err error
+}
+
+type loadGroup[K comparable, V any] struct {
+	mu    sync.Mutex
+	calls map[K]*loadCall[V]
+}
+
+// Do runs fn once per key at a time, shared reports whether the result came
+// from another caller's run
+func (g *loadGroup[K, V]) Do(key K, fn func() (V, error)) (val V, err error, shared bool) {
+	g.mu.Lock()
+	if g.calls == nil {
+		g.calls = make(map[K]*loadCall[V])
+	}
+	if call, exists := g.calls[key]; exists {
+		g.mu.Unlock()
+		call.wg.Wait()
+		return call.val, call.err, true
+	}
+
+	call := &loadCall[V]{}
+	call.wg.Add(1)
+	g.calls[key] = call
+	g.mu.Unlock()
+
+	defer func() {
+		g.mu.Lock()
+		delete(g.calls, key)
+		g.mu.Unlock()
+		call.wg.Done()
+	}()
+
+	call.val, call.err = fn()
+	return call.val, call.err, false
+}